@@ -7,7 +7,7 @@ function build()
 {
     echo "build"
     GOOS=linux GOARCH=amd64 go build .
-    zip ${STACK_NAME}-${GITHUB_SHA}.zip ${STACK_NAME}
+    zip -r ${STACK_NAME}-${GITHUB_SHA}.zip ${STACK_NAME} policies
 }
 
 function moveFiles()
@@ -64,7 +64,7 @@ function deleteStack()
 
 function testCode()
 {
-    TEST_CODE=true DB_DATABASE=tester DB_TABLE=agent DB_HOSTNAME=0.0.0.0 DB_PORT=5432 DB_USERNAME=postgres DB_PASSWORD=tester go test ./...
+    TEST_CODE=true DB_DATABASE=tester DB_TABLE=agent DB_HOSTNAME=0.0.0.0 DB_PORT=5432 DB_USERNAME=postgres DB_PASSWORD=tester DYNAMODB_ENDPOINT=http://0.0.0.0:8000 go test ./...
     echo "----"
     echo "---- Benchmarks ----"
     echo "----"
@@ -76,8 +76,8 @@ function testDatabase()
     echo "testDatabase"
     docker run -d -p 5432:5432 -e POSTGRES_PASSWORD=tester -e POSGRES_USERNAME=tester -e POSTGRES_DB=tester --name tester_postgres postgres:11.5
     sleep 10
-    docker exec -e PGPASSWORD=tester tester_postgres psql -U postgres -d tester -c "DROP TABLE "public"."agent";"
-    docker exec -e PGPASSWORD=tester tester_postgres psql -U postgres -d tester -c "CREATE TABLE "public"."agent" ("id" uuid, "name" varchar(200), "key" uuid, "secret" uuid, "company_id" uuid, PRIMARY KEY ("id"));"
+    docker exec -i -e PGPASSWORD=tester tester_postgres psql -U postgres -d tester < .ci/dev/structure.sql
+    docker run -d -p 8000:8000 --name tester_dynamodb amazon/dynamodb-local
 }
 
 function cloudFormation()
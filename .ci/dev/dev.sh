@@ -13,14 +13,24 @@ function createDatabase()
     postgres:11.5
 }
 
+function createDynamo()
+{
+  echo "createDynamo"
+  docker run \
+    -d \
+    -p 8000:8000 \
+    --name tester_dynamodb \
+    amazon/dynamodb-local
+}
+
 function injectStructure()
 {
   echo "injectStructure"
   docker exec \
+    -i \
     -e PGPASSWORD=tester tester_postgres psql \
     -U postgres \
-    -d postgres \
-    -c "CREATE TABLE "public"."agent" ("id" uuid, "name" varchar(200), "key" uuid, "secret" uuid, "company_id" uuid, PRIMARY KEY ("id"));"
+    -d postgres < .ci/dev/structure.sql
 }
 
 function wipeDatabase()
@@ -31,13 +41,13 @@ function wipeDatabase()
     -d postgres \
     --host 0.0.0.0 \
     --port 5432 \
-    -c "DROP TABLE "public"."agent";"
+    -c "DROP SCHEMA public CASCADE; CREATE SCHEMA public;"
 }
 
 function testCode()
 {
     echo "testCode"
-    go test ./...
+    DYNAMODB_ENDPOINT=http://0.0.0.0:8000 go test ./...
     go test ./... -bench=. -run=$$$
 }
 
@@ -46,6 +56,7 @@ if [[ ! -z ${1} ]] || [[ "${1}" != "" ]]; then
     ${1}
 else
     createDatabase
+    createDynamo
     sleep 5
     injectStructure
     testCode
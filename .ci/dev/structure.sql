@@ -8,11 +8,180 @@ CREATE TABLE "public"."agent" (
                                   "company_id" uuid,
                                   PRIMARY KEY ("id")
 );
---
--- CREATE TABLE "public"."company" (
---                                     "id" uuid,
---                                     "name" varchar(200),
---                                     PRIMARY KEY ("id")
--- );
---
--- ALTER TABLE "agent" ADD FOREIGN KEY ("companyId") REFERENCES "company" ("id");
+
+CREATE TABLE "public"."company" (
+                                    "id"   uuid,
+                                    "name" varchar(200),
+                                    "plan" varchar(50),
+                                    PRIMARY KEY ("id")
+);
+
+-- roles, what an agent can call is the union of its own roles and its company's roles
+CREATE TABLE "public"."role" (
+                                 "id"   uuid,
+                                 "name" varchar(100) UNIQUE NOT NULL,
+                                 PRIMARY KEY ("id")
+);
+
+CREATE TABLE "public"."role_permission" (
+                                            "role_id"  uuid REFERENCES "role" ("id") ON DELETE CASCADE,
+                                            "verb"     varchar(10)  NOT NULL,
+                                            "resource" varchar(200) NOT NULL,
+                                            PRIMARY KEY ("role_id", "verb", "resource")
+);
+
+CREATE TABLE "public"."role_inherit" (
+                                         "role_id"     uuid REFERENCES "role" ("id") ON DELETE CASCADE,
+                                         "inherits_id" uuid REFERENCES "role" ("id") ON DELETE CASCADE,
+                                         PRIMARY KEY ("role_id", "inherits_id")
+);
+
+CREATE TABLE "public"."agent_role" (
+                                       "agent_id" uuid REFERENCES "agent" ("id") ON DELETE CASCADE,
+                                       "role_id"  uuid REFERENCES "role" ("id") ON DELETE CASCADE,
+                                       PRIMARY KEY ("agent_id", "role_id")
+);
+
+CREATE TABLE "public"."company_role" (
+                                         "company_id" uuid,
+                                         "role_id"    uuid REFERENCES "role" ("id") ON DELETE CASCADE,
+                                         PRIMARY KEY ("company_id", "role_id")
+);
+
+INSERT INTO "role" ("id", "name") VALUES
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0001', 'ingest'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0002', 'dashboard'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0003', 'company-admin'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0004', 'operator');
+
+INSERT INTO "role_permission" ("role_id", "verb", "resource") VALUES
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0001', 'POST', 'bug'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0001', 'POST', 'log'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0002', 'GET', 'bug'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0002', 'GET', 'bug/*'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0002', 'GET', 'log'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0002', 'GET', 'log/*'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0003', '*', 'agent'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0003', '*', 'agent/*'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0003', '*', 'company'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0004', '*', '*');
+
+INSERT INTO "role_inherit" ("role_id", "inherits_id") VALUES
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0003', '0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0001'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0003', '0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0002'),
+  ('0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0004', '0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0003');
+
+-- agents from before roles could call everything, they keep that as operators until
+-- they're given narrower roles
+INSERT INTO "agent_role" ("agent_id", "role_id")
+SELECT "agent"."id", '0b6b3f4e-6d0a-4c1e-9a57-0e5f3f1d0004' FROM "agent"
+WHERE NOT EXISTS (SELECT 1 FROM "agent_role" WHERE "agent_role"."agent_id" = "agent"."id");
+
+-- scopes narrow a key to part of what its roles allow, NULL is an unscoped key
+ALTER TABLE "agent" ADD COLUMN "scopes" varchar(50)[];
+
+-- token buckets for rate limiting shared between containers
+CREATE TABLE "public"."rate_limit" (
+                                       "key"        varchar(100),
+                                       "tokens"     double precision NOT NULL,
+                                       "allowed"    boolean NOT NULL,
+                                       "updated_at" timestamptz NOT NULL,
+                                       PRIMARY KEY ("key")
+);
+
+-- api gateway api key values for usage plans, an agent without one uses its company's
+ALTER TABLE "agent" ADD COLUMN "usage_key" varchar(128);
+ALTER TABLE "company" ADD COLUMN "usage_key" varchar(128);
+
+-- accepted requests per company per month, written in batches by each container
+CREATE TABLE "public"."quota" (
+                                  "company_id" uuid,
+                                  "period"     char(7),
+                                  "count"      bigint NOT NULL DEFAULT 0,
+                                  PRIMARY KEY ("company_id", "period")
+);
+
+-- failed attempts per api key, agent id and source ip, and how long each is locked out for
+CREATE TABLE "public"."lockout" (
+                                    "key"          varchar(200),
+                                    "failures"     integer NOT NULL DEFAULT 0,
+                                    "lockouts"     integer NOT NULL DEFAULT 0,
+                                    "last_failure" timestamptz NOT NULL,
+                                    "locked_until" timestamptz NOT NULL,
+                                    PRIMARY KEY ("key")
+);
+
+-- networks an agent's credentials can and can't be used from, a company's lists apply to all of its agents
+ALTER TABLE "agent" ADD COLUMN "ip_allow" cidr[];
+ALTER TABLE "agent" ADD COLUMN "ip_deny" cidr[];
+ALTER TABLE "company" ADD COLUMN "ip_allow" cidr[];
+ALTER TABLE "company" ADD COLUMN "ip_deny" cidr[];
+
+-- when an agent's credentials start and stop working, null for no bound
+ALTER TABLE "agent" ADD COLUMN "not_before" timestamptz;
+ALTER TABLE "agent" ADD COLUMN "expires_at" timestamptz;
+
+-- every secret an agent has had, any that hasn't retired works so a secret can be rotated without breaking deployed SDKs
+CREATE TABLE "public"."agent_secret" (
+                                         "agent_id"     uuid REFERENCES "agent" ("id") ON DELETE CASCADE,
+                                         "generation"   integer      NOT NULL,
+                                         "secret"       varchar(200) NOT NULL,
+                                         "status"       varchar(20)  NOT NULL DEFAULT 'primary',
+                                         "created_at"   timestamptz  NOT NULL DEFAULT now(),
+                                         "retires_at"   timestamptz,
+                                         "last_used_at" timestamptz,
+                                         PRIMARY KEY ("agent_id", "generation")
+);
+CREATE INDEX "agent_secret_secret" ON "agent_secret" ("agent_id", "secret");
+
+INSERT INTO "agent_secret" ("agent_id", "generation", "secret", "status")
+  SELECT "id", 1, "secret", 'primary' FROM "agent" WHERE "secret" IS NOT NULL;
+ALTER TABLE "agent" DROP COLUMN "secret";
+
+-- revoked credentials, each revocation gets the next version so warm containers only read the new ones
+ALTER TABLE "agent" ADD COLUMN "revoked_at" timestamptz;
+CREATE TABLE "public"."revocation" (
+                                       "version"    bigserial,
+                                       "agent_id"   uuid        NOT NULL,
+                                       "revoked_at" timestamptz NOT NULL,
+                                       PRIMARY KEY ("version")
+);
+
+-- company lifecycle and the limits a company has instead of its plan's, zero keeps the plan's
+ALTER TABLE "company" ADD COLUMN "status" varchar(20) NOT NULL DEFAULT 'active'
+  CHECK ("status" IN ('active', 'trial', 'suspended', 'deleted'));
+ALTER TABLE "company" ADD COLUMN "monthly_quota" bigint;
+ALTER TABLE "company" ADD COLUMN "rate_limit" real;
+ALTER TABLE "company" ADD COLUMN "rate_burst" real;
+
+INSERT INTO "company" ("id", "name")
+  SELECT DISTINCT "company_id", '' FROM "agent" WHERE "company_id" IS NOT NULL
+  ON CONFLICT ("id") DO NOTHING;
+ALTER TABLE "agent" ADD FOREIGN KEY ("company_id") REFERENCES "company" ("id");
+
+-- agent lifecycle, paused-ingest agents can still read, and who changed it and why
+ALTER TABLE "agent" ADD COLUMN "status" varchar(20) NOT NULL DEFAULT 'active'
+  CHECK ("status" IN ('active', 'disabled', 'paused-ingest', 'deleted'));
+CREATE TABLE "public"."agent_status_change" (
+                                                "id"          bigserial,
+                                                "agent_id"    uuid         NOT NULL,
+                                                "from_status" varchar(20)  NOT NULL,
+                                                "to_status"   varchar(20)  NOT NULL,
+                                                "changed_by"  varchar(200) NOT NULL,
+                                                "note"        text         NOT NULL DEFAULT '',
+                                                "changed_at"  timestamptz  NOT NULL DEFAULT now(),
+                                                PRIMARY KEY ("id")
+);
+CREATE INDEX "agent_status_change_agent" ON "agent_status_change" ("agent_id", "changed_at");
+
+-- revocation versions come from a counter row each revocation holds until it commits, so they
+-- commit in version order and a container polling past one can't miss another still in flight
+CREATE TABLE "public"."revocation_version" (
+                                               "version" bigint NOT NULL
+);
+INSERT INTO "revocation_version" ("version") SELECT COALESCE(MAX("version"), 0) FROM "revocation";
+ALTER TABLE "revocation" ALTER COLUMN "version" DROP DEFAULT;
+DROP SEQUENCE "revocation_version_seq";
+
+-- a new container reads the revocations recent enough to be in the shared identity cache
+CREATE INDEX "revocation_revoked_at" ON "revocation" ("revoked_at");
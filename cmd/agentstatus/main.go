@@ -0,0 +1,84 @@
+// Command agentstatus disables, pauses or deletes an agent without losing its
+// history, every change is recorded with who made it, using the DB_* environment
+//
+//	agentstatus set -agent ad4b99e1-dec8-4682-862a-6b017e7c7c70 -to paused-ingest -by alice -note "runaway sdk"
+//	agentstatus history -agent ad4b99e1-dec8-4682-862a-6b017e7c7c70
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bugfixes/authorizer/service"
+	"github.com/bugfixes/authorizer/service/store"
+)
+
+func main() {
+	if err := service.RequirePostgresStore(); err != nil {
+		fmt.Fprintf(os.Stderr, "agentstatus: %v\n", err)
+		os.Exit(1)
+	}
+
+	p, err := store.NewPostgres(service.ConnectDetailsFromEnv())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "agentstatus: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := run(os.Args[1:], p, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "agentstatus: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, k store.StatusKeeper, stdout io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected set or history")
+	}
+	command := args[0]
+
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	agent := fs.String("agent", "", "agent id")
+	to := fs.String("to", "", "status to set, active, disabled, paused-ingest or deleted")
+	by := fs.String("by", os.Getenv("USER"), "who is making the change")
+	note := fs.String("note", "", "why the change is being made")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *agent == "" {
+		return fmt.Errorf("expected -agent")
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "set":
+		c, err := k.SetStatus(ctx, *agent, *to, *by, *note)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s: %s -> %s\n", c.AgentID, c.From, c.To)
+	case "history":
+		changes, err := k.StatusHistory(ctx, *agent)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			fmt.Fprintf(stdout, "%s: no changes\n", *agent)
+		}
+		for _, c := range changes {
+			fmt.Fprintf(stdout, "%s %s -> %s by %s", c.At.UTC().Format(time.RFC3339), c.From, c.To, c.By)
+			if c.Note != "" {
+				fmt.Fprintf(stdout, ": %s", c.Note)
+			}
+			fmt.Fprintln(stdout)
+		}
+	default:
+		return fmt.Errorf("unknown command: %s", command)
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	m := &store.Memory{
+		Agents: []store.MemoryAgent{
+			{Agent: store.Agent{ID: "ad4b99e1-dec8-4682-862a-6b017e7c7c70"}},
+		},
+	}
+
+	out := bytes.Buffer{}
+	assert.NoError(t, run([]string{"history", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70"}, m, &out))
+	assert.Equal(t, "ad4b99e1-dec8-4682-862a-6b017e7c7c70: no changes\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, run([]string{"set", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "-to", "paused-ingest", "-by", "alice", "-note", "runaway sdk"}, m, &out))
+	assert.Equal(t, "ad4b99e1-dec8-4682-862a-6b017e7c7c70: active -> paused-ingest\n", out.String())
+	assert.Equal(t, store.AgentPausedIngest, m.Agents[0].Status)
+
+	out.Reset()
+	assert.NoError(t, run([]string{"set", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "-to", "active", "-by", "bob"}, m, &out))
+	out.Reset()
+	assert.NoError(t, run([]string{"history", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70"}, m, &out))
+	assert.Contains(t, out.String(), " active -> paused-ingest by alice: runaway sdk\n")
+	assert.Contains(t, out.String(), " paused-ingest -> active by bob\n")
+
+	assert.Error(t, run(nil, m, &out))
+	assert.Error(t, run([]string{"set", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "-to", "sleeping", "-by", "alice"}, m, &out))
+	assert.Error(t, run([]string{"set", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "-to", "disabled", "-by", ""}, m, &out))
+	assert.Error(t, run([]string{"set", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c71", "-to", "disabled", "-by", "alice"}, m, &out))
+	assert.Error(t, run([]string{"history"}, m, &out))
+	assert.Error(t, run([]string{"pause", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70"}, m, &out))
+}
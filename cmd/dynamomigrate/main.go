@@ -0,0 +1,82 @@
+// Command dynamomigrate copies every agent, its secrets and the roles from postgres,
+// using the DB_* environment, to the dynamodb tables the dynamodb store reads, using
+// DYNAMO_AGENT_TABLE, DYNAMO_ROLE_TABLE and DYNAMODB_ENDPOINT. It can be run again,
+// agents and roles are replaced, and company roles are copied onto each agent so a
+// change to them needs another run
+//
+//	dynamomigrate -create
+//	dynamomigrate -dry-run
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bugfixes/authorizer/service"
+	"github.com/bugfixes/authorizer/service/store"
+)
+
+func main() {
+	p, err := store.NewPostgres(service.ConnectDetailsFromEnv())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dynamomigrate: %v\n", err)
+		os.Exit(1)
+	}
+	d, err := service.DynamoFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dynamomigrate: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := run(os.Args[1:], p, d, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "dynamomigrate: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, from store.Exporter, to store.Importer, stdout io.Writer) error {
+	fs := flag.NewFlagSet("dynamomigrate", flag.ContinueOnError)
+	create := fs.Bool("create", false, "create the tables first")
+	dryRun := fs.Bool("dry-run", false, "list what would be copied without writing it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	agents, err := from.Export(ctx)
+	if err != nil {
+		return err
+	}
+	roles, err := from.Roles(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range agents {
+		fmt.Fprintf(stdout, "agent %s: company %s, %d secrets, roles %v\n", a.ID, a.CompanyID, len(a.Secrets), a.Roles)
+	}
+	fmt.Fprintf(stdout, "%d agents, %d roles\n", len(agents), len(roles))
+	if *dryRun {
+		return nil
+	}
+
+	if *create {
+		c, ok := to.(interface{ CreateTables(context.Context) error })
+		if !ok {
+			return fmt.Errorf("-create: the store has no tables to create")
+		}
+		if err := c.CreateTables(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := to.Import(ctx, agents, roles); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "copied")
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/bugfixes/authorizer/service/role"
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	from := &store.Memory{
+		Agents: []store.MemoryAgent{
+			{
+				Agent:  store.Agent{ID: "ad4b99e1-dec8-4682-862a-6b017e7c7c70", CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a", Roles: []string{role.Ingest}},
+				Key:    "94365b00-c6df-483f-804e-363312750500",
+				Secret: "f7356946-5814-4b5e-ad45-0348a89576ef",
+			},
+		},
+		RoleDefinitions: role.Roles{
+			role.Ingest: {Name: role.Ingest, Permissions: []policy.Route{policy.NewRoute("POST", "/bug")}},
+		},
+	}
+	to := &store.Memory{}
+
+	out := bytes.Buffer{}
+	assert.NoError(t, run([]string{"-dry-run"}, from, to, &out))
+	assert.Equal(t, "agent ad4b99e1-dec8-4682-862a-6b017e7c7c70: company b9e9153a-028c-4173-a7a8-e5063334416a, 1 secrets, roles [ingest]\n1 agents, 1 roles\n", out.String())
+	assert.Empty(t, to.Agents)
+
+	out.Reset()
+	assert.NoError(t, run(nil, from, to, &out))
+	assert.Contains(t, out.String(), "copied\n")
+	a, err := to.FindAgent(context.Background(), store.Credentials{Key: "94365b00-c6df-483f-804e-363312750500", Secret: "f7356946-5814-4b5e-ad45-0348a89576ef"})
+	assert.NoError(t, err)
+	assert.Equal(t, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", a.ID)
+	assert.Equal(t, 1, a.SecretGeneration)
+	assert.Len(t, to.RoleDefinitions, 1)
+
+	// again replaces rather than adds
+	assert.NoError(t, run(nil, from, to, &out))
+	assert.Len(t, to.Agents, 1)
+
+	assert.Error(t, run([]string{"-create"}, from, to, &out))
+}
@@ -0,0 +1,101 @@
+// Command lockout lets an operator see and clear the lockouts the authorizer has
+// put on an api key, agent id or source ip, using the DB_* environment
+//
+//	lockout show -key 94365b00-c6df-483f-804e-363312750500
+//	lockout clear -key 94365b00-c6df-483f-804e-363312750500 -ip 203.0.113.7
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bugfixes/authorizer/service"
+	"github.com/bugfixes/authorizer/service/lockout"
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	if err := service.RequirePostgresStore(); err != nil {
+		fmt.Fprintf(os.Stderr, "lockout: %v\n", err)
+		os.Exit(1)
+	}
+
+	db, err := sql.Open("postgres", service.ConnectDetailsFromEnv().DSN())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lockout: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := run(os.Args[1:], lockout.NewPostgres(db), os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "lockout: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, s lockout.Store, stdout io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected show or clear")
+	}
+	command := args[0]
+
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	key := fs.String("key", "", "api key")
+	agent := fs.String("agent", "", "agent id")
+	ip := fs.String("ip", "", "source ip")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	var keys []string
+	if *key != "" {
+		keys = append(keys, lockout.KeyFor(*key))
+	}
+	if *agent != "" {
+		keys = append(keys, lockout.AgentFor(*agent))
+	}
+	if *ip != "" {
+		keys = append(keys, lockout.IPFor(*ip))
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("expected at least one of -key, -agent or -ip")
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "show":
+		entries, err := s.Get(ctx, keys...)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, k := range keys {
+			e, ok := entries[k]
+			if !ok {
+				fmt.Fprintf(stdout, "%s: no failures\n", k)
+				continue
+			}
+			state := "not locked"
+			if now.Before(e.LockedUntil) {
+				state = "locked until " + e.LockedUntil.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(stdout, "%s: %s, %d failures, %d lockouts, last failure %s\n", k, state, e.Failures, e.Lockouts, e.LastFailure.UTC().Format(time.RFC3339))
+		}
+	case "clear":
+		g := lockout.NewGuard(s, lockout.DefaultPolicy())
+		for _, k := range keys {
+			if err := g.Clear(ctx, k); err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "%s: cleared\n", k)
+		}
+	default:
+		return fmt.Errorf("unknown command: %s", command)
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/lockout"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	m := lockout.NewMemory()
+	m.Entries[lockout.KeyFor("94365b00-c6df-483f-804e-363312750500")] = lockout.Entry{
+		Failures:    1,
+		Lockouts:    2,
+		LastFailure: time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC),
+		LockedUntil: time.Now().Add(time.Hour),
+	}
+
+	out := bytes.Buffer{}
+	assert.NoError(t, run([]string{"show", "-key", "94365b00-c6df-483f-804e-363312750500", "-ip", "203.0.113.7"}, m, &out))
+	assert.Contains(t, out.String(), "key:94365b00-c6df-483f-804e-363312750500: locked until ")
+	assert.Contains(t, out.String(), ", 1 failures, 2 lockouts, last failure 2021-03-16T10:00:00Z\n")
+	assert.Contains(t, out.String(), "ip:203.0.113.7: no failures\n")
+
+	out.Reset()
+	assert.NoError(t, run([]string{"clear", "-key", "94365b00-c6df-483f-804e-363312750500"}, m, &out))
+	assert.Equal(t, "key:94365b00-c6df-483f-804e-363312750500: cleared\n", out.String())
+	assert.Empty(t, m.Entries)
+
+	assert.Error(t, run(nil, m, &out))
+	assert.Error(t, run([]string{"clear"}, m, &out))
+	assert.Error(t, run([]string{"unlock", "-ip", "203.0.113.7"}, m, &out))
+}
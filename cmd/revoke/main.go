@@ -0,0 +1,68 @@
+// Command revoke stops an agent's credentials working straight away, warm
+// authorizers pick it up within REVOCATION_INTERVAL, using the DB_* environment.
+// When the authorizers share a redis it needs REDIS_ADDR too, so they see it
+//
+//	revoke -agent ad4b99e1-dec8-4682-862a-6b017e7c7c70
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bugfixes/authorizer/service"
+	"github.com/bugfixes/authorizer/service/revocation"
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	if err := service.RequirePostgresStore(); err != nil {
+		fmt.Fprintf(os.Stderr, "revoke: %v\n", err)
+		os.Exit(1)
+	}
+
+	db, err := sql.Open("postgres", service.ConnectDetailsFromEnv().DSN())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "revoke: %v\n", err)
+		os.Exit(1)
+	}
+
+	shared, err := service.RedisFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "revoke: %v\n", err)
+		os.Exit(1)
+	}
+
+	var s revocation.Store = revocation.NewPostgres(db)
+	if shared != nil {
+		s = revocation.NewRedis(shared, s)
+	}
+
+	if err := run(os.Args[1:], s, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "revoke: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, s revocation.Store, stdout io.Writer) error {
+	fs := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	agent := fs.String("agent", "", "agent id")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *agent == "" {
+		return fmt.Errorf("expected -agent")
+	}
+
+	r, err := s.Revoke(context.Background(), *agent)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s: revoked at %s, version %d\n", r.AgentID, r.RevokedAt.UTC().Format(time.RFC3339), r.Version)
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bugfixes/authorizer/service/revocation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	m := revocation.NewMemory()
+
+	out := bytes.Buffer{}
+	assert.NoError(t, run([]string{"-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70"}, m, &out))
+	assert.Contains(t, out.String(), "ad4b99e1-dec8-4682-862a-6b017e7c7c70: revoked at ")
+	assert.Contains(t, out.String(), ", version 1\n")
+	assert.Len(t, m.Revocations, 1)
+
+	assert.Error(t, run(nil, m, &out))
+}
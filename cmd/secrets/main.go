@@ -0,0 +1,105 @@
+// Command secrets rotates an agent's secret without breaking the SDKs using the
+// old one, which keeps working until the overlap is up, using the DB_* environment
+//
+//	secrets list -agent ad4b99e1-dec8-4682-862a-6b017e7c7c70
+//	secrets rotate -agent ad4b99e1-dec8-4682-862a-6b017e7c7c70 -overlap 336h
+//	secrets retire -agent ad4b99e1-dec8-4682-862a-6b017e7c7c70 -generation 1
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bugfixes/authorizer/service"
+	"github.com/bugfixes/authorizer/service/store"
+)
+
+func main() {
+	if err := service.RequirePostgresStore(); err != nil {
+		fmt.Fprintf(os.Stderr, "secrets: %v\n", err)
+		os.Exit(1)
+	}
+
+	p, err := store.NewPostgres(service.ConnectDetailsFromEnv())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "secrets: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := run(os.Args[1:], p, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "secrets: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, r store.Rotator, stdout io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected list, rotate or retire")
+	}
+	command := args[0]
+
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	agent := fs.String("agent", "", "agent id")
+	overlap := fs.Duration("overlap", 14*24*time.Hour, "how long the old secrets keep working after a rotation")
+	generation := fs.Int("generation", 0, "generation of the secret to retire")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *agent == "" {
+		return fmt.Errorf("expected -agent")
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "list":
+		secrets, err := r.Secrets(ctx, *agent)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, s := range secrets {
+			state := "active"
+			switch {
+			case !s.Active(now):
+				state = "retired " + formatTime(s.RetiresAt)
+			case !s.RetiresAt.IsZero():
+				state = "retires " + formatTime(s.RetiresAt)
+			}
+			fmt.Fprintf(stdout, "generation %d: %s, %s, last used %s\n", s.Generation, s.Status, state, formatTime(s.LastUsedAt))
+		}
+	case "rotate":
+		secret, err := store.NewSecret()
+		if err != nil {
+			return err
+		}
+		s, err := r.Rotate(ctx, *agent, secret, *overlap)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "generation %d: %s\n", s.Generation, secret)
+		fmt.Fprintf(stdout, "older secrets retire at %s\n", formatTime(s.CreatedAt.Add(*overlap)))
+	case "retire":
+		if *generation == 0 {
+			return fmt.Errorf("expected -generation")
+		}
+		if err := r.Retire(ctx, *agent, *generation); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "generation %d: retired\n", *generation)
+	default:
+		return fmt.Errorf("unknown command: %s", command)
+	}
+
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	m := &store.Memory{
+		Agents: []store.MemoryAgent{
+			{
+				Agent:  store.Agent{ID: "ad4b99e1-dec8-4682-862a-6b017e7c7c70"},
+				Key:    "94365b00-c6df-483f-804e-363312750500",
+				Secret: "f7356946-5814-4b5e-ad45-0348a89576ef",
+			},
+		},
+	}
+
+	out := bytes.Buffer{}
+	assert.NoError(t, run([]string{"rotate", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "-overlap", "1h"}, m, &out))
+	assert.Regexp(t, regexp.MustCompile(`^generation 2: [0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\nolder secrets retire at `), out.String())
+
+	out.Reset()
+	assert.NoError(t, run([]string{"list", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70"}, m, &out))
+	assert.Regexp(t, regexp.MustCompile(`^generation 1: secondary, retires [^,]+, last used never\ngeneration 2: primary, active, last used never\n$`), out.String())
+
+	out.Reset()
+	assert.Error(t, run([]string{"retire", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "-generation", "2"}, m, &out))
+	assert.NoError(t, run([]string{"retire", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "-generation", "1"}, m, &out))
+	assert.Equal(t, "generation 1: retired\n", out.String())
+
+	assert.Error(t, run(nil, m, &out))
+	assert.Error(t, run([]string{"list"}, m, &out))
+	assert.Error(t, run([]string{"retire", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70"}, m, &out))
+	assert.Error(t, run([]string{"list", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c71"}, m, &out))
+	assert.Error(t, run([]string{"revoke", "-agent", "ad4b99e1-dec8-4682-862a-6b017e7c7c70"}, m, &out))
+}
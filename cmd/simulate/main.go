@@ -0,0 +1,268 @@
+// Command simulate answers "would this request be allowed?" by running an
+// authorizer event through the same pipeline the lambda uses, against postgres
+// or a fixture file, and printing how the decision was made
+//
+//	simulate -event captured.json
+//	simulate -store fixture -fixture .ci/dev/fixture.json -method GET -path /bug/1234 \
+//	  -header x-api-key=94365b00-c6df-483f-804e-363312750571 \
+//	  -header x-api-secret=f7356946-5814-4b5e-ad45-0348a89576ef
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bugfixes/authorizer/service"
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/bugfixes/authorizer/service/replay"
+	"github.com/bugfixes/authorizer/service/store"
+)
+
+const defaultArnPrefix = "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live"
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "simulate: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// headers collects repeated -header name=value flags
+type headers map[string]string
+
+func (h headers) String() string {
+	var pairs []string
+	for k, v := range h {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (h headers) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected name=value, got: %q", s)
+	}
+	h[parts[0]] = parts[1]
+	return nil
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	env := service.ConfigFromEnv()
+	hs := headers{}
+
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	eventFile := fs.String("event", "", "authorizer event json, - reads stdin, otherwise the event is built from the flags below")
+	fs.Var(hs, "header", "request header name=value, can be repeated")
+	method := fs.String("method", "GET", "http method")
+	path := fs.String("path", "/", "request path")
+	arnPrefix := fs.String("arn-prefix", defaultArnPrefix, "methodArn up to and including the stage")
+	sourceIP := fs.String("source-ip", "", "source ip of the request")
+	storeName := fs.String("store", os.Getenv("STORE"), "credential store, postgres, dynamodb or fixture, they're set up from the environment like the lambda's")
+	fixture := fs.String("fixture", fixtureFromEnv(), "fixture file for -store fixture")
+	record := fs.String("record", "", "directory to record the sanitized event and its response in, for service/testdata/replay")
+	name := fs.String("name", "simulated", "name of the recorded case")
+	fs.StringVar(&env.PolicyScope, "scope", env.PolicyScope, "policy scope, method, routes or stage")
+	fs.StringVar(&env.DefaultRoles, "default-roles", env.DefaultRoles, "roles for agents without any")
+	fs.StringVar(&env.ScopeRoutes, "scope-routes", env.ScopeRoutes, "scope to routes mapping json")
+	fs.StringVar(&env.PolicyFile, "policy-file", env.PolicyFile, "rules policy file")
+	fs.StringVar(&env.OPAPolicy, "opa-policy", env.OPAPolicy, "rego policy, bundled or a file")
+	fs.StringVar(&env.OPAPath, "opa-path", env.OPAPath, "opa rule to evaluate")
+	fs.StringVar(&env.OPATimeout, "opa-timeout", env.OPATimeout, "opa evaluation timeout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	event := events.APIGatewayCustomAuthorizerRequestTypeRequest{}
+	switch *eventFile {
+	case "":
+		event = buildEvent(*arnPrefix, *method, *path, *sourceIP, hs)
+	default:
+		e, err := readEvent(*eventFile, stdin)
+		if err != nil {
+			return err
+		}
+		event = e
+		for k, v := range hs {
+			if event.Headers == nil {
+				event.Headers = map[string]string{}
+			}
+			event.Headers[k] = v
+		}
+	}
+
+	s, err := readOnlyStore(*storeName, *fixture)
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+
+	// everything else is as the lambda has it, but a simulated request mustn't use up
+	// a rate limit or quota or count towards a lockout
+	c := env
+	c.RateLimiter = ""
+	c.Quotas = ""
+	c.Lockout = ""
+
+	a, err := service.NewAuthorizer(c, s)
+	if err != nil {
+		return err
+	}
+
+	d, err := a.Decide(context.Background(), event)
+	if err != nil {
+		return err
+	}
+
+	if err := report(stdout, event, d); err != nil {
+		return err
+	}
+
+	if *record != "" {
+		return replay.Record(*record, replay.Case{
+			Name:   *name,
+			Event:  replay.Sanitize(event),
+			Expect: d.Response,
+		})
+	}
+
+	return nil
+}
+
+// fixtureFromEnv is FIXTURE_FILE, or the dev fixture when it isn't set
+func fixtureFromEnv() string {
+	if f := os.Getenv("FIXTURE_FILE"); f != "" {
+		return f
+	}
+	return ".ci/dev/fixture.json"
+}
+
+// readOnlyStore is the store the lambda would use, the flags standing in for STORE and
+// FIXTURE_FILE, made read only so a simulated request doesn't mark a secret as used
+func readOnlyStore(name, fixture string) (store.Store, error) {
+	if err := os.Setenv("STORE", name); err != nil {
+		return nil, err
+	}
+	if err := os.Setenv("FIXTURE_FILE", fixture); err != nil {
+		return nil, err
+	}
+
+	s, err := service.StoreFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	switch rs := s.(type) {
+	case *store.Postgres:
+		rs.ReadOnly = true
+	case *store.Dynamo:
+		rs.ReadOnly = true
+	}
+	return s, nil
+}
+
+func readEvent(file string, stdin io.Reader) (events.APIGatewayCustomAuthorizerRequestTypeRequest, error) {
+	event := events.APIGatewayCustomAuthorizerRequestTypeRequest{}
+
+	var b []byte
+	var err error
+	if file == "-" {
+		b, err = ioutil.ReadAll(stdin)
+	} else {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return event, fmt.Errorf("read event: %w", err)
+	}
+
+	if err := json.Unmarshal(b, &event); err != nil {
+		return event, fmt.Errorf("parse event: %w", err)
+	}
+	return event, nil
+}
+
+func buildEvent(arnPrefix, method, path, sourceIP string, hs headers) events.APIGatewayCustomAuthorizerRequestTypeRequest {
+	method = strings.ToUpper(method)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	event := events.APIGatewayCustomAuthorizerRequestTypeRequest{
+		Type:       "REQUEST",
+		MethodArn:  strings.TrimSuffix(arnPrefix, "/") + "/" + method + path,
+		Path:       path,
+		HTTPMethod: method,
+		Headers:    hs,
+	}
+	event.RequestContext.Identity.SourceIP = sourceIP
+	event.RequestContext.HTTPMethod = method
+	event.RequestContext.Path = path
+
+	return event
+}
+
+func report(w io.Writer, event events.APIGatewayCustomAuthorizerRequestTypeRequest, d service.Decision) error {
+	decision := "deny"
+	if d.Allowed {
+		decision = "allow"
+	}
+
+	var routes []string
+	for _, r := range d.Routes {
+		routes = append(routes, r.String())
+	}
+
+	fmt.Fprintf(w, "request:   %s\n", event.MethodArn)
+	fmt.Fprintf(w, "source ip: %s\n", orNone(d.SourceIP))
+	fmt.Fprintf(w, "decision:  %s\n", decision)
+	fmt.Fprintf(w, "engine:    %s\n", orNone(d.Engine))
+	fmt.Fprintf(w, "rule:      %s\n", orNone(d.Rule))
+	fmt.Fprintf(w, "reason:    %s\n", orNone(d.Reason))
+	fmt.Fprintf(w, "agent:     %s\n", orNone(d.Agent.ID))
+	fmt.Fprintf(w, "company:   %s\n", orNone(d.Agent.CompanyID))
+	if d.Agent.Company.ID != "" {
+		fmt.Fprintf(w, "status:    %s, plan %s\n", orNone(d.Agent.Company.Status), orNone(d.Agent.Company.Plan))
+	}
+	fmt.Fprintf(w, "roles:     %s\n", orNone(strings.Join(d.Roles, ", ")))
+	if d.Agent.Scoped() {
+		fmt.Fprintf(w, "scopes:    %s\n", orNone(strings.Join(d.Agent.Scopes, ", ")))
+	}
+	fmt.Fprintf(w, "routes:    %s\n", orNone(strings.Join(routes, ", ")))
+	fmt.Fprintf(w, "usage key: %s\n", orNone(d.Response.UsageIdentifierKey))
+	if d.Agent.SecretGeneration > 0 {
+		fmt.Fprintf(w, "secret:    generation %d\n", d.Agent.SecretGeneration)
+	}
+	if !d.Agent.ExpiresAt.IsZero() {
+		fmt.Fprintf(w, "expires:   %s\n", d.Agent.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "policy:    %d bytes of %d\n", policySize(d.Response.PolicyDocument), policy.MaxPolicySize)
+
+	b, err := json.MarshalIndent(d.Response, "", "  ")
+	if err != nil {
+		return fmt.Errorf("response marshal: %w", err)
+	}
+	fmt.Fprintf(w, "response:\n%s\n", b)
+
+	return nil
+}
+
+func policySize(doc events.APIGatewayCustomAuthorizerPolicy) int {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		stdin  string
+		expect []string
+		err    bool
+	}{
+		{
+			name: "scoped admin reading a bug",
+			args: []string{
+				"-method", "get", "-path", "bug/1234",
+				"-header", "x-api-key=94365b00-c6df-483f-804e-363312750571",
+				"-header", "x-api-secret=f7356946-5814-4b5e-ad45-0348a89576ef",
+			},
+			expect: []string{
+				"request:   arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/bug/1234\n",
+				"decision:  allow\n",
+				"engine:    grant\n",
+				"agent:     ad4b99e1-dec8-4682-862a-6b017e7c7c71\n",
+				"roles:     company-admin\n",
+				"scopes:    bug:write, bug:read\n",
+				`"Effect": "Allow"`,
+			},
+		},
+		{
+			name: "ingest agent reading a bug",
+			args: []string{
+				"-method", "GET", "-path", "/bug/1234",
+				"-header", "x-agent-id=ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+			},
+			expect: []string{
+				"decision:  deny\n",
+				"reason:    not entitled\n",
+				"routes:    POST /bug, POST /log\n",
+			},
+		},
+		{
+			name: "event from stdin",
+			args: []string{"-event", "-"},
+			stdin: `{
+				"type": "REQUEST",
+				"methodArn": "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+				"headers": {"x-api-key": "94365b00-c6df-483f-804e-363312750570", "x-api-secret": "f7356946-5814-4b5e-ad45-0348a89576ef"}
+			}`,
+			expect: []string{
+				"decision:  allow\n",
+				"agent:     ad4b99e1-dec8-4682-862a-6b017e7c7c70\n",
+			},
+		},
+		{
+			name: "unknown credentials",
+			args: []string{"-method", "POST", "-path", "/bug", "-header", "x-agent-id=nobody"},
+			expect: []string{
+				"decision:  deny\n",
+				"reason:    unknown credentials\n",
+				"agent:     -\n",
+			},
+		},
+		{
+			name: "rules policy file",
+			args: []string{
+				"-policy-file", "../../policies/example.json", "-source-ip", "203.0.113.7",
+				"-method", "POST", "-path", "/bug", "-header", "x-agent-id=ad4b99e1-dec8-4682-862a-6b017e7c7c72",
+			},
+			expect: []string{
+				"decision:  deny\n",
+				"engine:    rules\n",
+				"rule:      block abusive network\n",
+				"reason:    network\n",
+			},
+		},
+		{
+			name: "bad header",
+			args: []string{"-header", "x-agent-id"},
+			err:  true,
+		},
+		{
+			name: "unknown store",
+			args: []string{"-store", "mysql"},
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := append([]string{"-store", "fixture", "-fixture", "../../.ci/dev/fixture.json", "-scope", "method"}, test.args...)
+			out := bytes.Buffer{}
+			err := run(args, strings.NewReader(test.stdin), &out)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			for _, e := range test.expect {
+				assert.Contains(t, out.String(), e)
+			}
+		})
+	}
+}
+
+func TestRunFromEnv(t *testing.T) {
+	for k, v := range map[string]string{
+		"IP_DENYLIST":  "203.0.113.0/24",
+		"RATE_LIMITER": "postgres",
+		"QUOTAS":       "not json",
+		"LOCKOUT":      "postgres",
+	} {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatalf("setenv %s: %v", k, err)
+		}
+		defer func(k string) {
+			_ = os.Unsetenv(k)
+		}(k)
+	}
+
+	// the lambda's settings apply and the stateful ones, that the fixture can't back, are left off
+	out := bytes.Buffer{}
+	err := run([]string{
+		"-store", "fixture", "-fixture", "../../.ci/dev/fixture.json", "-scope", "method",
+		"-source-ip", "203.0.113.7", "-method", "POST", "-path", "/bug",
+		"-header", "x-agent-id=ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+	}, strings.NewReader(""), &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "decision:  deny\n")
+	assert.Contains(t, out.String(), "reason:    ip denied\n")
+}
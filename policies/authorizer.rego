@@ -0,0 +1,23 @@
+package bugfixes.authz
+
+import future.keywords.if
+import future.keywords.in
+
+# networks nothing is accepted from, whoever the agent is
+blocked_networks := ["203.0.113.0/24"]
+
+default decision := {"allow": false, "reason": "not entitled"}
+
+decision := {"allow": true, "context": {"policy": "rego"}} if {
+	input.entitled
+	not blocked
+}
+
+decision := {"allow": false, "reason": "blocked network"} if {
+	blocked
+}
+
+blocked if {
+	some cidr in blocked_networks
+	net.cidr_contains(cidr, input.request.sourceIp)
+}
@@ -0,0 +1,13 @@
+// Package policies builds the bundled policy files into the binary, so they're the
+// ones deployed with it wherever the package is unpacked
+package policies
+
+import (
+	// embed is only used for the go:embed directive
+	_ "embed"
+)
+
+// Authorizer is authorizer.rego, evaluated when OPA_POLICY is bundled
+//
+//go:embed authorizer.rego
+var Authorizer string
@@ -1,39 +1,731 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
-  "os"
+	"net"
+	"strings"
+	"sync"
+	"time"
 
-  "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bugfixes/authorizer/service/ipfilter"
+	"github.com/bugfixes/authorizer/service/lockout"
+	"github.com/bugfixes/authorizer/service/nonce"
+	"github.com/bugfixes/authorizer/service/opa"
 	"github.com/bugfixes/authorizer/service/policy"
-	"github.com/bugfixes/agent"
+	"github.com/bugfixes/authorizer/service/quota"
+	"github.com/bugfixes/authorizer/service/ratelimit"
+	"github.com/bugfixes/authorizer/service/revocation"
+	"github.com/bugfixes/authorizer/service/rules"
+	"github.com/bugfixes/authorizer/service/scope"
+	"github.com/bugfixes/authorizer/service/store"
 )
 
-// Handler process request
-func Handler(event events.APIGatewayCustomAuthorizerRequestTypeRequest) (events.APIGatewayCustomAuthorizerResponse, error) {
-  c := agent.ConnectDetails{
-    Host:     os.Getenv("DB_HOSTNAME"),
-    Port:     os.Getenv("DB_PORT"),
-    Username: os.Getenv("DB_USERNAME"),
-    Password: os.Getenv("DB_PASSWORD"),
-    Database: os.Getenv("DB_DATABASE"),
-  }
-
-	agentId, err := c.FindAgentFromHeaders(event.Headers)
-	if err != nil {
-    fmt.Printf("couldnt find agentId from headers: %+v, err: %+v\n", event.Headers, err)
-    return policy.GenerateDeny(events.APIGatewayCustomAuthorizerRequest{
-      Type:               event.Type,
-      AuthorizationToken: agentId,
-      MethodArn:          event.MethodArn,
-    }), nil
-  }
-
-	newEvent := events.APIGatewayCustomAuthorizerRequest{
-		Type:               event.Type,
-		AuthorizationToken: agentId,
-		MethodArn:          event.MethodArn,
-	}
-
-	return policy.GenerateAllow(newEvent), nil
+// Engines that can make the decision
+const (
+	EngineGrant = "grant"
+	EngineRules = "rules"
+	EngineOPA   = "opa"
+)
+
+// Degraded modes, what's done when the store can't answer in time or the breaker
+// has stopped asking it
+const (
+	// DegradedDeny denies with the reason, API Gateway answers 403
+	DegradedDeny = "deny"
+
+	// DegradedError fails the invocation, API Gateway answers 500 and SDKs retry
+	DegradedError = "error"
+)
+
+// DefaultExpiryWarning is how long before credentials expire the ingest API is told to warn about it
+const DefaultExpiryWarning = 14 * 24 * time.Hour
+
+// Authorizer resolves the agent behind a request and builds the policy for its roles
+type Authorizer struct {
+	Store store.Store
+	Scope policy.Scope
+
+	// DefaultRoles are given to agents that have no roles of their own
+	DefaultRoles []string
+
+	// Scopes maps the scopes on a key to the routes they allow
+	Scopes scope.Mapping
+
+	// Rules decide each request when a policy file is configured, instead of granting the routes directly
+	Rules *rules.Engine
+
+	// OPA decides each request using the bundled rego when configured, it takes over from Rules
+	OPA *opa.Engine
+
+	// Limiter counts requests against the limits of the plan, nil turns rate limiting off
+	Limiter ratelimit.Limiter
+	Plans   ratelimit.Plans
+
+	// Quota counts accepted requests against the monthly allowance of the company's plan, nil turns it off
+	Quota      *quota.Tracker
+	Allowances quota.Allowances
+
+	// Lockout locks credentials and source ips out after repeated failures, nil turns it off
+	Lockout *lockout.Guard
+
+	// IPDeny are the networks nothing is let in from, whatever the credentials
+	IPDeny ipfilter.List
+
+	// TrustedProxies are the networks whose X-Forwarded-For is used for the source ip
+	TrustedProxies ipfilter.List
+
+	// Revocations catches agents revoked since they were looked up, nil relies on the store alone
+	Revocations *revocation.Checker
+
+	// ExpiryGrace keeps credentials working for a while after they expire, ExpiryWarning
+	// is how long before they expire the credentialExpiring context flag is set
+	ExpiryGrace   time.Duration
+	ExpiryWarning time.Duration
+
+	// CallBudget is the longest any one backend call can take, zero leaves only the
+	// invocation's deadline, less DeadlineReserve to answer in once a call gives up
+	CallBudget      time.Duration
+	DeadlineReserve time.Duration
+
+	// DegradedMode is DegradedDeny or DegradedError, empty is DegradedDeny
+	DegradedMode string
+
+	// RequireUsageKey denies agents that have no usage key, for when API Gateway
+	// takes the api key from the authorizer and every request has to be metered
+	RequireUsageKey bool
+
+	// Nonces denies a request whose x-request-nonce the agent already used within
+	// NonceTTL, nil turns it off. RequireNonce denies requests without one
+	Nonces       nonce.Store
+	NonceTTL     time.Duration
+	RequireNonce bool
+}
+
+// Decision is everything that went into the response, so a decision can be explained
+type Decision struct {
+	// SourceIP is the client the request came from, after any trusted proxies
+	SourceIP string
+
+	Agent  store.Agent
+	Roles  []string
+	Routes []policy.Route
+
+	// Engine is the one that decided, Rule the rule that matched in the policy file
+	Engine string
+	Rule   string
+
+	// Reason is set when the request was denied before an engine was asked, or when the engine gave one
+	Reason string
+
+	Allowed  bool
+	Response events.APIGatewayCustomAuthorizerResponse
+}
+
+var (
+	envAuthorizer     *Authorizer
+	envAuthorizerErr  error
+	envAuthorizerOnce sync.Once
+)
+
+// Handler process request, the context carries the lambda deadline through to the backend calls
+func Handler(ctx context.Context, event events.APIGatewayCustomAuthorizerRequestTypeRequest) (events.APIGatewayCustomAuthorizerResponse, error) {
+	envAuthorizerOnce.Do(func() {
+		envAuthorizer, envAuthorizerErr = NewAuthorizerFromEnv()
+	})
+	if envAuthorizerErr != nil {
+		fmt.Printf("couldnt create authorizer: %+v\n", envAuthorizerErr)
+		return policy.GenerateDeny(events.APIGatewayCustomAuthorizerRequest{
+			Type:      event.Type,
+			MethodArn: event.MethodArn,
+		}), nil
+	}
+
+	return envAuthorizer.Authorize(ctx, event)
+}
+
+// Authorize decides the policy for a single request
+func (a *Authorizer) Authorize(ctx context.Context, event events.APIGatewayCustomAuthorizerRequestTypeRequest) (events.APIGatewayCustomAuthorizerResponse, error) {
+	d, err := a.Decide(ctx, event)
+	if err != nil {
+		return events.APIGatewayCustomAuthorizerResponse{}, err
+	}
+
+	return d.Response, nil
+}
+
+// Decide runs the request through the whole pipeline and keeps what it found on the way
+func (a *Authorizer) Decide(ctx context.Context, event events.APIGatewayCustomAuthorizerRequestTypeRequest) (Decision, error) {
+	d := Decision{}
+
+	arn, err := policy.ParseARN(event.MethodArn)
+	if err != nil {
+		fmt.Printf("couldnt parse methodArn: %s, err: %+v\n", event.MethodArn, err)
+		d.Reason = "invalid methodArn"
+		d.Response = policy.GenerateDeny(events.APIGatewayCustomAuthorizerRequest{
+			Type:      event.Type,
+			MethodArn: event.MethodArn,
+		})
+		return d, nil
+	}
+
+	clientIP := ipfilter.ClientIP(event.RequestContext.Identity.SourceIP, event.Headers, a.TrustedProxies)
+	if clientIP != nil {
+		d.SourceIP = clientIP.String()
+	}
+	if a.IPDeny.Contains(clientIP) {
+		fmt.Printf("audit denied code=ip_denylisted ip=%s\n", d.SourceIP)
+		d.Reason = "ip denied"
+		d.Response = policy.NewBuilder("system", arn).
+			WithContext("reason", d.Reason).
+			Build()
+		return d, nil
+	}
+
+	creds := store.CredentialsFromHeaders(event.Headers)
+	keys := lockoutKeys(creds, d.SourceIP)
+	status := a.checkLockout(ctx, keys)
+	if status.Locked() {
+		fmt.Printf("audit denied code=%s key=%s until=%s\n", status.Code, status.Key, status.Until.UTC().Format(time.RFC3339))
+		d.Reason = "locked out"
+		d.Response = policy.NewBuilder("system", arn).
+			WithContext("reason", d.Reason).
+			Build()
+		return d, nil
+	}
+
+	agent, err := a.findAgent(ctx, creds)
+	if unavailable(err) {
+		return a.degraded(d, arn, "find_agent", err)
+	}
+	if err != nil {
+		fmt.Printf("couldnt find agent, agentId: %s, key: %s, err: %+v\n", creds.AgentID, creds.Key, err)
+		if errors.Is(err, store.ErrNotFound) && a.Lockout != nil {
+			ctx, cancel := a.budget(ctx)
+			if err := a.Lockout.Fail(ctx, keys...); err != nil {
+				fmt.Printf("couldnt count failure: %+v\n", err)
+			}
+			cancel()
+		}
+		d.Reason = "unknown credentials"
+		d.Response = policy.NewBuilder("system", arn).Build()
+		return d, nil
+	}
+	d.Agent = agent
+
+	if a.revoked(ctx, agent) {
+		fmt.Printf("audit denied code=revoked agent=%s\n", agent.ID)
+		d.Reason = "revoked"
+		d.Response = denied(arn, agent, d.Reason)
+		return d, nil
+	}
+
+	if reason := companyDenial(agent.Company); reason != "" {
+		fmt.Printf("audit denied code=company_%s agent=%s company=%s\n", agent.Company.Status, agent.ID, agent.CompanyID)
+		d.Reason = reason
+		d.Response = denied(arn, agent, d.Reason)
+		return d, nil
+	}
+
+	if reason := agentDenial(agent, arn); reason != "" {
+		fmt.Printf("audit denied code=agent_%s agent=%s %s %s\n", agent.Status, agent.ID, arn.Verb, arn.Resource)
+		d.Reason = reason
+		d.Response = denied(arn, agent, d.Reason)
+		return d, nil
+	}
+
+	reason, expiring := a.checkValidity(agent, time.Now())
+	if reason != "" {
+		fmt.Printf("agent %s credentials %s, not before: %s, expires at: %s\n", agent.ID, reason, agent.NotBefore.Format(time.RFC3339), agent.ExpiresAt.Format(time.RFC3339))
+		d.Reason = reason
+		d.Response = denied(arn, agent, d.Reason)
+		return d, nil
+	}
+
+	if !permittedIP(agent, clientIP) {
+		fmt.Printf("audit denied code=ip_not_allowed agent=%s ip=%s\n", agent.ID, d.SourceIP)
+		d.Reason = "ip not allowed"
+		d.Response = denied(arn, agent, d.Reason)
+		return d, nil
+	}
+
+	if agent.SecretGeneration > 0 {
+		fmt.Printf("agent %s used secret generation %d\n", agent.ID, agent.SecretGeneration)
+	}
+
+	if a.Lockout != nil && !creds.Empty() {
+		ctx, cancel := a.budget(ctx)
+		if err := a.Lockout.Succeed(ctx, status, keys[0]); err != nil {
+			fmt.Printf("agent %s couldnt clear failures: %+v\n", agent.ID, err)
+		}
+		cancel()
+	}
+
+	if agent.UsageKey == "" && a.RequireUsageKey {
+		fmt.Printf("agent %s has no usage key\n", agent.ID)
+		d.Reason = "no usage key"
+		d.Response = denied(arn, agent, d.Reason)
+		return d, nil
+	}
+
+	if reason := a.checkNonce(ctx, agent, event.Headers); reason != "" {
+		d.Reason = reason
+		d.Response = denied(arn, agent, d.Reason)
+		return d, nil
+	}
+
+	if a.rateLimited(ctx, agent) {
+		d.Reason = "rate limited"
+		d.Response = denied(arn, agent, d.Reason)
+		return d, nil
+	}
+
+	usage := a.checkQuota(ctx, agent)
+	if usage.Exceeded {
+		d.Reason = "quota exceeded"
+		d.Response = denied(arn, agent, d.Reason)
+		return d, nil
+	}
+
+	d.Roles = agent.Roles
+	if len(d.Roles) == 0 {
+		d.Roles = a.DefaultRoles
+	}
+
+	definitions, err := a.roles(ctx)
+	if unavailable(err) {
+		return a.degraded(d, arn, "roles", err)
+	}
+	if err != nil {
+		fmt.Printf("couldnt load roles, err: %+v\n", err)
+		d.Reason = "roles unavailable"
+		d.Response = policy.NewBuilder("system", arn).Build()
+		return d, nil
+	}
+	routes, unknown := definitions.Resolve(d.Roles...)
+	if len(unknown) > 0 {
+		fmt.Printf("agent %s has unknown roles: %v\n", agent.ID, unknown)
+	}
+	if agent.Status == store.AgentPausedIngest {
+		routes = policy.ReadOnly(routes)
+	}
+
+	b := policy.NewBuilder(agent.ID, arn).WithUsageKey(agent.UsageKey)
+	if agent.Scoped() {
+		scoped, unknown := a.Scopes.Routes(agent.Scopes...)
+		if len(unknown) > 0 {
+			fmt.Printf("agent %s has unknown scopes: %v\n", agent.ID, unknown)
+		}
+		routes = policy.Intersect(routes, scoped)
+		b.WithContext("scopes", strings.Join(agent.Scopes, ","))
+	}
+	d.Routes = routes
+
+	b.WithContext("agentId", agent.ID).
+		WithContext("companyId", agent.CompanyID).
+		WithContext("roles", strings.Join(d.Roles, ","))
+	if agent.Status != "" {
+		b.WithContext("agentStatus", agent.Status)
+	}
+	if agent.Company.ID != "" {
+		b.WithContext("companyStatus", agent.Company.Status).
+			WithContext("plan", agent.Company.Plan)
+	}
+	if usage.Warning {
+		b.WithContext("quotaWarning", true)
+	}
+	if agent.SecretGeneration > 0 {
+		b.WithContext("secretGeneration", agent.SecretGeneration)
+	}
+	if expiring {
+		b.WithContext("credentialExpiring", true).
+			WithContext("credentialExpiresAt", agent.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+
+	switch {
+	case a.OPA != nil:
+		d.Engine = EngineOPA
+		ctx, cancel := a.budget(ctx)
+		a.evaluateOPA(ctx, &d, b, arn, event)
+		cancel()
+	case a.Rules != nil:
+		d.Engine = EngineRules
+		a.evaluateRules(&d, b, arn)
+	default:
+		d.Engine = EngineGrant
+		d.Response = b.Grant(a.Scope, routes...).Build()
+		if !entitled(routes, arn) {
+			d.Reason = "not entitled"
+		}
+	}
+	d.Allowed = policy.Evaluate(d.Response.PolicyDocument, arn.String())
+
+	if d.Allowed && a.Quota != nil && agent.CompanyID != "" {
+		ctx, cancel := a.budget(ctx)
+		if err := a.Quota.Record(ctx, agent.CompanyID); err != nil {
+			fmt.Printf("agent %s quota record: %+v\n", agent.ID, err)
+		}
+		cancel()
+	}
+
+	return d, nil
+}
+
+// evaluateRules lets the policy file decide, the decision only covers this request
+// as rules can depend on more than the route
+func (a *Authorizer) evaluateRules(d *Decision, b *policy.Builder, arn policy.ARN) {
+	rd := a.Rules.Evaluate(rules.Input{
+		Principal: map[string][]string{
+			"agentId":   {d.Agent.ID},
+			"companyId": {d.Agent.CompanyID},
+			"roles":     d.Roles,
+			"scopes":    d.Agent.Scopes,
+			"plan":      {d.Agent.Company.Plan},
+		},
+		Company:  d.Agent.CompanyID,
+		Verb:     arn.Verb,
+		Resource: arn.Resource,
+		SourceIP: d.SourceIP,
+		Time:     time.Now(),
+		Entitled: entitled(d.Routes, arn),
+	})
+	fmt.Printf("agent %s %s %s, rule %q: %s\n", d.Agent.ID, arn.Verb, arn.Resource, rd.Rule, rd.Effect)
+
+	for k, v := range rd.Context {
+		b.WithContext(k, v)
+	}
+	b.WithContext("rule", rd.Rule)
+	if rd.Allowed() {
+		b.AllowResource(arn.String())
+	}
+
+	d.Rule = rd.Rule
+	if reason, ok := rd.Context["reason"].(string); ok {
+		d.Reason = reason
+	}
+	d.Response = b.Build()
+}
+
+// evaluateOPA evaluates the rego policy, anything going wrong with it is a deny
+func (a *Authorizer) evaluateOPA(ctx context.Context, d *Decision, b *policy.Builder, arn policy.ARN, event events.APIGatewayCustomAuthorizerRequestTypeRequest) {
+	var entitledRoutes []string
+	for _, r := range d.Routes {
+		entitledRoutes = append(entitledRoutes, r.String())
+	}
+
+	result, err := a.OPA.Decide(ctx, opa.Input{
+		Principal: opa.Principal{
+			AgentID:   d.Agent.ID,
+			CompanyID: d.Agent.CompanyID,
+			Roles:     d.Roles,
+			Scopes:    d.Agent.Scopes,
+
+			Plan:          d.Agent.Company.Plan,
+			CompanyStatus: d.Agent.Company.Status,
+		},
+		Request: opa.Request{
+			MethodArn:   event.MethodArn,
+			Verb:        arn.Verb,
+			Resource:    arn.Resource,
+			Stage:       arn.Stage,
+			Path:        event.Path,
+			SourceIP:    d.SourceIP,
+			Headers:     opa.SafeHeaders(event.Headers),
+			QueryString: event.QueryStringParameters,
+		},
+		Routes:   entitledRoutes,
+		Entitled: entitled(d.Routes, arn),
+		Time:     time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		fmt.Printf("agent %s opa decision failed: %+v\n", d.Agent.ID, err)
+		d.Reason = "opa unavailable"
+		d.Response = policy.NewBuilder(d.Agent.ID, arn).Build()
+		return
+	}
+	fmt.Printf("agent %s %s %s, opa allow: %t, reason: %q\n", d.Agent.ID, arn.Verb, arn.Resource, result.Allow, result.Reason)
+
+	if err := result.Apply(b, arn); err != nil {
+		fmt.Printf("agent %s opa result: %+v\n", d.Agent.ID, err)
+		d.Reason = "opa result invalid"
+		d.Response = policy.NewBuilder(d.Agent.ID, arn).Build()
+		return
+	}
+
+	d.Reason = result.Reason
+	d.Response = b.Build()
+}
+
+// rateLimited takes a token from the agent's bucket and then the company's, if the
+// limiter can't be reached the request goes through rather than failing ingest
+func (a *Authorizer) rateLimited(ctx context.Context, agent store.Agent) bool {
+	if a.Limiter == nil {
+		return false
+	}
+
+	plan := a.Plans.For(agent.Company.Plan)
+	if l := agent.Company.Limits; l.Rate > 0 {
+		plan.Company = ratelimit.Limit{Rate: l.Rate, Burst: l.Burst}
+	}
+	type bucket struct {
+		key   string
+		limit ratelimit.Limit
+	}
+	buckets := []bucket{
+		{key: ratelimit.AgentKey(agent.ID), limit: plan.Agent},
+	}
+	if agent.CompanyID != "" {
+		buckets = append(buckets, bucket{key: ratelimit.CompanyKey(agent.CompanyID), limit: plan.Company})
+	}
+
+	ctx, cancel := a.budget(ctx)
+	defer cancel()
+	for _, b := range buckets {
+		allowed, err := a.Limiter.Allow(ctx, b.key, b.limit)
+		if err != nil {
+			fmt.Printf("agent %s rate limit %s: %+v\n", agent.ID, b.key, err)
+			return false
+		}
+		if !allowed {
+			fmt.Printf("agent %s rate limited on %s\n", agent.ID, b.key)
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkNonce records the request's nonce and is the reason to deny it, if it can't be
+// recorded the request goes through the same as with rate limiting
+func (a *Authorizer) checkNonce(ctx context.Context, agent store.Agent, headers map[string]string) string {
+	if a.Nonces == nil {
+		return ""
+	}
+
+	n := ""
+	for k, v := range headers {
+		if strings.EqualFold(k, nonce.Header) {
+			n = v
+		}
+	}
+	switch {
+	case n == "" && a.RequireNonce:
+		fmt.Printf("audit denied code=nonce_missing agent=%s\n", agent.ID)
+		return "nonce missing"
+	case n == "":
+		return ""
+	case len(n) > nonce.MaxLength:
+		fmt.Printf("audit denied code=nonce_invalid agent=%s\n", agent.ID)
+		return "invalid nonce"
+	}
+
+	ctx, cancel := a.budget(ctx)
+	defer cancel()
+	fresh, err := a.Nonces.Use(ctx, agent.ID, n, a.NonceTTL)
+	if err != nil {
+		fmt.Printf("agent %s nonce: %+v\n", agent.ID, err)
+		return ""
+	}
+	if !fresh {
+		fmt.Printf("audit denied code=nonce_replayed agent=%s\n", agent.ID)
+		return "replayed"
+	}
+
+	return ""
+}
+
+// checkQuota is where the company is against its allowance, if the counts can't be
+// read the request goes through the same as with rate limiting
+func (a *Authorizer) checkQuota(ctx context.Context, agent store.Agent) quota.State {
+	if a.Quota == nil || agent.CompanyID == "" {
+		return quota.State{}
+	}
+
+	allowance := a.Allowances.For(agent.Company.Plan)
+	if agent.Company.Limits.Monthly > 0 {
+		allowance.Monthly = agent.Company.Limits.Monthly
+	}
+
+	ctx, cancel := a.budget(ctx)
+	defer cancel()
+	s, err := a.Quota.Check(ctx, agent.CompanyID, allowance)
+	if err != nil {
+		fmt.Printf("agent %s quota check: %+v\n", agent.ID, err)
+		return quota.State{}
+	}
+	if s.Exceeded {
+		fmt.Printf("company %s over quota with %d requests\n", agent.CompanyID, s.Used)
+	}
+
+	return s
+}
+
+// checkLockout is whether any of the keys are locked, if that can't be read the
+// request is let through to the credential check rather than locking everyone out
+func (a *Authorizer) checkLockout(ctx context.Context, keys []string) lockout.Status {
+	if a.Lockout == nil {
+		return lockout.Status{}
+	}
+
+	ctx, cancel := a.budget(ctx)
+	defer cancel()
+	s, err := a.Lockout.Check(ctx, keys...)
+	if err != nil {
+		fmt.Printf("couldnt check lockout: %+v\n", err)
+		return lockout.Status{}
+	}
+	return s
+}
+
+// revoked is whether the agent's credentials have been revoked, if newer revocations
+// can't be read the ones already seen still count
+func (a *Authorizer) revoked(ctx context.Context, agent store.Agent) bool {
+	if !agent.RevokedAt.IsZero() {
+		return true
+	}
+	if a.Revocations == nil {
+		return false
+	}
+
+	ctx, cancel := a.budget(ctx)
+	defer cancel()
+	revoked, err := a.Revocations.Revoked(ctx, agent.ID)
+	if err != nil {
+		fmt.Printf("couldnt check revocations: %+v\n", err)
+	}
+	return revoked
+}
+
+// unavailable is true when the store didn't answer, as opposed to answering with an error
+func unavailable(err error) bool {
+	return errors.Is(err, ErrBudgetExhausted) || errors.Is(err, store.ErrCircuitOpen)
+}
+
+// degraded is the outcome for a request the store couldn't answer for, a denial with
+// the reason unless the authorizer is set to fail the invocation instead
+func (a *Authorizer) degraded(d Decision, arn policy.ARN, call string, err error) (Decision, error) {
+	code, reason := "timeout", "timeout"
+	if errors.Is(err, store.ErrCircuitOpen) {
+		code, reason = "store_unavailable", "store unavailable"
+	}
+	fmt.Printf("audit denied code=%s call=%s agent=%s ip=%s\n", code, call, d.Agent.ID, d.SourceIP)
+	d.Reason = reason
+
+	if a.DegradedMode == DegradedError {
+		return d, fmt.Errorf("authorizer %s: %w", call, err)
+	}
+
+	if d.Agent.ID == "" {
+		d.Response = policy.NewBuilder("system", arn).
+			WithContext("reason", d.Reason).
+			Build()
+		return d, nil
+	}
+	d.Response = denied(arn, d.Agent, d.Reason)
+	return d, nil
+}
+
+// agentDenial is why the agent is turned away, if it is, paused agents can still read
+// so dashboards keep working while ingest is stopped
+func agentDenial(agent store.Agent, arn policy.ARN) string {
+	switch agent.Status {
+	case store.AgentDisabled:
+		return "agent disabled"
+	case store.AgentDeleted:
+		return "agent deleted"
+	case store.AgentPausedIngest:
+		if !policy.IsRead(arn.Verb) {
+			return "agent paused"
+		}
+	}
+	return ""
+}
+
+// companyDenial is why agents of the company are turned away, if they are, a company
+// without a status is treated as active as agents can predate their company row
+func companyDenial(c store.Company) string {
+	switch c.Status {
+	case store.CompanySuspended:
+		return "company suspended"
+	case store.CompanyDeleted:
+		return "company deleted"
+	default:
+		return ""
+	}
+}
+
+// checkValidity is why the credentials can't be used at the time, if they can't, and
+// whether they're close enough to expiring, or in their grace, that the SDK should warn
+func (a *Authorizer) checkValidity(agent store.Agent, now time.Time) (reason string, expiring bool) {
+	if !agent.NotBefore.IsZero() && now.Before(agent.NotBefore) {
+		return "not yet valid", false
+	}
+	if agent.ExpiresAt.IsZero() {
+		return "", false
+	}
+	if !now.Before(agent.ExpiresAt.Add(a.ExpiryGrace)) {
+		return "expired", false
+	}
+
+	return "", !now.Before(agent.ExpiresAt.Add(-a.ExpiryWarning))
+}
+
+// permittedIP checks the client against the agent's and company's networks, lists
+// that can't be read deny rather than let a restricted key in from anywhere
+func permittedIP(agent store.Agent, ip net.IP) bool {
+	rules := ipfilter.Rules{}
+	for _, entries := range [][]string{agent.IPAllow, agent.Company.IPAllow} {
+		l, err := ipfilter.ParseList(entries)
+		if err != nil {
+			fmt.Printf("agent %s ip allow list: %+v\n", agent.ID, err)
+			return false
+		}
+		rules.Allow = append(rules.Allow, l)
+	}
+	for _, entries := range [][]string{agent.IPDeny, agent.Company.IPDeny} {
+		l, err := ipfilter.ParseList(entries)
+		if err != nil {
+			fmt.Printf("agent %s ip deny list: %+v\n", agent.ID, err)
+			return false
+		}
+		rules.Deny = append(rules.Deny, l)
+	}
+
+	return rules.Permits(ip)
+}
+
+// lockoutKeys are the credential presented, first, and where it came from
+func lockoutKeys(creds store.Credentials, sourceIP string) []string {
+	var keys []string
+	switch {
+	case creds.Key != "" && creds.Secret != "":
+		keys = append(keys, lockout.KeyFor(creds.Key))
+	case creds.AgentID != "":
+		keys = append(keys, lockout.AgentFor(creds.AgentID))
+	}
+	if sourceIP != "" {
+		keys = append(keys, lockout.IPFor(sourceIP))
+	}
+	return keys
+}
+
+// denied is the response for an agent turned away before its roles are looked at,
+// the reason goes in the context so gateway responses can show it
+func denied(arn policy.ARN, agent store.Agent, reason string) events.APIGatewayCustomAuthorizerResponse {
+	return policy.NewBuilder(agent.ID, arn).
+		WithContext("agentId", agent.ID).
+		WithContext("companyId", agent.CompanyID).
+		WithContext("reason", reason).
+		Build()
+}
+
+func entitled(routes []policy.Route, arn policy.ARN) bool {
+	for _, r := range routes {
+		if r.Matches(arn.Verb, arn.Resource) {
+			return true
+		}
+	}
+	return false
 }
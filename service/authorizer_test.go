@@ -1,465 +1,1536 @@
 package service_test
 
 import (
-  "database/sql"
-	"fmt"
-  "os"
+	"context"
+	"flag"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
-  "github.com/aws/aws-lambda-go/events"
-  "github.com/bugfixes/authorizer/service"
-  "github.com/joho/godotenv"
-  "github.com/stretchr/testify/assert"
-	_ "github.com/lib/pq"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bugfixes/authorizer/service"
+	"github.com/bugfixes/authorizer/service/lockout"
+	"github.com/bugfixes/authorizer/service/nonce"
+	"github.com/bugfixes/authorizer/service/opa"
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/bugfixes/authorizer/service/quota"
+	"github.com/bugfixes/authorizer/service/ratelimit"
+	"github.com/bugfixes/authorizer/service/replay"
+	"github.com/bugfixes/authorizer/service/revocation"
+	"github.com/bugfixes/authorizer/service/role"
+	"github.com/bugfixes/authorizer/service/rules"
+	"github.com/bugfixes/authorizer/service/scope"
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
 )
 
-type AgentData struct {
-	ID        string
-	Key       string
-	Secret    string
-	CompanyID string
-	Name      string
+var update = flag.Bool("update", false, "rewrite the replay expectations with the current responses")
+
+// TestReplay runs the recorded events in testdata/replay through Handler, backed
+// by the fixture store, any response that changed is reported as a diff
+func TestReplay(t *testing.T) {
+	for k, v := range map[string]string{
+		"STORE":         "fixture",
+		"FIXTURE_FILE":  "testdata/fixture.json",
+		"POLICY_SCOPE":  "method",
+		"DEFAULT_ROLES": "",
+		"SCOPE_ROUTES":  "",
+		"POLICY_FILE":   "",
+		"OPA_POLICY":    "",
+		"RATE_LIMITER":  "",
+		"QUOTAS":        "",
+		"LOCKOUT":       "",
+	} {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatalf("setenv %s: %v", k, err)
+		}
+	}
+
+	cases, err := replay.Load("testdata/replay")
+	if err != nil {
+		t.Fatalf("replay load: %v", err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("replay load: no cases in testdata/replay")
+	}
+
+	report := replay.Run(context.Background(), service.Handler, cases)
+	if *update {
+		for i, res := range report.Results {
+			if res.Err != nil {
+				t.Fatalf("replay %s: %v", res.Name, res.Err)
+			}
+			cases[i].Expect = res.Got
+			if err := replay.Record("testdata/replay", cases[i]); err != nil {
+				t.Fatalf("replay update: %v", err)
+			}
+		}
+		return
+	}
+
+	if len(report.Failed()) > 0 {
+		t.Errorf("%s", report)
+	}
 }
 
-var connectDetails = ""
-
-func injectAgent(data AgentData) error {
-  db, err := sql.Open("postgres", connectDetails)
-  if err != nil {
-    return fmt.Errorf("injectAgent db.open: %w", err)
-  }
-  defer func() {
-    err := db.Close()
-    if err != nil {
-      fmt.Printf("injectAgent db.close: %v", err)
-    }
-  }()
-  _, err = db.Exec(
-    "INSERT INTO agent (id, key, secret, company_id, name) VALUES ($1, $2, $3, $4, $5)",
-    data.ID,
-    data.Key,
-    data.Secret,
-    data.CompanyID,
-    data.Name)
-  if err != nil {
-    return fmt.Errorf("injectAgent db.exec: %w", err)
-  }
-
-  return nil
+func memoryStore() *store.Memory {
+	rs := role.Roles{}
+	rs.Add(role.Ingest, "", &policy.Route{Verb: "POST", Resource: "bug"})
+	rs.Add(role.Ingest, "", &policy.Route{Verb: "POST", Resource: "log"})
+	rs.Add(role.Dashboard, "", &policy.Route{Verb: "GET", Resource: "bug/*"})
+	rs.Add(role.CompanyAdmin, role.Ingest, nil)
+	rs.Add(role.CompanyAdmin, role.Dashboard, nil)
+
+	return &store.Memory{
+		Agents: []store.MemoryAgent{
+			{
+				Agent: store.Agent{
+					ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+					CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+					Roles:     []string{role.Ingest},
+				},
+				Key:    "94365b00-c6df-483f-804e-363312750580",
+				Secret: "f7356946-5814-4b5e-ad45-0348a89576ef",
+			},
+			{
+				Agent: store.Agent{
+					ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c81",
+					CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+					Roles:     []string{role.CompanyAdmin},
+				},
+				Key:    "94365b00-c6df-483f-804e-363312750581",
+				Secret: "f7356946-5814-4b5e-ad45-0348a89576ef",
+			},
+			{
+				Agent: store.Agent{
+					ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c82",
+					CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+				},
+				Key:    "94365b00-c6df-483f-804e-363312750582",
+				Secret: "f7356946-5814-4b5e-ad45-0348a89576ef",
+			},
+			{
+				Agent: store.Agent{
+					ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c83",
+					CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+					Roles:     []string{role.CompanyAdmin},
+					Scopes:    []string{scope.BugWrite},
+				},
+				Key:    "94365b00-c6df-483f-804e-363312750583",
+				Secret: "f7356946-5814-4b5e-ad45-0348a89576ef",
+			},
+			{
+				Agent: store.Agent{
+					ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c84",
+					CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+					Roles:     []string{role.CompanyAdmin},
+					Scopes:    []string{},
+				},
+				Key:    "94365b00-c6df-483f-804e-363312750584",
+				Secret: "f7356946-5814-4b5e-ad45-0348a89576ef",
+			},
+		},
+		RoleDefinitions: rs,
+	}
 }
 
-func deleteAgent(id string) error {
-  db, err := sql.Open("postgres", connectDetails)
-  if err != nil {
-    return fmt.Errorf("deleteAgent db.open: %w", err)
-  }
-  defer func() {
-    err := db.Close()
-    if err != nil {
-      fmt.Printf("deleteAgent db.close: %v", err)
-    }
-  }()
-  _, err = db.Exec("DELETE FROM agent WHERE id = $1", id)
-  if err != nil {
-    return fmt.Errorf("deleteAgent db.exec: %w", err)
-  }
-
-	return nil
+func TestAuthorizeRoles(t *testing.T) {
+	tests := []struct {
+		name         string
+		key          string
+		methodArn    string
+		defaultRoles []string
+		expect       bool
+	}{
+		{
+			name:      "ingest can post a bug",
+			key:       "94365b00-c6df-483f-804e-363312750580",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			expect:    true,
+		},
+		{
+			name:      "ingest cant read bugs",
+			key:       "94365b00-c6df-483f-804e-363312750580",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/bug/1234",
+			expect:    false,
+		},
+		{
+			name:      "company admin inherits dashboard",
+			key:       "94365b00-c6df-483f-804e-363312750581",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/bug/1234",
+			expect:    true,
+		},
+		{
+			name:      "company admin inherits ingest",
+			key:       "94365b00-c6df-483f-804e-363312750581",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/log",
+			expect:    true,
+		},
+		{
+			name:      "no roles",
+			key:       "94365b00-c6df-483f-804e-363312750582",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			expect:    false,
+		},
+		{
+			name:         "no roles uses default roles",
+			key:          "94365b00-c6df-483f-804e-363312750582",
+			methodArn:    "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			defaultRoles: []string{role.Ingest},
+			expect:       true,
+		},
+		{
+			name:      "scoped key can submit crash reports",
+			key:       "94365b00-c6df-483f-804e-363312750583",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			expect:    true,
+		},
+		{
+			name:      "scoped key cant use the rest of its roles",
+			key:       "94365b00-c6df-483f-804e-363312750583",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/bug/1234",
+			expect:    false,
+		},
+		{
+			name:      "key scoped to nothing",
+			key:       "94365b00-c6df-483f-804e-363312750584",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			expect:    false,
+		},
+		{
+			name:      "unknown key",
+			key:       "94365b00-c6df-483f-804e-363312750599",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			expect:    false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := service.Authorizer{
+				Store:        memoryStore(),
+				Scope:        policy.ScopeMethod,
+				DefaultRoles: test.defaultRoles,
+				Scopes:       scope.DefaultMapping(),
+			}
+			resp, err := a.Authorize(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+				Type: "REQUEST",
+				Headers: map[string]string{
+					"X-Api-Key":    test.key,
+					"X-Api-Secret": "f7356946-5814-4b5e-ad45-0348a89576ef",
+				},
+				MethodArn: test.methodArn,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, test.expect, policy.Evaluate(resp.PolicyDocument, test.methodArn))
+		})
+	}
 }
 
-func TestHandler(t *testing.T) {
-	if os.Getenv("GITHUB_ACTOR") == "" {
-		err := godotenv.Load()
-		if err != nil {
-			t.Errorf("godotenv err: %w", err)
-		}
+func TestAuthorizeScopesContext(t *testing.T) {
+	a := service.Authorizer{
+		Store:  memoryStore(),
+		Scope:  policy.ScopeMethod,
+		Scopes: scope.DefaultMapping(),
 	}
-	connectDetails = fmt.Sprintf(
-    "host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-    os.Getenv("DB_HOSTNAME"),
-    os.Getenv("DB_PORT"),
-    os.Getenv("DB_USERNAME"),
-    os.Getenv("DB_PASSWORD"),
-    os.Getenv("DB_DATABASE"))
+	resp, err := a.Authorize(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+		Type: "REQUEST",
+		Headers: map[string]string{
+			"x-api-key":    "94365b00-c6df-483f-804e-363312750583",
+			"x-api-secret": "f7356946-5814-4b5e-ad45-0348a89576ef",
+		},
+		MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, scope.BugWrite, resp.Context["scopes"])
+
+	resp, err = a.Authorize(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+		Type: "REQUEST",
+		Headers: map[string]string{
+			"x-api-key":    "94365b00-c6df-483f-804e-363312750581",
+			"x-api-secret": "f7356946-5814-4b5e-ad45-0348a89576ef",
+		},
+		MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+	})
+	assert.NoError(t, err)
+	assert.NotContains(t, resp.Context, "scopes")
+}
+
+func TestDecide(t *testing.T) {
+	a, err := service.NewAuthorizer(service.Config{PolicyScope: "method"}, memoryStore())
+	assert.NoError(t, err)
 
 	tests := []struct {
-		name    string
-		agent   AgentData
-		request events.APIGatewayCustomAuthorizerRequestTypeRequest
-		expect  events.APIGatewayCustomAuthorizerResponse
-		err     error
+		name      string
+		headers   map[string]string
+		methodArn string
+		allowed   bool
+		engine    string
+		reason    string
+		agent     string
 	}{
 		{
-			name: "allowed agentid",
-			agent: AgentData{
-				ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
-				Key:       "94365b00-c6df-483f-804e-363312750500",
-				Secret:    "f7356946-5814-4b5e-ad45-0348a89576ef",
-				CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
-				Name:      "bugfixes test frontend -- allowed agentid",
+			name:      "invalid arn",
+			headers:   map[string]string{"x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c80"},
+			methodArn: "tester",
+			reason:    "invalid methodArn",
+		},
+		{
+			name:      "unknown credentials",
+			headers:   map[string]string{"x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c99"},
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			reason:    "unknown credentials",
+		},
+		{
+			name:      "entitled",
+			headers:   map[string]string{"x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c80"},
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			allowed:   true,
+			engine:    service.EngineGrant,
+			agent:     "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+		},
+		{
+			name:      "not entitled",
+			headers:   map[string]string{"x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c80"},
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/bug/1234",
+			engine:    service.EngineGrant,
+			reason:    "not entitled",
+			agent:     "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := a.Decide(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+				Type:      "REQUEST",
+				Headers:   test.headers,
+				MethodArn: test.methodArn,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, test.allowed, d.Allowed)
+			assert.Equal(t, test.engine, d.Engine)
+			assert.Equal(t, test.reason, d.Reason)
+			assert.Equal(t, test.agent, d.Agent.ID)
+		})
+	}
+}
+
+func TestNewAuthorizerConfig(t *testing.T) {
+	_, err := service.NewAuthorizer(service.Config{PolicyScope: "everything"}, memoryStore())
+	assert.Error(t, err)
+
+	_, err = service.NewAuthorizer(service.Config{OPAPolicy: "bundled", OPATimeout: "soon"}, memoryStore())
+	assert.Error(t, err)
+
+	_, err = service.NewAuthorizer(service.Config{OPAPolicy: "policies/missing.rego"}, memoryStore())
+	assert.Error(t, err)
+
+	a, err := service.NewAuthorizer(service.Config{OPAPolicy: "bundled"}, memoryStore())
+	assert.NoError(t, err)
+	assert.NotNil(t, a.OPA)
+
+	a, err = service.NewAuthorizer(service.Config{DefaultRoles: "ingest, dashboard"}, memoryStore())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ingest", "dashboard"}, a.DefaultRoles)
+	assert.Equal(t, policy.ScopeMethod, a.Scope)
+
+	_, err = service.NewAuthorizer(service.Config{CallBudget: "quick"}, memoryStore())
+	assert.Error(t, err)
+
+	a, err = service.NewAuthorizer(service.Config{CallBudget: "250ms"}, memoryStore())
+	assert.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, a.CallBudget)
+	assert.Equal(t, service.DefaultDeadlineReserve, a.DeadlineReserve)
+
+	_, err = service.NewAuthorizer(service.Config{DegradedMode: "shrug"}, memoryStore())
+	assert.Error(t, err)
+
+	_, err = service.NewAuthorizer(service.Config{StoreBreakerFailures: "some"}, memoryStore())
+	assert.Error(t, err)
+
+	a, err = service.NewAuthorizer(service.Config{StoreBreakerFailures: "5", StoreBreakerCoolDown: "30s", DegradedMode: "error"}, memoryStore())
+	assert.NoError(t, err)
+	assert.IsType(t, &store.Breaker{}, a.Store)
+	assert.Equal(t, service.DegradedError, a.DegradedMode)
+
+	_, err = service.NewAuthorizer(service.Config{IdentityCacheTTL: "30s", IdentityCacheSize: "lots"}, memoryStore())
+	assert.Error(t, err)
+
+	a, err = service.NewAuthorizer(service.Config{IdentityCacheTTL: "30s"}, memoryStore())
+	assert.NoError(t, err)
+	assert.IsType(t, &store.Cache{}, a.Store)
+	assert.Nil(t, a.Store.(*store.Cache).Options.Shared)
+
+	// redis is only connected to on the first command
+	_, err = service.NewAuthorizer(service.Config{RateLimiter: "redis"}, memoryStore())
+	assert.Error(t, err)
+
+	a, err = service.NewAuthorizer(service.Config{RateLimiter: "redis", IdentityCacheTTL: "30s", RedisAddr: "localhost:6379"}, memoryStore())
+	assert.NoError(t, err)
+	assert.IsType(t, &ratelimit.Redis{}, a.Limiter)
+	assert.IsType(t, &store.RedisCache{}, a.Store.(*store.Cache).Options.Shared)
+
+	_, err = service.NewAuthorizer(service.Config{RedisAddr: "localhost:6379", RedisTLS: "sometimes"}, memoryStore())
+	assert.Error(t, err)
+
+	_, err = service.NewAuthorizer(service.Config{RequireNonce: "true"}, memoryStore())
+	assert.Error(t, err)
+
+	a, err = service.NewAuthorizer(service.Config{RequireNonce: "false"}, memoryStore())
+	assert.NoError(t, err)
+	assert.Nil(t, a.Nonces)
+
+	a, err = service.NewAuthorizer(service.Config{NonceTTL: "5m", RequireNonce: "true"}, memoryStore())
+	assert.NoError(t, err)
+	assert.IsType(t, &nonce.Memory{}, a.Nonces)
+	assert.Equal(t, 5*time.Minute, a.NonceTTL)
+	assert.True(t, a.RequireNonce)
+
+	a, err = service.NewAuthorizer(service.Config{NonceTTL: "5m", RedisAddr: "localhost:6379"}, memoryStore())
+	assert.NoError(t, err)
+	assert.IsType(t, &nonce.Redis{}, a.Nonces)
+
+	// the dynamodb store can't back the shared counts or revoke cached agents
+	dynamo := store.NewDynamo(nil, store.DynamoTables{})
+	for _, c := range []service.Config{
+		{Quotas: `{"default": {"monthly": 10}}`},
+		{Lockout: "{}"},
+		{IdentityCacheTTL: "30s"},
+		{RateLimiter: "postgres"},
+	} {
+		_, err = service.NewAuthorizer(c, dynamo)
+		assert.Error(t, err)
+	}
+	a, err = service.NewAuthorizer(service.Config{RateLimiter: "memory"}, dynamo)
+	assert.NoError(t, err)
+	assert.Nil(t, a.Revocations)
+}
+
+func TestRedisFromEnv(t *testing.T) {
+	defer func() {
+		_ = os.Unsetenv("REDIS_ADDR")
+		_ = os.Unsetenv("REDIS_TLS")
+	}()
+
+	c, err := service.RedisFromEnv()
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	assert.NoError(t, os.Setenv("REDIS_ADDR", "cache.internal:6380"))
+	assert.NoError(t, os.Setenv("REDIS_TLS", "true"))
+	c, err = service.RedisFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, "cache.internal:6380", c.Options().Addr)
+	assert.NotNil(t, c.Options().TLSConfig)
+}
+
+func TestRequirePostgresStore(t *testing.T) {
+	defer func() {
+		_ = os.Unsetenv("STORE")
+	}()
+	for name, ok := range map[string]bool{"": true, "postgres": true, "dynamodb": false, "fixture": false} {
+		assert.NoError(t, os.Setenv("STORE", name))
+		assert.Equal(t, ok, service.RequirePostgresStore() == nil, name)
+	}
+}
+
+func TestAuthorizeRateLimit(t *testing.T) {
+	a := service.Authorizer{
+		Store:   memoryStore(),
+		Scope:   policy.ScopeMethod,
+		Limiter: ratelimit.NewMemory(),
+		Plans: ratelimit.Plans{
+			ratelimit.DefaultPlan: {
+				Agent:   ratelimit.Limit{Rate: 0.001, Burst: 2},
+				Company: ratelimit.Limit{Rate: 0.001, Burst: 3},
 			},
-			request: events.APIGatewayCustomAuthorizerRequestTypeRequest{
-				Type: "TOKEN",
-				Headers: map[string]string{
-					"x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+		},
+	}
+	methodArn := "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug"
+
+	decide := func(agentID string) service.Decision {
+		d, err := a.Decide(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+			Type:      "REQUEST",
+			Headers:   map[string]string{"x-agent-id": agentID},
+			MethodArn: methodArn,
+		})
+		assert.NoError(t, err)
+		return d
+	}
+
+	// the agent runs out first
+	assert.True(t, decide("ad4b99e1-dec8-4682-862a-6b017e7c7c80").Allowed)
+	assert.True(t, decide("ad4b99e1-dec8-4682-862a-6b017e7c7c80").Allowed)
+	d := decide("ad4b99e1-dec8-4682-862a-6b017e7c7c80")
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "rate limited", d.Reason)
+	assert.Equal(t, events.APIGatewayCustomAuthorizerResponse{
+		PrincipalID: "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+		PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+			Version: "2012-10-17",
+			Statement: []events.IAMPolicyStatement{
+				{
+					Action:   []string{"execute-api:Invoke"},
+					Effect:   "Deny",
+					Resource: []string{methodArn},
 				},
-				MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/",
 			},
-			expect: events.APIGatewayCustomAuthorizerResponse{
-				PrincipalID: "system",
-				PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
-					Version: "2012-10-17",
-					Statement: []events.IAMPolicyStatement{
-						{
-							Action:   []string{"execute-api:Invoke"},
-							Effect:   "Allow",
-							Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/"},
-						},
+		},
+		Context: map[string]interface{}{
+			"agentId":   "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+			"companyId": "b9e9153a-028c-4173-a7a8-e5063334416a",
+			"reason":    "rate limited",
+		},
+	}, d.Response)
+
+	// then the company, shared with its other agents
+	assert.True(t, decide("ad4b99e1-dec8-4682-862a-6b017e7c7c81").Allowed)
+	d = decide("ad4b99e1-dec8-4682-862a-6b017e7c7c81")
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "rate limited", d.Reason)
+}
+
+func TestAuthorizeQuota(t *testing.T) {
+	tracker := quota.NewTracker(quota.NewMemory())
+	tracker.FlushSize = 1
+	a := service.Authorizer{
+		Store: memoryStore(),
+		Scope: policy.ScopeMethod,
+		Quota: tracker,
+		Allowances: quota.Allowances{
+			quota.DefaultPlan: {Monthly: 3, Soft: 0.3},
+		},
+	}
+
+	decide := func(methodArn string) service.Decision {
+		d, err := a.Decide(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+			Type:      "REQUEST",
+			Headers:   map[string]string{"x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c80"},
+			MethodArn: methodArn,
+		})
+		assert.NoError(t, err)
+		return d
+	}
+
+	d := decide("arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug")
+	assert.True(t, d.Allowed)
+	assert.NotContains(t, d.Response.Context, "quotaWarning")
+
+	// denied requests aren't counted
+	assert.False(t, decide("arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/bug/1234").Allowed)
+
+	d = decide("arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug")
+	assert.True(t, d.Allowed)
+	assert.Equal(t, true, d.Response.Context["quotaWarning"])
+
+	d = decide("arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/log")
+	assert.True(t, d.Allowed)
+	assert.Equal(t, true, d.Response.Context["quotaWarning"])
+
+	d = decide("arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug")
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "quota exceeded", d.Reason)
+	assert.Equal(t, "quota exceeded", d.Response.Context["reason"])
+}
+
+func TestAuthorizeLockout(t *testing.T) {
+	a := service.Authorizer{
+		Store: memoryStore(),
+		Scope: policy.ScopeMethod,
+		Lockout: lockout.NewGuard(lockout.NewMemory(), lockout.Policy{
+			Threshold:   2,
+			IPThreshold: 10,
+			Base:        time.Hour,
+			Max:         time.Hour,
+			Window:      time.Hour,
+		}),
+	}
+
+	decide := func(secret string) service.Decision {
+		event := events.APIGatewayCustomAuthorizerRequestTypeRequest{
+			Type: "REQUEST",
+			Headers: map[string]string{
+				"x-api-key":    "94365b00-c6df-483f-804e-363312750580",
+				"x-api-secret": secret,
+			},
+			MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+		}
+		event.RequestContext.Identity.SourceIP = "203.0.113.7"
+		d, err := a.Decide(context.Background(), event)
+		assert.NoError(t, err)
+		return d
+	}
+
+	// a success clears the failure before it
+	assert.Equal(t, "unknown credentials", decide("f7356946-5814-4b5e-ad45-0348a89576e0").Reason)
+	assert.True(t, decide("f7356946-5814-4b5e-ad45-0348a89576ef").Allowed)
+	assert.Equal(t, "unknown credentials", decide("f7356946-5814-4b5e-ad45-0348a89576e0").Reason)
+	assert.True(t, decide("f7356946-5814-4b5e-ad45-0348a89576ef").Allowed)
+
+	// two in a row lock the key, even for the right secret
+	assert.Equal(t, "unknown credentials", decide("f7356946-5814-4b5e-ad45-0348a89576e0").Reason)
+	assert.Equal(t, "unknown credentials", decide("f7356946-5814-4b5e-ad45-0348a89576e1").Reason)
+	d := decide("f7356946-5814-4b5e-ad45-0348a89576ef")
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "locked out", d.Reason)
+	assert.Equal(t, "system", d.Response.PrincipalID)
+	assert.Equal(t, map[string]interface{}{"reason": "locked out"}, d.Response.Context)
+}
+
+func TestAuthorizeIPFilter(t *testing.T) {
+	rs := role.Roles{}
+	rs.Add(role.Ingest, "", &policy.Route{Verb: "POST", Resource: "bug"})
+	s := &store.Memory{
+		Agents: []store.MemoryAgent{
+			{
+				Agent: store.Agent{
+					ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+					CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+					Roles:     []string{role.Ingest},
+					IPAllow:   []string{"198.51.100.0/24", "2001:db8:1::/48"},
+					IPDeny:    []string{"198.51.100.66"},
+					Company: store.Company{
+						ID:      "b9e9153a-028c-4173-a7a8-e5063334416a",
+						IPAllow: []string{"198.51.100.0/24", "2001:db8::/32"},
+						IPDeny:  []string{"2001:db8:1:bad::/64"},
 					},
 				},
-				Context: map[string]interface{}{
-					"booleanKey": true,
-					"numberKey":  123,
-					"stringKey":  "stringval",
+			},
+			{
+				Agent: store.Agent{
+					ID:    "ad4b99e1-dec8-4682-862a-6b017e7c7c91",
+					Roles: []string{role.Ingest},
+				},
+			},
+			{
+				Agent: store.Agent{
+					ID:      "ad4b99e1-dec8-4682-862a-6b017e7c7c92",
+					Roles:   []string{role.Ingest},
+					IPAllow: []string{"198.51.100.0/33"},
 				},
 			},
 		},
+		RoleDefinitions: rs,
+	}
+
+	a, err := service.NewAuthorizer(service.Config{
+		PolicyScope:    "method",
+		IPDenylist:     "192.0.2.0/24, 2001:db8:dead::/48",
+		TrustedProxies: "10.0.0.0/8",
+	}, s)
+	if err != nil {
+		t.Fatalf("new authorizer: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		agentID   string
+		sourceIP  string
+		forwarded string
+		allowed   bool
+		reason    string
+		clientIP  string
+	}{
+		{
+			name:     "allowed ipv4",
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			sourceIP: "198.51.100.7",
+			allowed:  true,
+			clientIP: "198.51.100.7",
+		},
+		{
+			name:     "allowed ipv6",
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			sourceIP: "2001:db8:1::7",
+			allowed:  true,
+			clientIP: "2001:db8:1::7",
+		},
+		{
+			name:     "outside the agent list",
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			sourceIP: "2001:db8:2::7",
+			reason:   "ip not allowed",
+			clientIP: "2001:db8:2::7",
+		},
+		{
+			name:     "outside every list",
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			sourceIP: "203.0.113.7",
+			reason:   "ip not allowed",
+			clientIP: "203.0.113.7",
+		},
+		{
+			name:     "agent denied",
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			sourceIP: "198.51.100.66",
+			reason:   "ip not allowed",
+			clientIP: "198.51.100.66",
+		},
+		{
+			name:     "company denied",
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			sourceIP: "2001:db8:1:bad::1",
+			reason:   "ip not allowed",
+			clientIP: "2001:db8:1:bad::1",
+		},
+		{
+			name:      "through a trusted proxy",
+			agentID:   "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			sourceIP:  "10.0.0.1",
+			forwarded: "203.0.113.7, 198.51.100.7",
+			allowed:   true,
+			clientIP:  "198.51.100.7",
+		},
 		{
-			name: "denied agentid",
-			agent: AgentData{
-				ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c71",
-				Key:       "94365b00-c6df-483f-804e-363312750500",
-				Secret:    "f7356946-5814-4b5e-ad45-0348a89576ef",
+			name:      "forwarded by an untrusted source",
+			agentID:   "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			sourceIP:  "203.0.113.7",
+			forwarded: "198.51.100.7",
+			reason:    "ip not allowed",
+			clientIP:  "203.0.113.7",
+		},
+		{
+			name:     "no lists",
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c91",
+			sourceIP: "203.0.113.7",
+			allowed:  true,
+			clientIP: "203.0.113.7",
+		},
+		{
+			name:     "globally denied ipv4",
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c91",
+			sourceIP: "192.0.2.7",
+			reason:   "ip denied",
+			clientIP: "192.0.2.7",
+		},
+		{
+			name:      "globally denied ipv6 through a proxy",
+			agentID:   "ad4b99e1-dec8-4682-862a-6b017e7c7c91",
+			sourceIP:  "10.0.0.1",
+			forwarded: "2001:db8:dead::1",
+			reason:    "ip denied",
+			clientIP:  "2001:db8:dead::1",
+		},
+		{
+			name:     "invalid list",
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c92",
+			sourceIP: "198.51.100.7",
+			reason:   "ip not allowed",
+			clientIP: "198.51.100.7",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := events.APIGatewayCustomAuthorizerRequestTypeRequest{
+				Type: "REQUEST",
+				Headers: map[string]string{
+					"x-agent-id": test.agentID,
+				},
+				MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			}
+			if test.forwarded != "" {
+				event.Headers["X-Forwarded-For"] = test.forwarded
+			}
+			event.RequestContext.Identity.SourceIP = test.sourceIP
+
+			d, err := a.Decide(context.Background(), event)
+			assert.NoError(t, err)
+			assert.Equal(t, test.allowed, d.Allowed)
+			assert.Equal(t, test.reason, d.Reason)
+			assert.Equal(t, test.clientIP, d.SourceIP)
+			if test.reason != "" {
+				assert.Equal(t, test.reason, d.Response.Context["reason"])
+			}
+		})
+	}
+}
+
+func TestAuthorizeExpiry(t *testing.T) {
+	rs := role.Roles{}
+	rs.Add(role.Ingest, "", &policy.Route{Verb: "POST", Resource: "bug"})
+	now := time.Now()
+	agent := func(id string, notBefore, expiresAt time.Time) store.MemoryAgent {
+		return store.MemoryAgent{
+			Agent: store.Agent{
+				ID:        id,
 				CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
-				Name:      "bugfixes test frontend -- denied agentid",
+				Roles:     []string{role.Ingest},
+				NotBefore: notBefore,
+				ExpiresAt: expiresAt,
 			},
-			request: events.APIGatewayCustomAuthorizerRequestTypeRequest{
-				Type: "TOKEN",
+		}
+	}
+	s := &store.Memory{
+		Agents: []store.MemoryAgent{
+			agent("ad4b99e1-dec8-4682-862a-6b017e7c7c90", time.Time{}, time.Time{}),
+			agent("ad4b99e1-dec8-4682-862a-6b017e7c7c91", now.Add(-time.Hour), now.Add(30*24*time.Hour)),
+			agent("ad4b99e1-dec8-4682-862a-6b017e7c7c92", now.Add(time.Hour), time.Time{}),
+			agent("ad4b99e1-dec8-4682-862a-6b017e7c7c93", time.Time{}, now.Add(48*time.Hour)),
+			agent("ad4b99e1-dec8-4682-862a-6b017e7c7c94", time.Time{}, now.Add(-time.Hour)),
+			agent("ad4b99e1-dec8-4682-862a-6b017e7c7c95", time.Time{}, now.Add(-48*time.Hour)),
+		},
+		RoleDefinitions: rs,
+	}
+
+	a, err := service.NewAuthorizer(service.Config{
+		PolicyScope:   "method",
+		ExpiryGrace:   "24h",
+		ExpiryWarning: "72h",
+	}, s)
+	if err != nil {
+		t.Fatalf("new authorizer: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		agentID  string
+		allowed  bool
+		reason   string
+		expiring bool
+	}{
+		{
+			name:    "no bounds",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			allowed: true,
+		},
+		{
+			name:    "within bounds",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c91",
+			allowed: true,
+		},
+		{
+			name:    "not yet valid",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c92",
+			reason:  "not yet valid",
+		},
+		{
+			name:     "close to expiry",
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c93",
+			allowed:  true,
+			expiring: true,
+		},
+		{
+			name:     "in the grace period",
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c94",
+			allowed:  true,
+			expiring: true,
+		},
+		{
+			name:    "expired",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c95",
+			reason:  "expired",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := a.Decide(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+				Type: "REQUEST",
 				Headers: map[string]string{
-					"x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+					"x-agent-id": test.agentID,
 				},
-				MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/",
+				MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, test.allowed, d.Allowed)
+			assert.Equal(t, test.reason, d.Reason)
+			if test.reason != "" {
+				assert.Equal(t, test.reason, d.Response.Context["reason"])
+			}
+			if test.expiring {
+				assert.Equal(t, true, d.Response.Context["credentialExpiring"])
+				assert.Equal(t, d.Agent.ExpiresAt.UTC().Format(time.RFC3339), d.Response.Context["credentialExpiresAt"])
+			} else {
+				assert.Nil(t, d.Response.Context["credentialExpiring"])
+			}
+		})
+	}
+}
+
+func TestAuthorizeRevoked(t *testing.T) {
+	s := memoryStore()
+	s.Agents[1].RevokedAt = time.Now().Add(-time.Hour)
+	revocations := revocation.NewMemory()
+	a := service.Authorizer{
+		Store:       s,
+		Scope:       policy.ScopeMethod,
+		Revocations: revocation.NewChecker(revocations, 0),
+	}
+
+	decide := func(agentID string) service.Decision {
+		d, err := a.Decide(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+			Type: "REQUEST",
+			Headers: map[string]string{
+				"x-agent-id": agentID,
+			},
+			MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+		})
+		assert.NoError(t, err)
+		return d
+	}
+
+	assert.True(t, decide("ad4b99e1-dec8-4682-862a-6b017e7c7c80").Allowed)
+
+	d := decide("ad4b99e1-dec8-4682-862a-6b017e7c7c81")
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "revoked", d.Reason)
+	assert.Equal(t, "revoked", d.Response.Context["reason"])
+
+	// revoked after the agent was looked up, as a cached agent would be
+	_, err := revocations.Revoke(context.Background(), "ad4b99e1-dec8-4682-862a-6b017e7c7c80")
+	assert.NoError(t, err)
+	d = decide("ad4b99e1-dec8-4682-862a-6b017e7c7c80")
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "revoked", d.Reason)
+}
+
+// TestAuthorizeRevokedShared is an agent another container put in redis before it was
+// revoked, a container started after the revocation has to turn it away all the same
+func TestAuthorizeRevokedShared(t *testing.T) {
+	ctx := context.Background()
+	m := miniredis.RunT(t)
+	c := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	s := memoryStore()
+	revocations := revocation.NewRedis(c, revocation.NewMemory())
+	const ttl = time.Minute
+
+	container := func(lookback time.Duration) service.Authorizer {
+		checker := revocation.NewChecker(revocations, 0)
+		checker.Lookback = lookback
+		return service.Authorizer{
+			Store:       store.NewCache(s, store.CacheOptions{TTL: ttl, Shared: store.NewRedisCache(c)}),
+			Scope:       policy.ScopeMethod,
+			Revocations: checker,
+		}
+	}
+	decide := func(a service.Authorizer) service.Decision {
+		d, err := a.Decide(ctx, events.APIGatewayCustomAuthorizerRequestTypeRequest{
+			Type: "REQUEST",
+			Headers: map[string]string{
+				"x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+			},
+			MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+		})
+		assert.NoError(t, err)
+		return d
+	}
+
+	assert.True(t, decide(container(2*ttl)).Allowed)
+
+	_, err := revocations.Revoke(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c80")
+	assert.NoError(t, err)
+	s.Agents[0].RevokedAt = time.Now()
+
+	// without looking back the checker starts after the revocation and never sees it
+	assert.True(t, decide(container(0)).Allowed)
+
+	d := decide(container(2 * ttl))
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "revoked", d.Reason)
+	assert.True(t, d.Agent.RevokedAt.IsZero(), "the agent should have come from redis")
+}
+
+func TestAuthorizeCompany(t *testing.T) {
+	rs := role.Roles{}
+	rs.Add(role.Ingest, "", &policy.Route{Verb: "POST", Resource: "bug"})
+	agent := func(id, status string) store.MemoryAgent {
+		a := store.MemoryAgent{
+			Agent: store.Agent{
+				ID:        id,
+				CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+				Roles:     []string{role.Ingest},
+			},
+		}
+		if status != "" {
+			a.Company = store.Company{
+				ID:     "b9e9153a-028c-4173-a7a8-e5063334416a",
+				Status: status,
+				Plan:   "business",
+			}
+		}
+		return a
+	}
+	a := service.Authorizer{
+		Store: &store.Memory{
+			Agents: []store.MemoryAgent{
+				agent("ad4b99e1-dec8-4682-862a-6b017e7c7c90", store.CompanyActive),
+				agent("ad4b99e1-dec8-4682-862a-6b017e7c7c91", store.CompanyTrial),
+				agent("ad4b99e1-dec8-4682-862a-6b017e7c7c92", store.CompanySuspended),
+				agent("ad4b99e1-dec8-4682-862a-6b017e7c7c93", store.CompanyDeleted),
+				agent("ad4b99e1-dec8-4682-862a-6b017e7c7c94", ""),
 			},
-			expect: events.APIGatewayCustomAuthorizerResponse{
-				PrincipalID: "system",
-				PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
-					Version: "2012-10-17",
-					Statement: []events.IAMPolicyStatement{
-						{
-							Action:   []string{"execute-api:Invoke"},
-							Effect:   "Deny",
-							Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/"},
+			RoleDefinitions: rs,
+		},
+		Scope: policy.ScopeMethod,
+	}
+
+	tests := []struct {
+		name    string
+		agentID string
+		allowed bool
+		reason  string
+		status  interface{}
+	}{
+		{
+			name:    "active",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			allowed: true,
+			status:  store.CompanyActive,
+		},
+		{
+			name:    "trial",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c91",
+			allowed: true,
+			status:  store.CompanyTrial,
+		},
+		{
+			name:    "suspended",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c92",
+			reason:  "company suspended",
+		},
+		{
+			name:    "deleted",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c93",
+			reason:  "company deleted",
+		},
+		{
+			name:    "no company row",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c94",
+			allowed: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := a.Decide(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+				Type: "REQUEST",
+				Headers: map[string]string{
+					"x-agent-id": test.agentID,
+				},
+				MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, test.allowed, d.Allowed)
+			assert.Equal(t, test.reason, d.Reason)
+			if test.reason != "" {
+				assert.Equal(t, test.reason, d.Response.Context["reason"])
+			} else {
+				assert.Equal(t, test.status, d.Response.Context["companyStatus"])
+			}
+		})
+	}
+}
+
+func TestAuthorizeCompanyLimits(t *testing.T) {
+	rs := role.Roles{}
+	rs.Add(role.Ingest, "", &policy.Route{Verb: "POST", Resource: "bug"})
+	a := service.Authorizer{
+		Store: &store.Memory{
+			Agents: []store.MemoryAgent{
+				{
+					Agent: store.Agent{
+						ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+						CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+						Roles:     []string{role.Ingest},
+						Company: store.Company{
+							ID:     "b9e9153a-028c-4173-a7a8-e5063334416a",
+							Status: store.CompanyActive,
+							Plan:   "business",
+							Limits: store.Limits{Monthly: 2, Rate: 0.001, Burst: 3},
 						},
 					},
 				},
-				Context: map[string]interface{}{
-					"booleanKey": true,
-					"numberKey":  123,
-					"stringKey":  "stringval",
-				},
 			},
+			RoleDefinitions: rs,
 		},
-		{
-			name: "allowed key and secret",
-			agent: AgentData{
-				ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c72",
-				Key:       "94365b00-c6df-483f-804e-363312750500",
-				Secret:    "f7356946-5814-4b5e-ad45-0348a89576ef",
-				CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
-				Name:      "bugfixes test frontend -- allowed key",
+		Scope:   policy.ScopeMethod,
+		Limiter: ratelimit.NewMemory(),
+		Plans: ratelimit.Plans{
+			"business": {Company: ratelimit.Limit{Rate: 100, Burst: 100}},
+		},
+		Quota: quota.NewTracker(quota.NewMemory()),
+		Allowances: quota.Allowances{
+			"business": {Monthly: 100},
+		},
+	}
+
+	decide := func() service.Decision {
+		d, err := a.Decide(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+			Type: "REQUEST",
+			Headers: map[string]string{
+				"x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
 			},
-			request: events.APIGatewayCustomAuthorizerRequestTypeRequest{
-				Type: "TOKEN",
+			MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+		})
+		assert.NoError(t, err)
+		return d
+	}
+
+	// the company's own allowance of 2 runs out before the plan's, and its burst of 3 after that
+	assert.True(t, decide().Allowed)
+	assert.True(t, decide().Allowed)
+	assert.Equal(t, "quota exceeded", decide().Reason)
+	assert.Equal(t, "rate limited", decide().Reason)
+}
+
+func TestAuthorizeAgentStatus(t *testing.T) {
+	rs := role.Roles{}
+	rs.Add(role.Ingest, "", &policy.Route{Verb: "POST", Resource: "bug"})
+	rs.Add(role.Dashboard, "", &policy.Route{Verb: "GET", Resource: "bug/*"})
+	rs.Add(role.CompanyAdmin, role.Ingest, nil)
+	rs.Add(role.CompanyAdmin, role.Dashboard, nil)
+	agent := func(id, status string) store.MemoryAgent {
+		return store.MemoryAgent{
+			Agent: store.Agent{
+				ID:     id,
+				Roles:  []string{role.CompanyAdmin},
+				Status: status,
+			},
+		}
+	}
+	a := service.Authorizer{
+		Store: &store.Memory{
+			Agents: []store.MemoryAgent{
+				agent("ad4b99e1-dec8-4682-862a-6b017e7c7c90", store.AgentActive),
+				agent("ad4b99e1-dec8-4682-862a-6b017e7c7c91", store.AgentDisabled),
+				agent("ad4b99e1-dec8-4682-862a-6b017e7c7c92", store.AgentPausedIngest),
+				agent("ad4b99e1-dec8-4682-862a-6b017e7c7c93", store.AgentDeleted),
+				agent("ad4b99e1-dec8-4682-862a-6b017e7c7c94", ""),
+			},
+			RoleDefinitions: rs,
+		},
+		Scope: policy.ScopeRoutes,
+	}
+
+	tests := []struct {
+		name    string
+		agentID string
+		arn     string
+		allowed bool
+		reason  string
+		routes  []policy.Route
+	}{
+		{
+			name:    "active",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			arn:     "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			allowed: true,
+			routes:  []policy.Route{{Verb: "POST", Resource: "bug"}, {Verb: "GET", Resource: "bug/*"}},
+		},
+		{
+			name:    "no status",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c94",
+			arn:     "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			allowed: true,
+			routes:  []policy.Route{{Verb: "POST", Resource: "bug"}, {Verb: "GET", Resource: "bug/*"}},
+		},
+		{
+			name:    "disabled",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c91",
+			arn:     "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/bug/1234",
+			reason:  "agent disabled",
+		},
+		{
+			name:    "deleted",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c93",
+			arn:     "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/bug/1234",
+			reason:  "agent deleted",
+		},
+		{
+			name:    "paused ingest",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c92",
+			arn:     "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			reason:  "agent paused",
+		},
+		{
+			name:    "paused read",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c92",
+			arn:     "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/bug/1234",
+			allowed: true,
+			routes:  []policy.Route{{Verb: "GET", Resource: "bug/*"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := a.Decide(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+				Type: "REQUEST",
 				Headers: map[string]string{
-					"x-api-key":    "94365b00-c6df-483f-804e-363312750500",
-					"x-api-secret": "f7356946-5814-4b5e-ad45-0348a89576ef",
+					"x-agent-id": test.agentID,
 				},
-				MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/",
-			},
-			expect: events.APIGatewayCustomAuthorizerResponse{
-				PrincipalID: "system",
-				PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
-					Version: "2012-10-17",
-					Statement: []events.IAMPolicyStatement{
-						{
-							Action:   []string{"execute-api:Invoke"},
-							Effect:   "Allow",
-							Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/"},
-						},
-					},
+				MethodArn: test.arn,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, test.allowed, d.Allowed)
+			assert.Equal(t, test.reason, d.Reason)
+			assert.ElementsMatch(t, test.routes, d.Routes)
+			if test.reason != "" {
+				assert.Equal(t, test.reason, d.Response.Context["reason"])
+			}
+		})
+	}
+}
+
+func TestAuthorizeUsageKey(t *testing.T) {
+	rs := role.Roles{}
+	rs.Add(role.Ingest, "", &policy.Route{Verb: "POST", Resource: "bug"})
+	s := &store.Memory{
+		Agents: []store.MemoryAgent{
+			{
+				Agent: store.Agent{
+					ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+					CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+					Roles:     []string{role.Ingest},
+					UsageKey:  "bugfixes-agent-usage-key",
 				},
-				Context: map[string]interface{}{
-					"booleanKey": true,
-					"numberKey":  123,
-					"stringKey":  "stringval",
+			},
+			{
+				Agent: store.Agent{
+					ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c91",
+					CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+					Roles:     []string{role.Ingest},
 				},
 			},
 		},
+		RoleDefinitions: rs,
+	}
+
+	tests := []struct {
+		name     string
+		require  bool
+		agentID  string
+		usageKey string
+		allowed  bool
+		reason   string
+	}{
 		{
-			name: "denied key and secret",
-			agent: AgentData{
-				ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c73",
-				Key:       "94365b00-c6df-483f-804e-363312750500",
-				Secret:    "f7356946-5814-4b5e-ad45-0348a89576ef",
-				CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
-				Name:      "bugfixes test frontend -- denied key",
-			},
-			request: events.APIGatewayCustomAuthorizerRequestTypeRequest{
-				Type: "TOKEN",
-				Headers: map[string]string{
-					"x-api-key":    "94365b00-c6df-483f-804e-363312750501",
-					"x-api-secret": "f7356946-5814-4b5e-ad45-0348a89576ef",
+			name:     "usage key",
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			usageKey: "bugfixes-agent-usage-key",
+			allowed:  true,
+		},
+		{
+			name:    "missing usage key",
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c91",
+			allowed: true,
+		},
+		{
+			name:     "required usage key",
+			require:  true,
+			agentID:  "ad4b99e1-dec8-4682-862a-6b017e7c7c90",
+			usageKey: "bugfixes-agent-usage-key",
+			allowed:  true,
+		},
+		{
+			name:    "required missing usage key",
+			require: true,
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c91",
+			reason:  "no usage key",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := service.Authorizer{
+				Store:           s,
+				Scope:           policy.ScopeMethod,
+				RequireUsageKey: test.require,
+			}
+			d, err := a.Decide(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+				Type:      "REQUEST",
+				Headers:   map[string]string{"x-agent-id": test.agentID},
+				MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, test.allowed, d.Allowed)
+			assert.Equal(t, test.reason, d.Reason)
+			assert.Equal(t, test.usageKey, d.Response.UsageIdentifierKey)
+		})
+	}
+}
+
+func TestAuthorizeNonce(t *testing.T) {
+	m := miniredis.RunT(t)
+	c := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	memory := nonce.NewMemory()
+	shared := nonce.NewRedis(c)
+
+	tests := []struct {
+		name    string
+		nonces  []nonce.Store
+		require bool
+		agentID string
+		nonce   string
+		allowed bool
+		reason  string
+	}{
+		{
+			name:    "first use",
+			nonces:  []nonce.Store{memory},
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+			nonce:   "6b0e1c2a-3d4f-4b5e-8a9c-0d1e2f3a4b5c",
+			allowed: true,
+		},
+		{
+			name:    "replayed",
+			nonces:  []nonce.Store{memory},
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+			nonce:   "6b0e1c2a-3d4f-4b5e-8a9c-0d1e2f3a4b5c",
+			reason:  "replayed",
+		},
+		{
+			name:    "another agent",
+			nonces:  []nonce.Store{memory},
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c81",
+			nonce:   "6b0e1c2a-3d4f-4b5e-8a9c-0d1e2f3a4b5c",
+			allowed: true,
+		},
+		{
+			name:    "replayed to another container",
+			nonces:  []nonce.Store{shared, nonce.NewRedis(c)},
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+			nonce:   "7c1f2d3b-4e5a-4c6f-9b0d-1e2f3a4b5c6d",
+			reason:  "replayed",
+		},
+		{
+			name:    "no nonce",
+			nonces:  []nonce.Store{memory},
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+			allowed: true,
+		},
+		{
+			name:    "required nonce",
+			nonces:  []nonce.Store{memory},
+			require: true,
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+			reason:  "nonce missing",
+		},
+		{
+			name:    "too long",
+			nonces:  []nonce.Store{memory},
+			agentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+			nonce:   strings.Repeat("a", nonce.MaxLength+1),
+			reason:  "invalid nonce",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var d service.Decision
+			for _, n := range test.nonces {
+				a := service.Authorizer{
+					Store:        memoryStore(),
+					Scope:        policy.ScopeMethod,
+					Nonces:       n,
+					NonceTTL:     time.Minute,
+					RequireNonce: test.require,
+				}
+				headers := map[string]string{"x-agent-id": test.agentID}
+				if test.nonce != "" {
+					headers["X-Request-Nonce"] = test.nonce
+				}
+
+				var err error
+				d, err = a.Decide(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+					Type:      "REQUEST",
+					Headers:   headers,
+					MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+				})
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.allowed, d.Allowed)
+			assert.Equal(t, test.reason, d.Reason)
+		})
+	}
+
+	// a nonce that can't be recorded doesn't stop ingest
+	m.Close()
+	a := service.Authorizer{
+		Store:    memoryStore(),
+		Scope:    policy.ScopeMethod,
+		Nonces:   shared,
+		NonceTTL: time.Minute,
+	}
+	d, err := a.Decide(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+		Type: "REQUEST",
+		Headers: map[string]string{
+			"x-agent-id":      "ad4b99e1-dec8-4682-862a-6b017e7c7c80",
+			"x-request-nonce": "8d2a3e4c-5f6b-4d7a-8c1e-2f3a4b5c6d7e",
+		},
+		MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+	})
+	assert.NoError(t, err)
+	assert.True(t, d.Allowed)
+}
+
+func TestAuthorizeRules(t *testing.T) {
+	entitled := true
+	engine, err := rules.Compile(rules.File{
+		Default: rules.Deny,
+		Rules: []rules.Rule{
+			{
+				Name:   "blocked network",
+				Effect: rules.Deny,
+				Match: rules.Match{
+					SourceIP: []string{"203.0.113.0/24"},
 				},
-				MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/",
 			},
-			expect: events.APIGatewayCustomAuthorizerResponse{
-				PrincipalID: "system",
-				PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
-					Version: "2012-10-17",
-					Statement: []events.IAMPolicyStatement{
-						{
-							Action:   []string{"execute-api:Invoke"},
-							Effect:   "Deny",
-							Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/"},
-						},
-					},
+			{
+				Name:   "entitled",
+				Effect: rules.Allow,
+				Match: rules.Match{
+					Entitled: &entitled,
 				},
 				Context: map[string]interface{}{
-					"booleanKey": true,
-					"numberKey":  123,
-					"stringKey":  "stringval",
+					"tier": "standard",
 				},
 			},
 		},
+	})
+	if err != nil {
+		t.Fatalf("compile rules: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		sourceIP  string
+		methodArn string
+		expect    bool
+		rule      string
+	}{
+		{
+			name:      "entitled",
+			sourceIP:  "192.0.2.1",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			expect:    true,
+			rule:      "entitled",
+		},
+		{
+			name:      "blocked network",
+			sourceIP:  "203.0.113.9",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			expect:    false,
+			rule:      "blocked network",
+		},
+		{
+			name:      "not entitled falls to default",
+			sourceIP:  "192.0.2.1",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/bug/1234",
+			expect:    false,
+			rule:      "",
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			// inject key
-			injErr := injectAgent(test.agent)
-			if injErr != nil {
-				t.Errorf("inject err: %w", injErr)
+			a := service.Authorizer{
+				Store: memoryStore(),
+				Scope: policy.ScopeRoutes,
+				Rules: engine,
 			}
-
-			// do the test
-			resp, err := service.Handler(test.request)
-			passed := assert.IsType(t, test.err, err)
-			if !passed {
-				t.Errorf("%s type failed: %w", test.name, err)
+			event := events.APIGatewayCustomAuthorizerRequestTypeRequest{
+				Type: "REQUEST",
+				Headers: map[string]string{
+					"x-api-key":    "94365b00-c6df-483f-804e-363312750580",
+					"x-api-secret": "f7356946-5814-4b5e-ad45-0348a89576ef",
+				},
+				MethodArn: test.methodArn,
 			}
-			passed = assert.Equal(t, test.expect, resp)
-			if !passed {
-				t.Errorf("%s equal failed: %+v, resp: %+v", test.name, test.expect, resp)
+			event.RequestContext.Identity.SourceIP = test.sourceIP
+
+			resp, err := a.Authorize(context.Background(), event)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expect, policy.Evaluate(resp.PolicyDocument, test.methodArn))
+			assert.Equal(t, test.rule, resp.Context["rule"])
+			if test.expect {
+				assert.Equal(t, "standard", resp.Context["tier"])
 			}
+		})
+	}
+}
+
+func TestAuthorizeOPA(t *testing.T) {
+	const src = `package bugfixes.authz
+
+decision := {"allow": input.entitled, "reason": "from opa"}
+`
+
+	tests := []struct {
+		name      string
+		path      string
+		methodArn string
+		expect    bool
+	}{
+		{
+			name:      "entitled",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			expect:    true,
+		},
+		{
+			name:      "not entitled",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/bug/1234",
+			expect:    false,
+		},
+		{
+			name:      "undefined rule",
+			path:      "bugfixes/authz/missing",
+			methodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			expect:    false,
+		},
+	}
 
-			// delete the tester key
-			delErr := deleteAgent(test.agent.ID)
-			if delErr != nil {
-				t.Errorf("delete err: %w", delErr)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := opa.New(context.Background(), "test.rego", src, test.path, time.Second)
+			assert.NoError(t, err)
+			a := service.Authorizer{
+				Store: memoryStore(),
+				Scope: policy.ScopeMethod,
+				OPA:   e,
 			}
+			resp, err := a.Authorize(context.Background(), events.APIGatewayCustomAuthorizerRequestTypeRequest{
+				Type: "REQUEST",
+				Headers: map[string]string{
+					"x-api-key":    "94365b00-c6df-483f-804e-363312750580",
+					"x-api-secret": "f7356946-5814-4b5e-ad45-0348a89576ef",
+				},
+				MethodArn: test.methodArn,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, test.expect, policy.Evaluate(resp.PolicyDocument, test.methodArn))
 		})
 	}
 }
 
-func BenchmarkHandler(b *testing.B) {
+func BenchmarkReplay(b *testing.B) {
 	b.ReportAllocs()
 
-  if os.Getenv("GITHUB_ACTOR") == "" {
-    err := godotenv.Load()
-    if err != nil {
-      b.Errorf("godotenv err: %w", err)
-    }
-  }
-
-  connectDetails = fmt.Sprintf(
-    "host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-    os.Getenv("DB_HOSTNAME"),
-    os.Getenv("DB_PORT"),
-    os.Getenv("DB_USERNAME"),
-    os.Getenv("DB_PASSWORD"),
-    os.Getenv("DB_DATABASE"))
-
-  tests := []struct {
-    name    string
-    agent   AgentData
-    request events.APIGatewayCustomAuthorizerRequestTypeRequest
-    expect  events.APIGatewayCustomAuthorizerResponse
-    err     error
-  }{
-    {
-      name: "allowed agentid",
-      agent: AgentData{
-        ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
-        Key:       "94365b00-c6df-483f-804e-363312750500",
-        Secret:    "f7356946-5814-4b5e-ad45-0348a89576ef",
-        CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
-        Name:      "bugfixes test frontend -- allowed agentid",
-      },
-      request: events.APIGatewayCustomAuthorizerRequestTypeRequest{
-        Type: "TOKEN",
-        Headers: map[string]string{
-          "x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
-        },
-        MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/",
-      },
-      expect: events.APIGatewayCustomAuthorizerResponse{
-        PrincipalID: "system",
-        PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
-          Version: "2012-10-17",
-          Statement: []events.IAMPolicyStatement{
-            {
-              Action:   []string{"execute-api:Invoke"},
-              Effect:   "Allow",
-              Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/"},
-            },
-          },
-        },
-        Context: map[string]interface{}{
-          "booleanKey": true,
-          "numberKey":  123,
-          "stringKey":  "stringval",
-        },
-      },
-    },
-    {
-      name: "denied agentid",
-      agent: AgentData{
-        ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c71",
-        Key:       "94365b00-c6df-483f-804e-363312750500",
-        Secret:    "f7356946-5814-4b5e-ad45-0348a89576ef",
-        CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
-        Name:      "bugfixes test frontend -- denied agentid",
-      },
-      request: events.APIGatewayCustomAuthorizerRequestTypeRequest{
-        Type: "TOKEN",
-        Headers: map[string]string{
-          "x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
-        },
-        MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/",
-      },
-      expect: events.APIGatewayCustomAuthorizerResponse{
-        PrincipalID: "system",
-        PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
-          Version: "2012-10-17",
-          Statement: []events.IAMPolicyStatement{
-            {
-              Action:   []string{"execute-api:Invoke"},
-              Effect:   "Deny",
-              Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/"},
-            },
-          },
-        },
-        Context: map[string]interface{}{
-          "booleanKey": true,
-          "numberKey":  123,
-          "stringKey":  "stringval",
-        },
-      },
-    },
-    {
-      name: "allowed key and secret",
-      agent: AgentData{
-        ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c72",
-        Key:       "94365b00-c6df-483f-804e-363312750500",
-        Secret:    "f7356946-5814-4b5e-ad45-0348a89576ef",
-        CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
-        Name:      "bugfixes test frontend -- allowed key",
-      },
-      request: events.APIGatewayCustomAuthorizerRequestTypeRequest{
-        Type: "TOKEN",
-        Headers: map[string]string{
-          "x-api-key":    "94365b00-c6df-483f-804e-363312750500",
-          "x-api-secret": "f7356946-5814-4b5e-ad45-0348a89576ef",
-        },
-        MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/",
-      },
-      expect: events.APIGatewayCustomAuthorizerResponse{
-        PrincipalID: "system",
-        PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
-          Version: "2012-10-17",
-          Statement: []events.IAMPolicyStatement{
-            {
-              Action:   []string{"execute-api:Invoke"},
-              Effect:   "Allow",
-              Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/"},
-            },
-          },
-        },
-        Context: map[string]interface{}{
-          "booleanKey": true,
-          "numberKey":  123,
-          "stringKey":  "stringval",
-        },
-      },
-    },
-    {
-      name: "denied key and secret",
-      agent: AgentData{
-        ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c73",
-        Key:       "94365b00-c6df-483f-804e-363312750500",
-        Secret:    "f7356946-5814-4b5e-ad45-0348a89576ef",
-        CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
-        Name:      "bugfixes test frontend -- denied key",
-      },
-      request: events.APIGatewayCustomAuthorizerRequestTypeRequest{
-        Type: "TOKEN",
-        Headers: map[string]string{
-          "x-api-key":    "94365b00-c6df-483f-804e-363312750501",
-          "x-api-secret": "f7356946-5814-4b5e-ad45-0348a89576ef",
-        },
-        MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/",
-      },
-      expect: events.APIGatewayCustomAuthorizerResponse{
-        PrincipalID: "system",
-        PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
-          Version: "2012-10-17",
-          Statement: []events.IAMPolicyStatement{
-            {
-              Action:   []string{"execute-api:Invoke"},
-              Effect:   "Deny",
-              Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/"},
-            },
-          },
-        },
-        Context: map[string]interface{}{
-          "booleanKey": true,
-          "numberKey":  123,
-          "stringKey":  "stringval",
-        },
-      },
-    },
-  }
-
-  b.ResetTimer()
-
-  for _, test := range tests {
-    b.Run(test.name, func(t *testing.B) {
-      b.StopTimer()
-
-      // inject key
-      injErr := injectAgent(test.agent)
-      if injErr != nil {
-        t.Errorf("inject err: %w", injErr)
-      }
-
-      b.StartTimer()
-      // do the test
-      resp, err := service.Handler(test.request)
-      passed := assert.IsType(t, test.err, err)
-      if !passed {
-        t.Errorf("%s type failed: %w", test.name, err)
-      }
-      passed = assert.Equal(t, test.expect, resp)
-      if !passed {
-        t.Errorf("%s equal failed: %+v, resp: %+v", test.name, test.expect, resp)
-      }
-      b.StopTimer()
-
-      // delete the tester key
-      delErr := deleteAgent(test.agent.ID)
-      if delErr != nil {
-        t.Errorf("delete err: %w", delErr)
-      }
-    })
-  }
+	fixture, err := store.LoadFixture("testdata/fixture.json")
+	if err != nil {
+		b.Fatalf("fixture: %v", err)
+	}
+	a, err := service.NewAuthorizer(service.Config{PolicyScope: "method"}, fixture)
+	if err != nil {
+		b.Fatalf("authorizer: %v", err)
+	}
+
+	cases, err := replay.Load("testdata/replay")
+	if err != nil {
+		b.Fatalf("replay load: %v", err)
+	}
+
+	for _, c := range cases {
+		c := c
+		b.Run(c.Name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := a.Authorize(context.Background(), c.Event); err != nil {
+					b.Fatalf("authorize: %v", err)
+				}
+			}
+		})
+	}
 }
@@ -0,0 +1,678 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/bugfixes/authorizer/policies"
+	"github.com/bugfixes/authorizer/service/ipfilter"
+	"github.com/bugfixes/authorizer/service/lockout"
+	"github.com/bugfixes/authorizer/service/nonce"
+	"github.com/bugfixes/authorizer/service/opa"
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/bugfixes/authorizer/service/quota"
+	"github.com/bugfixes/authorizer/service/ratelimit"
+	"github.com/bugfixes/authorizer/service/revocation"
+	"github.com/bugfixes/authorizer/service/rules"
+	"github.com/bugfixes/authorizer/service/scope"
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/redis/go-redis/v9"
+)
+
+// Config is the authorizer settings as they come from the environment
+type Config struct {
+	PolicyScope  string
+	DefaultRoles string
+	ScopeRoutes  string
+	PolicyFile   string
+
+	// OPAPolicy turns rego on, bundled for the policies/authorizer.rego built into the
+	// binary or the path of a rego file in the deployment package. OPAPath is the rule
+	// to evaluate and OPATimeout caps an evaluation, a duration like "500ms"
+	OPAPolicy  string
+	OPAPath    string
+	OPATimeout string
+
+	RateLimiter string
+	RateLimits  string
+	Quotas      string
+	Lockout     string
+
+	// IPDenylist is a comma separated list of addresses and CIDRs nothing is let in from
+	IPDenylist string
+
+	// TrustedProxies are the addresses and CIDRs whose X-Forwarded-For is believed
+	TrustedProxies string
+
+	// ExpiryGrace is how long expired credentials keep working, ExpiryWarning how long
+	// before expiry credentialExpiring is set, both are durations like "72h"
+	ExpiryGrace   string
+	ExpiryWarning string
+
+	// RevocationInterval is how often to look for revoked credentials, a duration
+	// like "1s", it only applies to the postgres store
+	RevocationInterval string
+
+	// IdentityCacheTTL turns the identity cache on, IdentityCacheNegativeTTL is how long
+	// unknown credentials are kept and IdentityCacheSize the most entries. Nothing evicts
+	// an entry before its ttl, revocations still apply within RevocationInterval as the
+	// checker turns the cached agent away, but status changes, company suspension and
+	// retired secrets wait out the ttl
+	IdentityCacheTTL         string
+	IdentityCacheNegativeTTL string
+	IdentityCacheSize        string
+
+	// CallBudget is the longest a backend call can take and DeadlineReserve how much
+	// of the lambda's time is kept back to answer in, both durations like "250ms"
+	CallBudget      string
+	DeadlineReserve string
+
+	// StoreBreakerFailures turns the breaker around the store on, StoreBreakerCoolDown
+	// is how long it stays open and StoreBreakerSuccesses the probes it takes to close
+	StoreBreakerFailures  string
+	StoreBreakerCoolDown  string
+	StoreBreakerSuccesses string
+
+	// DegradedMode is deny or error, for when the store can't answer
+	DegradedMode string
+
+	// RedisAddr is the host:port of a redis shared by every container, empty keeps the
+	// identity cache and revocation polling in the container, RedisPassword is for AUTH
+	// and RedisTLS, parsed with strconv.ParseBool, connects over tls
+	RedisAddr     string
+	RedisPassword string
+	RedisTLS      string
+
+	// RequireUsageKey is parsed with strconv.ParseBool, empty is false
+	RequireUsageKey string
+
+	// NonceTTL turns replay protection on, a duration like "5m" for how long a nonce
+	// can't be used again, kept in redis when RedisAddr is set. RequireNonce is parsed
+	// with strconv.ParseBool and denies requests without one
+	NonceTTL     string
+	RequireNonce string
+}
+
+// ConfigFromEnv reads the settings from the lambda environment
+func ConfigFromEnv() Config {
+	return Config{
+		PolicyScope:  os.Getenv("POLICY_SCOPE"),
+		DefaultRoles: os.Getenv("DEFAULT_ROLES"),
+		ScopeRoutes:  os.Getenv("SCOPE_ROUTES"),
+		PolicyFile:   os.Getenv("POLICY_FILE"),
+		OPAPolicy:    os.Getenv("OPA_POLICY"),
+		OPAPath:      os.Getenv("OPA_PATH"),
+		OPATimeout:   os.Getenv("OPA_TIMEOUT"),
+		RateLimiter:  os.Getenv("RATE_LIMITER"),
+		RateLimits:   os.Getenv("RATE_LIMITS"),
+		Quotas:       os.Getenv("QUOTAS"),
+		Lockout:      os.Getenv("LOCKOUT"),
+
+		IPDenylist:     os.Getenv("IP_DENYLIST"),
+		TrustedProxies: os.Getenv("TRUSTED_PROXIES"),
+
+		ExpiryGrace:   os.Getenv("EXPIRY_GRACE"),
+		ExpiryWarning: os.Getenv("EXPIRY_WARNING"),
+
+		RevocationInterval: os.Getenv("REVOCATION_INTERVAL"),
+
+		IdentityCacheTTL:         os.Getenv("IDENTITY_CACHE_TTL"),
+		IdentityCacheNegativeTTL: os.Getenv("IDENTITY_CACHE_NEGATIVE_TTL"),
+		IdentityCacheSize:        os.Getenv("IDENTITY_CACHE_SIZE"),
+
+		CallBudget:      os.Getenv("CALL_BUDGET"),
+		DeadlineReserve: os.Getenv("DEADLINE_RESERVE"),
+
+		StoreBreakerFailures:  os.Getenv("STORE_BREAKER_FAILURES"),
+		StoreBreakerCoolDown:  os.Getenv("STORE_BREAKER_COOL_DOWN"),
+		StoreBreakerSuccesses: os.Getenv("STORE_BREAKER_SUCCESSES"),
+
+		DegradedMode: os.Getenv("DEGRADED_MODE"),
+
+		RedisAddr:     os.Getenv("REDIS_ADDR"),
+		RedisPassword: os.Getenv("REDIS_PASSWORD"),
+		RedisTLS:      os.Getenv("REDIS_TLS"),
+
+		RequireUsageKey: os.Getenv("REQUIRE_USAGE_KEY"),
+
+		NonceTTL:     os.Getenv("NONCE_TTL"),
+		RequireNonce: os.Getenv("REQUIRE_NONCE"),
+	}
+}
+
+// ConnectDetailsFromEnv reads the postgres settings from the lambda environment
+func ConnectDetailsFromEnv() store.ConnectDetails {
+	return store.ConnectDetails{
+		Host:     os.Getenv("DB_HOSTNAME"),
+		Port:     os.Getenv("DB_PORT"),
+		Username: os.Getenv("DB_USERNAME"),
+		Password: os.Getenv("DB_PASSWORD"),
+		Database: os.Getenv("DB_DATABASE"),
+		Replicas: splitList(os.Getenv("DB_REPLICAS")),
+	}
+}
+
+// NewAuthorizer builds an authorizer around the store, policy files are loaded and compiled here
+func NewAuthorizer(c Config, s store.Store) (*Authorizer, error) {
+	policyScope, err := policy.ParseScope(c.PolicyScope)
+	if err != nil {
+		return nil, fmt.Errorf("authorizer scope: %w", err)
+	}
+
+	scopes := scope.DefaultMapping()
+	if c.ScopeRoutes != "" {
+		scopes, err = scope.ParseMapping(c.ScopeRoutes)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer scopes: %w", err)
+		}
+	}
+
+	var engine *rules.Engine
+	if c.PolicyFile != "" {
+		engine, err = rules.Load(c.PolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer rules: %w", err)
+		}
+	}
+
+	decider, err := opaEngine(c)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := redisClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter, plans, err := rateLimiter(c, s, shared)
+	if err != nil {
+		return nil, err
+	}
+
+	tracker, allowances, err := quotaTracker(c, s)
+	if err != nil {
+		return nil, err
+	}
+
+	guard, err := lockoutGuard(c, s)
+	if err != nil {
+		return nil, err
+	}
+
+	ipDeny, err := ipfilter.ParseList(splitList(c.IPDenylist))
+	if err != nil {
+		return nil, fmt.Errorf("authorizer ip denylist: %w", err)
+	}
+
+	trustedProxies, err := ipfilter.ParseList(splitList(c.TrustedProxies))
+	if err != nil {
+		return nil, fmt.Errorf("authorizer trusted proxies: %w", err)
+	}
+
+	revocations, err := revocationChecker(c, s, shared)
+	if err != nil {
+		return nil, err
+	}
+
+	var expiryGrace time.Duration
+	if c.ExpiryGrace != "" {
+		expiryGrace, err = time.ParseDuration(c.ExpiryGrace)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer expiry grace: %w", err)
+		}
+	}
+
+	expiryWarning := DefaultExpiryWarning
+	if c.ExpiryWarning != "" {
+		expiryWarning, err = time.ParseDuration(c.ExpiryWarning)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer expiry warning: %w", err)
+		}
+	}
+
+	var callBudget time.Duration
+	if c.CallBudget != "" {
+		callBudget, err = time.ParseDuration(c.CallBudget)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer call budget: %w", err)
+		}
+	}
+
+	deadlineReserve := DefaultDeadlineReserve
+	if c.DeadlineReserve != "" {
+		deadlineReserve, err = time.ParseDuration(c.DeadlineReserve)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer deadline reserve: %w", err)
+		}
+	}
+
+	switch c.DegradedMode {
+	case "", DegradedDeny, DegradedError:
+	default:
+		return nil, fmt.Errorf("authorizer degraded mode: unknown mode: %s", c.DegradedMode)
+	}
+
+	breaker, err := storeBreaker(c, s)
+	if err != nil {
+		return nil, err
+	}
+
+	cached, err := identityCache(c, breaker, shared)
+	if err != nil {
+		return nil, err
+	}
+
+	requireUsageKey := false
+	if c.RequireUsageKey != "" {
+		requireUsageKey, err = strconv.ParseBool(c.RequireUsageKey)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer require usage key: %w", err)
+		}
+	}
+
+	nonces, nonceTTL, requireNonce, err := nonceStore(c, shared)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authorizer{
+		Store:        cached,
+		Scope:        policyScope,
+		DefaultRoles: splitList(c.DefaultRoles),
+		Scopes:       scopes,
+		Rules:        engine,
+		OPA:          decider,
+		Limiter:      limiter,
+		Plans:        plans,
+		Quota:        tracker,
+		Allowances:   allowances,
+		Lockout:      guard,
+
+		IPDeny:         ipDeny,
+		TrustedProxies: trustedProxies,
+
+		Revocations: revocations,
+
+		ExpiryGrace:   expiryGrace,
+		ExpiryWarning: expiryWarning,
+
+		CallBudget:      callBudget,
+		DeadlineReserve: deadlineReserve,
+		DegradedMode:    c.DegradedMode,
+
+		RequireUsageKey: requireUsageKey,
+
+		Nonces:       nonces,
+		NonceTTL:     nonceTTL,
+		RequireNonce: requireNonce,
+	}, nil
+}
+
+// opaEngine compiles the rego policy when OPA_POLICY is set, bundled is the one built
+// into the binary and anything else a file in the deployment package
+func opaEngine(c Config) (*opa.Engine, error) {
+	if c.OPAPolicy == "" {
+		return nil, nil
+	}
+
+	timeout := opa.DefaultTimeout
+	if c.OPATimeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(c.OPATimeout)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer opa timeout: %w", err)
+		}
+	}
+
+	ctx := context.Background()
+	if c.OPAPolicy == "bundled" {
+		e, err := opa.New(ctx, "policies/authorizer.rego", policies.Authorizer, c.OPAPath, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer opa: %w", err)
+		}
+		return e, nil
+	}
+
+	e, err := opa.Load(ctx, c.OPAPolicy, c.OPAPath, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("authorizer opa: %w", err)
+	}
+	return e, nil
+}
+
+// RedisTimeout bounds connecting to redis and each command, it's there to save a trip to
+// the database so there's no point waiting on it longer
+const RedisTimeout = time.Second
+
+// redisClient is the client for REDIS_ADDR, nil when it isn't set. It doesn't connect
+// until the first command, and a command gives up after RedisTimeout if its context
+// has no deadline of its own
+func redisClient(c Config) (*redis.Client, error) {
+	if c.RedisAddr == "" {
+		return nil, nil
+	}
+
+	o := &redis.Options{
+		Addr:                  c.RedisAddr,
+		Password:              c.RedisPassword,
+		DialTimeout:           RedisTimeout,
+		ReadTimeout:           RedisTimeout,
+		WriteTimeout:          RedisTimeout,
+		ContextTimeoutEnabled: true,
+	}
+	if c.RedisTLS != "" {
+		useTLS, err := strconv.ParseBool(c.RedisTLS)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer redis tls: %w", err)
+		}
+		if useTLS {
+			o.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+	}
+	return redis.NewClient(o), nil
+}
+
+// rateLimiter is off unless RATE_LIMITER is memory, counting per container, or
+// postgres or redis, counting across containers
+func rateLimiter(c Config, s store.Store, shared *redis.Client) (ratelimit.Limiter, ratelimit.Plans, error) {
+	if c.RateLimiter == "" {
+		return nil, nil, nil
+	}
+
+	plans := ratelimit.Plans{}
+	if c.RateLimits != "" {
+		var err error
+		plans, err = ratelimit.ParsePlans(c.RateLimits)
+		if err != nil {
+			return nil, nil, fmt.Errorf("authorizer rate limits: %w", err)
+		}
+	}
+
+	switch c.RateLimiter {
+	case "memory":
+		return ratelimit.NewMemory(), plans, nil
+	case "postgres":
+		p, ok := s.(interface{ DB() *sql.DB })
+		if !ok {
+			return nil, nil, fmt.Errorf("authorizer rate limiter: postgres needs the postgres store")
+		}
+		return ratelimit.NewPostgres(p.DB()), plans, nil
+	case "redis":
+		if shared == nil {
+			return nil, nil, fmt.Errorf("authorizer rate limiter: redis needs REDIS_ADDR")
+		}
+		return ratelimit.NewRedis(shared), plans, nil
+	default:
+		return nil, nil, fmt.Errorf("authorizer rate limiter: unknown limiter: %s", c.RateLimiter)
+	}
+}
+
+// quotaTracker is off unless QUOTAS has the allowances, counts are kept in postgres
+// when that's the store and in memory for the fixture store. The dynamodb store has
+// nowhere to keep them and each container counting its own would multiply the allowance
+func quotaTracker(c Config, s store.Store) (*quota.Tracker, quota.Allowances, error) {
+	if c.Quotas == "" {
+		return nil, nil, nil
+	}
+
+	allowances, err := quota.ParseAllowances(c.Quotas)
+	if err != nil {
+		return nil, nil, fmt.Errorf("authorizer quotas: %w", err)
+	}
+	if _, ok := s.(*store.Dynamo); ok {
+		return nil, nil, fmt.Errorf("authorizer quotas: the dynamodb store can't keep the counts, use the postgres store")
+	}
+
+	if p, ok := s.(interface{ DB() *sql.DB }); ok {
+		return quota.NewTracker(quota.NewPostgres(p.DB())), allowances, nil
+	}
+	return quota.NewTracker(quota.NewMemory()), allowances, nil
+}
+
+// lockoutGuard is off unless LOCKOUT has the policy, "{}" for the defaults, failures
+// are kept in postgres when that's the store and in memory for the fixture store, as
+// with quotas the dynamodb store has nowhere to keep them
+func lockoutGuard(c Config, s store.Store) (*lockout.Guard, error) {
+	if c.Lockout == "" {
+		return nil, nil
+	}
+
+	p, err := lockout.ParsePolicy(c.Lockout)
+	if err != nil {
+		return nil, fmt.Errorf("authorizer lockout: %w", err)
+	}
+	if _, ok := s.(*store.Dynamo); ok {
+		return nil, fmt.Errorf("authorizer lockout: the dynamodb store can't keep the failures, use the postgres store")
+	}
+
+	if db, ok := s.(interface{ DB() *sql.DB }); ok {
+		return lockout.NewGuard(lockout.NewPostgres(db.DB()), p), nil
+	}
+	return lockout.NewGuard(lockout.NewMemory(), p), nil
+}
+
+// revocationChecker watches the revocation table when the store is postgres, with
+// redis the containers poll the version there and only read the table when it moves.
+// Other stores only have revokedAt on the agent, which the identity cache would keep
+// for its ttl, so the dynamodb store can't have the cache in front of it
+func revocationChecker(c Config, s store.Store, shared *redis.Client) (*revocation.Checker, error) {
+	db, ok := s.(interface{ DB() *sql.DB })
+	if !ok {
+		if _, dynamo := s.(*store.Dynamo); dynamo && c.IdentityCacheTTL != "" {
+			return nil, fmt.Errorf("authorizer revocations: the dynamodb store can't revoke cached agents, leave IDENTITY_CACHE_TTL unset")
+		}
+		return nil, nil
+	}
+
+	interval := revocation.DefaultInterval
+	if c.RevocationInterval != "" {
+		var err error
+		interval, err = time.ParseDuration(c.RevocationInterval)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer revocation interval: %w", err)
+		}
+	}
+
+	var revocations revocation.Store = revocation.NewPostgres(db.DB())
+	if shared != nil {
+		revocations = revocation.NewRedis(shared, revocations)
+	}
+	checker := revocation.NewChecker(revocations, interval)
+
+	// an agent can be cached for up to the ttl before the checker starts, twice that
+	// with redis as another container may have put it there a ttl before this one took it
+	if c.IdentityCacheTTL != "" {
+		ttl, err := time.ParseDuration(c.IdentityCacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer identity cache ttl: %w", err)
+		}
+		checker.Lookback = ttl
+		if shared != nil {
+			checker.Lookback = 2 * ttl
+		}
+	}
+	return checker, nil
+}
+
+// nonceStore is off unless NONCE_TTL is set, the nonces are kept in the container or
+// in redis when there is one, so a request replayed to another container is caught
+func nonceStore(c Config, shared *redis.Client) (nonce.Store, time.Duration, bool, error) {
+	require := false
+	if c.RequireNonce != "" {
+		var err error
+		require, err = strconv.ParseBool(c.RequireNonce)
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("authorizer require nonce: %w", err)
+		}
+	}
+
+	if c.NonceTTL == "" {
+		if require {
+			return nil, 0, false, fmt.Errorf("authorizer require nonce: needs NONCE_TTL")
+		}
+		return nil, 0, false, nil
+	}
+
+	ttl, err := time.ParseDuration(c.NonceTTL)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("authorizer nonce ttl: %w", err)
+	}
+	if ttl <= 0 {
+		return nil, 0, false, fmt.Errorf("authorizer nonce ttl: must be more than zero")
+	}
+
+	if shared != nil {
+		return nonce.NewRedis(shared), ttl, require, nil
+	}
+	return nonce.NewMemory(), ttl, require, nil
+}
+
+// storeBreaker puts the circuit breaker around the store when STORE_BREAKER_FAILURES
+// is set, inside the identity cache so cached agents are still found while it's open
+func storeBreaker(c Config, s store.Store) (store.Store, error) {
+	if c.StoreBreakerFailures == "" {
+		return s, nil
+	}
+
+	o := store.BreakerOptions{}
+	var err error
+	o.Failures, err = strconv.Atoi(c.StoreBreakerFailures)
+	if err != nil {
+		return nil, fmt.Errorf("authorizer store breaker failures: %w", err)
+	}
+	if c.StoreBreakerCoolDown != "" {
+		o.CoolDown, err = time.ParseDuration(c.StoreBreakerCoolDown)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer store breaker cool down: %w", err)
+		}
+	}
+	if c.StoreBreakerSuccesses != "" {
+		o.Successes, err = strconv.Atoi(c.StoreBreakerSuccesses)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer store breaker successes: %w", err)
+		}
+	}
+
+	return store.NewBreaker(s, o), nil
+}
+
+// identityCache puts the cache in front of the store when IDENTITY_CACHE_TTL is set,
+// it's done last so the postgres backed parts above still see the postgres store.
+// With redis the containers share what they look up
+func identityCache(c Config, s store.Store, shared *redis.Client) (store.Store, error) {
+	if c.IdentityCacheTTL == "" {
+		return s, nil
+	}
+
+	o := store.CacheOptions{}
+	var err error
+	o.TTL, err = time.ParseDuration(c.IdentityCacheTTL)
+	if err != nil {
+		return nil, fmt.Errorf("authorizer identity cache ttl: %w", err)
+	}
+	if c.IdentityCacheNegativeTTL != "" {
+		o.NegativeTTL, err = time.ParseDuration(c.IdentityCacheNegativeTTL)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer identity cache negative ttl: %w", err)
+		}
+	}
+	if c.IdentityCacheSize != "" {
+		o.Size, err = strconv.Atoi(c.IdentityCacheSize)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer identity cache size: %w", err)
+		}
+	}
+
+	if shared != nil {
+		o.Shared = store.NewRedisCache(shared)
+	}
+
+	return store.NewCache(s, o), nil
+}
+
+// StoreFromEnv picks the credential store with STORE, postgres unless it's set to
+// dynamodb or fixture, which loads FIXTURE_FILE and is meant for replaying events
+func StoreFromEnv() (store.Store, error) {
+	switch os.Getenv("STORE") {
+	case "", "postgres":
+		return store.NewPostgres(ConnectDetailsFromEnv())
+	case "dynamodb":
+		return DynamoFromEnv()
+	case "fixture":
+		return store.LoadFixture(os.Getenv("FIXTURE_FILE"))
+	default:
+		return nil, fmt.Errorf("unknown store: %s", os.Getenv("STORE"))
+	}
+}
+
+// DynamoFromEnv is the dynamodb store for DYNAMO_AGENT_TABLE and DYNAMO_ROLE_TABLE, agent
+// and role by default, DYNAMODB_ENDPOINT points it at DynamoDB Local
+func DynamoFromEnv() (*store.Dynamo, error) {
+	cfg := aws.NewConfig()
+	if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("dynamo session: %w", err)
+	}
+
+	tables := store.DynamoTables{
+		Agents: os.Getenv("DYNAMO_AGENT_TABLE"),
+		Roles:  os.Getenv("DYNAMO_ROLE_TABLE"),
+	}
+	if tables.Agents == "" {
+		tables.Agents = "agent"
+	}
+	if tables.Roles == "" {
+		tables.Roles = "role"
+	}
+
+	return store.NewDynamo(dynamodb.New(sess), tables), nil
+}
+
+// RequirePostgresStore is an error unless STORE is the postgres store, for the commands
+// that only manage postgres so they don't change a database the lambda isn't reading
+func RequirePostgresStore() error {
+	switch s := os.Getenv("STORE"); s {
+	case "", "postgres":
+		return nil
+	default:
+		return fmt.Errorf("STORE is %s, only the postgres store can be managed", s)
+	}
+}
+
+// RedisFromEnv is the client for REDIS_ADDR, REDIS_PASSWORD and REDIS_TLS, nil when there's no address
+func RedisFromEnv() (*redis.Client, error) {
+	return redisClient(ConfigFromEnv())
+}
+
+// NewAuthorizerFromEnv builds the authorizer the lambda runs
+func NewAuthorizerFromEnv() (*Authorizer, error) {
+	s, err := StoreFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("authorizer store: %w", err)
+	}
+
+	return NewAuthorizer(ConfigFromEnv(), s)
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			list = append(list, l)
+		}
+	}
+	return list
+}
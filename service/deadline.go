@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/role"
+	"github.com/bugfixes/authorizer/service/store"
+)
+
+// DefaultDeadlineReserve is how much of the invocation is kept back to answer API Gateway once a call gives up
+const DefaultDeadlineReserve = 100 * time.Millisecond
+
+// ErrBudgetExhausted is returned for a backend call that ran out of time, or had none left to start
+var ErrBudgetExhausted = errors.New("call budget exhausted")
+
+// budget bounds a backend call by CallBudget and by the invocation's deadline less
+// DeadlineReserve, whichever comes first, with neither the call has the context as is
+func (a *Authorizer) budget(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if ok {
+		deadline = deadline.Add(-a.DeadlineReserve)
+	}
+	if a.CallBudget > 0 {
+		if d := time.Now().Add(a.CallBudget); !ok || d.Before(deadline) {
+			deadline, ok = d, true
+		}
+	}
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithDeadline(ctx, deadline)
+}
+
+// findAgent looks the credentials up within the budget, if the store doesn't give up
+// when its context does it's left to finish on its own so the request still gets an answer
+func (a *Authorizer) findAgent(ctx context.Context, creds store.Credentials) (store.Agent, error) {
+	ctx, cancel := a.budget(ctx)
+	defer cancel()
+	if ctx.Err() != nil {
+		return store.Agent{}, ErrBudgetExhausted
+	}
+
+	type result struct {
+		agent store.Agent
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		agent, err := a.Store.FindAgent(ctx, creds)
+		done <- result{agent, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil && ctx.Err() != nil {
+			return store.Agent{}, fmt.Errorf("find agent: %w", ErrBudgetExhausted)
+		}
+		return r.agent, r.err
+	case <-ctx.Done():
+		return store.Agent{}, fmt.Errorf("find agent: %w", ErrBudgetExhausted)
+	}
+}
+
+// roles loads the role definitions within the budget, the same way as findAgent
+func (a *Authorizer) roles(ctx context.Context) (role.Roles, error) {
+	ctx, cancel := a.budget(ctx)
+	defer cancel()
+	if ctx.Err() != nil {
+		return nil, ErrBudgetExhausted
+	}
+
+	type result struct {
+		roles role.Roles
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		roles, err := a.Store.Roles(ctx)
+		done <- result{roles, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil && ctx.Err() != nil {
+			return nil, fmt.Errorf("roles: %w", ErrBudgetExhausted)
+		}
+		return r.roles, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("roles: %w", ErrBudgetExhausted)
+	}
+}
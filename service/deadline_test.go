@@ -0,0 +1,212 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bugfixes/authorizer/service"
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/bugfixes/authorizer/service/role"
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowStore takes its time over lookups and doesn't give up when the context does,
+// the way a driver stuck connecting doesn't, and can be made to fail
+type slowStore struct {
+	store.Store
+	findDelay  time.Duration
+	rolesDelay time.Duration
+	lookups    int64
+	err        error
+}
+
+func (s *slowStore) FindAgent(ctx context.Context, creds store.Credentials) (store.Agent, error) {
+	atomic.AddInt64(&s.lookups, 1)
+	time.Sleep(s.findDelay)
+	if s.err != nil {
+		return store.Agent{}, s.err
+	}
+	return s.Store.FindAgent(ctx, creds)
+}
+
+func (s *slowStore) Roles(ctx context.Context) (role.Roles, error) {
+	time.Sleep(s.rolesDelay)
+	return s.Store.Roles(ctx)
+}
+
+func TestAuthorizeDeadline(t *testing.T) {
+	methodArn := "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug"
+	event := events.APIGatewayCustomAuthorizerRequestTypeRequest{
+		Type:      "REQUEST",
+		Headers:   map[string]string{"x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c80"},
+		MethodArn: methodArn,
+	}
+	timeout := events.APIGatewayCustomAuthorizerResponse{
+		PrincipalID: "system",
+		PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+			Version: "2012-10-17",
+			Statement: []events.IAMPolicyStatement{
+				{
+					Action:   []string{"execute-api:Invoke"},
+					Effect:   "Deny",
+					Resource: []string{methodArn},
+				},
+			},
+		},
+		Context: map[string]interface{}{
+			"reason": "timeout",
+		},
+	}
+
+	decide := func(t *testing.T, a *service.Authorizer, ctx context.Context) (service.Decision, time.Duration) {
+		t.Helper()
+		start := time.Now()
+		d, err := a.Decide(ctx, event)
+		assert.NoError(t, err)
+		return d, time.Since(start)
+	}
+
+	t.Run("call budget", func(t *testing.T) {
+		a := &service.Authorizer{
+			Store:      &slowStore{Store: memoryStore(), findDelay: time.Second},
+			Scope:      policy.ScopeMethod,
+			CallBudget: 20 * time.Millisecond,
+		}
+
+		d, took := decide(t, a, context.Background())
+		assert.False(t, d.Allowed)
+		assert.Equal(t, "timeout", d.Reason)
+		assert.Equal(t, timeout, d.Response)
+		assert.Less(t, int64(took), int64(500*time.Millisecond))
+	})
+
+	t.Run("invocation deadline", func(t *testing.T) {
+		a := &service.Authorizer{
+			Store:           &slowStore{Store: memoryStore(), findDelay: time.Second},
+			Scope:           policy.ScopeMethod,
+			DeadlineReserve: 40 * time.Millisecond,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Millisecond)
+		defer cancel()
+		d, took := decide(t, a, ctx)
+		assert.Equal(t, timeout, d.Response)
+
+		// the reserve is left to answer in
+		assert.Less(t, int64(took), int64(60*time.Millisecond))
+	})
+
+	t.Run("nothing left", func(t *testing.T) {
+		s := &slowStore{Store: memoryStore()}
+		a := &service.Authorizer{
+			Store:           s,
+			Scope:           policy.ScopeMethod,
+			DeadlineReserve: time.Second,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		d, _ := decide(t, a, ctx)
+		assert.Equal(t, timeout, d.Response)
+		assert.Equal(t, int64(0), atomic.LoadInt64(&s.lookups))
+	})
+
+	t.Run("roles", func(t *testing.T) {
+		a := &service.Authorizer{
+			Store:      &slowStore{Store: memoryStore(), rolesDelay: time.Second},
+			Scope:      policy.ScopeMethod,
+			CallBudget: 20 * time.Millisecond,
+		}
+
+		d, _ := decide(t, a, context.Background())
+		assert.False(t, d.Allowed)
+		assert.Equal(t, "timeout", d.Reason)
+		assert.Equal(t, "ad4b99e1-dec8-4682-862a-6b017e7c7c80", d.Response.PrincipalID)
+		assert.Equal(t, "timeout", d.Response.Context["reason"])
+	})
+
+	t.Run("within budget", func(t *testing.T) {
+		a := &service.Authorizer{
+			Store:           &slowStore{Store: memoryStore(), findDelay: 5 * time.Millisecond},
+			Scope:           policy.ScopeMethod,
+			CallBudget:      time.Second,
+			DeadlineReserve: 100 * time.Millisecond,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		d, _ := decide(t, a, ctx)
+		assert.True(t, d.Allowed)
+		assert.Empty(t, d.Reason)
+	})
+}
+
+func TestAuthorizeDegraded(t *testing.T) {
+	methodArn := "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug"
+	request := func(agentID string) events.APIGatewayCustomAuthorizerRequestTypeRequest {
+		return events.APIGatewayCustomAuthorizerRequestTypeRequest{
+			Type:      "REQUEST",
+			Headers:   map[string]string{"x-agent-id": agentID},
+			MethodArn: methodArn,
+		}
+	}
+
+	s := &slowStore{Store: memoryStore()}
+	breaker := store.NewBreaker(s, store.BreakerOptions{Failures: 2, CoolDown: time.Minute})
+	a := &service.Authorizer{
+		Store: store.NewCache(breaker, store.CacheOptions{}),
+		Scope: policy.ScopeMethod,
+	}
+
+	// an agent found before the database went
+	d, err := a.Decide(context.Background(), request("ad4b99e1-dec8-4682-862a-6b017e7c7c80"))
+	assert.NoError(t, err)
+	assert.True(t, d.Allowed)
+
+	s.err = errors.New("connection refused")
+	for i := 0; i < 2; i++ {
+		d, err = a.Decide(context.Background(), request("ad4b99e1-dec8-4682-862a-6b017e7c7c70"))
+		assert.NoError(t, err)
+		assert.Equal(t, "unknown credentials", d.Reason)
+	}
+	assert.Equal(t, store.BreakerOpen, breaker.State())
+
+	// once it's open nothing waits on the database
+	d, err = a.Decide(context.Background(), request("ad4b99e1-dec8-4682-862a-6b017e7c7c70"))
+	assert.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "store unavailable", d.Reason)
+	assert.Equal(t, "system", d.Response.PrincipalID)
+	assert.Equal(t, "store unavailable", d.Response.Context["reason"])
+	assert.Equal(t, int64(3), atomic.LoadInt64(&s.lookups))
+
+	// the cached agent is found, but roles come from the store so it is turned away too
+	d, err = a.Decide(context.Background(), request("ad4b99e1-dec8-4682-862a-6b017e7c7c80"))
+	assert.NoError(t, err)
+	assert.Equal(t, "store unavailable", d.Reason)
+	assert.Equal(t, "ad4b99e1-dec8-4682-862a-6b017e7c7c80", d.Response.PrincipalID)
+
+	// or the invocation fails so API Gateway answers 500 and the SDK retries
+	a.DegradedMode = service.DegradedError
+	d, err = a.Decide(context.Background(), request("ad4b99e1-dec8-4682-862a-6b017e7c7c70"))
+	assert.True(t, errors.Is(err, store.ErrCircuitOpen))
+	assert.Equal(t, "store unavailable", d.Reason)
+
+	_, err = a.Authorize(context.Background(), request("ad4b99e1-dec8-4682-862a-6b017e7c7c70"))
+	assert.Error(t, err)
+
+	a = &service.Authorizer{
+		Store:        &slowStore{Store: memoryStore(), findDelay: time.Second},
+		Scope:        policy.ScopeMethod,
+		CallBudget:   20 * time.Millisecond,
+		DegradedMode: service.DegradedError,
+	}
+	d, err = a.Decide(context.Background(), request("ad4b99e1-dec8-4682-862a-6b017e7c7c80"))
+	assert.True(t, errors.Is(err, service.ErrBudgetExhausted))
+	assert.Equal(t, "timeout", d.Reason)
+}
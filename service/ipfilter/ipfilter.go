@@ -0,0 +1,116 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseNet reads a CIDR, or a single address as a network of one
+func ParseNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip: %s", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr: %w", err)
+	}
+	return n, nil
+}
+
+// List is a set of networks
+type List []*net.IPNet
+
+// ParseList reads addresses and CIDRs, blank entries are skipped
+func ParseList(entries []string) (List, error) {
+	var l List
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		n, err := ParseNet(e)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, n)
+	}
+	return l, nil
+}
+
+// Contains is true when any of the networks has the address
+func (l List) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP is the address the request came from, when it came through one of the
+// trusted proxies the X-Forwarded-For header is walked from the right, skipping
+// the trusted proxies, as anything left of them could have been made up by the client
+func ClientIP(sourceIP string, headers map[string]string, trusted List) net.IP {
+	ip := net.ParseIP(strings.TrimSpace(sourceIP))
+	if ip == nil || !trusted.Contains(ip) {
+		return ip
+	}
+
+	forwarded := ""
+	for k, v := range headers {
+		if strings.EqualFold(k, "x-forwarded-for") {
+			forwarded = v
+			break
+		}
+	}
+
+	hops := strings.Split(forwarded, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return ip
+		}
+		ip = hop
+		if !trusted.Contains(hop) {
+			return hop
+		}
+	}
+
+	return ip
+}
+
+// Rules is a set of allow and deny lists, an address has to be in every allow
+// list that isn't empty and in none of the deny lists
+type Rules struct {
+	Allow []List
+	Deny  []List
+}
+
+// Permits checks the address against the rules
+func (r Rules) Permits(ip net.IP) bool {
+	for _, l := range r.Deny {
+		if l.Contains(ip) {
+			return false
+		}
+	}
+	for _, l := range r.Allow {
+		if len(l) > 0 && !l.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package ipfilter_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bugfixes/authorizer/service/ipfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func list(t *testing.T, entries ...string) ipfilter.List {
+	l, err := ipfilter.ParseList(entries)
+	if err != nil {
+		t.Fatalf("parse list: %v", err)
+	}
+	return l
+}
+
+func TestParseList(t *testing.T) {
+	l, err := ipfilter.ParseList([]string{"10.0.0.0/8", " 203.0.113.7 ", "", "2001:db8::/32", "2001:db8:ffff::1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(l))
+	assert.Equal(t, "203.0.113.7/32", l[1].String())
+	assert.Equal(t, "2001:db8:ffff::1/128", l[3].String())
+
+	_, err = ipfilter.ParseList([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+
+	_, err = ipfilter.ParseList([]string{"ci.example.com"})
+	assert.Error(t, err)
+}
+
+func TestListContains(t *testing.T) {
+	l := list(t, "10.0.0.0/8", "203.0.113.7", "2001:db8::/32")
+
+	tests := []struct {
+		ip       string
+		contains bool
+	}{
+		{ip: "10.1.2.3", contains: true},
+		{ip: "11.1.2.3", contains: false},
+		{ip: "203.0.113.7", contains: true},
+		{ip: "203.0.113.8", contains: false},
+		{ip: "::ffff:10.1.2.3", contains: true},
+		{ip: "2001:db8:1::5", contains: true},
+		{ip: "2001:db9::5", contains: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			assert.Equal(t, test.contains, l.Contains(net.ParseIP(test.ip)))
+		})
+	}
+
+	assert.False(t, l.Contains(nil))
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := list(t, "10.0.0.0/8", "fd00::/8")
+
+	tests := []struct {
+		name      string
+		sourceIP  string
+		forwarded string
+		expect    string
+	}{
+		{
+			name:      "untrusted source ignores the header",
+			sourceIP:  "203.0.113.7",
+			forwarded: "198.51.100.1",
+			expect:    "203.0.113.7",
+		},
+		{
+			name:      "trusted source uses the header",
+			sourceIP:  "10.0.0.1",
+			forwarded: "198.51.100.1",
+			expect:    "198.51.100.1",
+		},
+		{
+			name:      "spoofed hops left of the client are skipped",
+			sourceIP:  "10.0.0.1",
+			forwarded: "192.0.2.99, 198.51.100.1, 10.0.0.2",
+			expect:    "198.51.100.1",
+		},
+		{
+			name:      "ipv6",
+			sourceIP:  "fd00::1",
+			forwarded: "2001:db8::7, fd00::2",
+			expect:    "2001:db8::7",
+		},
+		{
+			name:     "trusted source without the header",
+			sourceIP: "10.0.0.1",
+			expect:   "10.0.0.1",
+		},
+		{
+			name:      "invalid hop stops at the last good one",
+			sourceIP:  "10.0.0.1",
+			forwarded: "198.51.100.1, unknown",
+			expect:    "10.0.0.1",
+		},
+		{
+			name:     "no source",
+			sourceIP: "",
+			expect:   "<nil>",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if test.forwarded != "" {
+				headers["X-Forwarded-For"] = test.forwarded
+			}
+			assert.Equal(t, test.expect, ipfilter.ClientIP(test.sourceIP, headers, trusted).String())
+		})
+	}
+}
+
+func TestRulesPermits(t *testing.T) {
+	r := ipfilter.Rules{
+		Allow: []ipfilter.List{list(t, "10.0.0.0/8", "2001:db8::/32"), list(t, "10.1.0.0/16", "2001:db8:1::/48"), nil},
+		Deny:  []ipfilter.List{list(t, "10.1.2.0/24", "2001:db8:1:2::/64")},
+	}
+
+	assert.True(t, r.Permits(net.ParseIP("10.1.1.1")))
+	assert.False(t, r.Permits(net.ParseIP("10.2.1.1")))
+	assert.False(t, r.Permits(net.ParseIP("10.1.2.1")))
+	assert.True(t, r.Permits(net.ParseIP("2001:db8:1:1::1")))
+	assert.False(t, r.Permits(net.ParseIP("2001:db8:2::1")))
+	assert.False(t, r.Permits(net.ParseIP("2001:db8:1:2::1")))
+	assert.False(t, r.Permits(nil))
+
+	assert.True(t, ipfilter.Rules{}.Permits(net.ParseIP("198.51.100.1")))
+}
@@ -0,0 +1,301 @@
+package lockout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExpireEvery is how often Fail drops the entries that have been quiet long enough to
+// be forgotten, so keys and ips that are never seen again don't pile up
+const ExpireEvery = 10 * time.Minute
+
+// Reason codes written to the audit log when something is locked
+const (
+	CodeKeyLocked   = "key_locked"
+	CodeAgentLocked = "agent_locked"
+	CodeIPLocked    = "ip_locked"
+)
+
+// KeyFor is the lockout key for an api key
+func KeyFor(apiKey string) string {
+	return "key:" + apiKey
+}
+
+// AgentFor is the lockout key for an agent id
+func AgentFor(id string) string {
+	return "agent:" + id
+}
+
+// IPFor is the lockout key for a source ip
+func IPFor(ip string) string {
+	return "ip:" + ip
+}
+
+func code(key string) string {
+	switch {
+	case strings.HasPrefix(key, "ip:"):
+		return CodeIPLocked
+	case strings.HasPrefix(key, "agent:"):
+		return CodeAgentLocked
+	default:
+		return CodeKeyLocked
+	}
+}
+
+// Entry is the failures counted against a key
+type Entry struct {
+	Failures    int
+	Lockouts    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// Store keeps the entries, Fail counts a failure in one step so the failures every
+// container sees are all counted, and Expire removes entries last failed before a time
+type Store interface {
+	Get(ctx context.Context, keys ...string) (map[string]Entry, error)
+	Fail(ctx context.Context, key string, now time.Time, threshold int, p Policy) (Entry, error)
+	Delete(ctx context.Context, key string) error
+	Expire(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Policy is how many failures lock a key and for how long, each lockout is twice
+// as long as the one before up to Max, failures older than Window are forgotten and
+// lockouts once the key has gone Window and Max without a failure
+type Policy struct {
+	Threshold   int
+	IPThreshold int
+	Base        time.Duration
+	Max         time.Duration
+	Window      time.Duration
+}
+
+// DefaultPolicy locks after 5 failures, for a minute at first and at most a day
+func DefaultPolicy() Policy {
+	return Policy{
+		Threshold:   5,
+		IPThreshold: 20,
+		Base:        time.Minute,
+		Max:         24 * time.Hour,
+		Window:      15 * time.Minute,
+	}
+}
+
+// ParsePolicy reads the policy over the defaults, durations are strings like "15m",
+// e.g. {"threshold": 5, "ipThreshold": 20, "base": "1m", "max": "24h", "window": "15m"}
+func ParsePolicy(s string) (Policy, error) {
+	p := DefaultPolicy()
+	raw := struct {
+		Threshold   *int   `json:"threshold"`
+		IPThreshold *int   `json:"ipThreshold"`
+		Base        string `json:"base"`
+		Max         string `json:"max"`
+		Window      string `json:"window"`
+	}{}
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return p, fmt.Errorf("lockout policy: %w", err)
+	}
+
+	if raw.Threshold != nil {
+		p.Threshold = *raw.Threshold
+	}
+	if raw.IPThreshold != nil {
+		p.IPThreshold = *raw.IPThreshold
+	}
+	for _, d := range []struct {
+		s string
+		d *time.Duration
+	}{
+		{s: raw.Base, d: &p.Base},
+		{s: raw.Max, d: &p.Max},
+		{s: raw.Window, d: &p.Window},
+	} {
+		if d.s == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.s)
+		if err != nil {
+			return p, fmt.Errorf("lockout policy: %w", err)
+		}
+		*d.d = parsed
+	}
+
+	if p.Base <= 0 || p.Max < p.Base {
+		return p, fmt.Errorf("lockout policy: base has to be positive and no more than max")
+	}
+	return p, nil
+}
+
+func (p Policy) threshold(key string) int {
+	if code(key) == CodeIPLocked {
+		return p.IPThreshold
+	}
+	return p.Threshold
+}
+
+// fail counts a failure at now against e, locking it at the threshold, the postgres
+// store does the same in its upsert. A failure that locks starts the count again
+func (p Policy) fail(e Entry, now time.Time, threshold int) Entry {
+	if now.Sub(e.LastFailure) > p.Window {
+		e.Failures = 0
+	}
+	if e.LastFailure.Before(p.forgotten(now)) {
+		e.Lockouts = 0
+	}
+	e.Failures++
+	e.LastFailure = now
+
+	if e.Failures >= threshold {
+		e.Lockouts++
+		e.Failures = 0
+		e.LockedUntil = now.Add(p.duration(e.Lockouts))
+	}
+	return e
+}
+
+// forgotten is when an entry last failed before is as good as no entry, its failures
+// are outside the window and the next lockout starts at Base again
+func (p Policy) forgotten(now time.Time) time.Time {
+	return now.Add(-p.Window - p.Max)
+}
+
+func (p Policy) duration(lockouts int) time.Duration {
+	d := p.Base
+	for i := 1; i < lockouts && d < p.Max; i++ {
+		d *= 2
+	}
+	if d > p.Max {
+		d = p.Max
+	}
+	return d
+}
+
+// Status is the outcome of a check, it remembers which keys have entries so a
+// success only costs a write when there's something to clear
+type Status struct {
+	Key   string
+	Code  string
+	Until time.Time
+
+	tracked map[string]bool
+}
+
+// Locked is true when one of the keys is locked
+func (s Status) Locked() bool {
+	return s.Key != ""
+}
+
+// Guard counts failures and locks keys out
+type Guard struct {
+	store  Store
+	policy Policy
+
+	// Now is the clock, replaced in tests
+	Now func() time.Time
+
+	mu      sync.Mutex
+	expired time.Time
+}
+
+// NewGuard applies the policy with the store
+func NewGuard(s Store, p Policy) *Guard {
+	return &Guard{
+		store:  s,
+		policy: p,
+		Now:    time.Now,
+	}
+}
+
+// Check finds the first of the keys that's locked
+func (g *Guard) Check(ctx context.Context, keys ...string) (Status, error) {
+	entries, err := g.store.Get(ctx, keys...)
+	if err != nil {
+		return Status{}, fmt.Errorf("lockout check: %w", err)
+	}
+
+	s := Status{
+		tracked: map[string]bool{},
+	}
+	now := g.Now()
+	for _, k := range keys {
+		e, ok := entries[k]
+		if !ok {
+			continue
+		}
+		s.tracked[k] = true
+		if s.Key == "" && now.Before(e.LockedUntil) {
+			s.Key = k
+			s.Code = code(k)
+			s.Until = e.LockedUntil
+		}
+	}
+
+	return s, nil
+}
+
+// Fail counts a failed attempt against each key, locking those over the threshold
+func (g *Guard) Fail(ctx context.Context, keys ...string) error {
+	now := g.Now()
+	for _, k := range keys {
+		threshold := g.policy.threshold(k)
+		if threshold <= 0 {
+			continue
+		}
+
+		e, err := g.store.Fail(ctx, k, now, threshold, g.policy)
+		if err != nil {
+			return fmt.Errorf("lockout fail: %w", err)
+		}
+		if e.Failures == 0 {
+			fmt.Printf("audit lockout code=%s key=%s lockouts=%d until=%s\n", code(k), k, e.Lockouts, e.LockedUntil.UTC().Format(time.RFC3339))
+		}
+	}
+
+	g.expire(ctx, now)
+	return nil
+}
+
+// expire drops forgotten entries every ExpireEvery, a failure is only logged as the
+// entries left behind are ignored anyway
+func (g *Guard) expire(ctx context.Context, now time.Time) {
+	g.mu.Lock()
+	if now.Sub(g.expired) < ExpireEvery {
+		g.mu.Unlock()
+		return
+	}
+	g.expired = now
+	g.mu.Unlock()
+
+	n, err := g.store.Expire(ctx, g.policy.forgotten(now))
+	if err != nil {
+		fmt.Printf("lockout expire: %v\n", err)
+		return
+	}
+	if n > 0 {
+		fmt.Printf("metric lockout_expired count=%d\n", n)
+	}
+}
+
+// Succeed clears the failures of a key that got in, lockouts already served are
+// forgotten too so the next lockout starts at Base again
+func (g *Guard) Succeed(ctx context.Context, s Status, key string) error {
+	if !s.tracked[key] {
+		return nil
+	}
+
+	return g.Clear(ctx, key)
+}
+
+// Clear removes everything counted against a key, used by operators
+func (g *Guard) Clear(ctx context.Context, key string) error {
+	if err := g.store.Delete(ctx, key); err != nil {
+		return fmt.Errorf("lockout clear: %w", err)
+	}
+	fmt.Printf("audit lockout cleared key=%s\n", key)
+
+	return nil
+}
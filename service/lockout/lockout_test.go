@@ -0,0 +1,148 @@
+package lockout_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/lockout"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	apiKey = "94365b00-c6df-483f-804e-363312750500"
+	ip     = "203.0.113.7"
+)
+
+func TestParsePolicy(t *testing.T) {
+	p, err := lockout.ParsePolicy(`{}`)
+	assert.NoError(t, err)
+	assert.Equal(t, lockout.DefaultPolicy(), p)
+
+	p, err = lockout.ParsePolicy(`{"threshold": 3, "ipThreshold": 0, "base": "30s", "window": "1h"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, lockout.Policy{
+		Threshold:   3,
+		IPThreshold: 0,
+		Base:        30 * time.Second,
+		Max:         24 * time.Hour,
+		Window:      time.Hour,
+	}, p)
+
+	_, err = lockout.ParsePolicy(`{"base": "soon"}`)
+	assert.Error(t, err)
+
+	_, err = lockout.ParsePolicy(`{"base": "2h", "max": "1h"}`)
+	assert.Error(t, err)
+}
+
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	g := lockout.NewGuard(lockout.NewMemory(), lockout.Policy{
+		Threshold:   3,
+		IPThreshold: 5,
+		Base:        time.Minute,
+		Max:         3 * time.Minute,
+		Window:      10 * time.Minute,
+	})
+	g.Now = func() time.Time {
+		return now
+	}
+	keys := []string{lockout.KeyFor(apiKey), lockout.IPFor(ip)}
+
+	check := func() lockout.Status {
+		s, err := g.Check(ctx, keys...)
+		assert.NoError(t, err)
+		return s
+	}
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			assert.NoError(t, g.Fail(ctx, keys...))
+		}
+	}
+
+	fail(2)
+	assert.False(t, check().Locked())
+
+	// the third failure locks the key for the base time
+	fail(1)
+	s := check()
+	assert.True(t, s.Locked())
+	assert.Equal(t, lockout.KeyFor(apiKey), s.Key)
+	assert.Equal(t, lockout.CodeKeyLocked, s.Code)
+	assert.Equal(t, now.Add(time.Minute), s.Until)
+
+	// and it unlocks by itself after the cool down
+	now = now.Add(time.Minute)
+	assert.False(t, check().Locked())
+
+	// the ip has had 5 failures by now
+	fail(2)
+	s = check()
+	assert.Equal(t, lockout.IPFor(ip), s.Key)
+	assert.Equal(t, lockout.CodeIPLocked, s.Code)
+
+	// each lockout of the key doubles, up to the max
+	now = now.Add(11 * time.Minute)
+	fail(3)
+	assert.Equal(t, now.Add(2*time.Minute), check().Until)
+	now = now.Add(11 * time.Minute)
+	fail(3)
+	assert.Equal(t, now.Add(3*time.Minute), check().Until)
+
+	// and starts at the base again once the key's been quiet for the window and the max
+	now = now.Add(14 * time.Minute)
+	fail(3)
+	assert.Equal(t, now.Add(time.Minute), check().Until)
+
+	// failures outside the window are forgotten
+	now = now.Add(time.Hour)
+	fail(2)
+	now = now.Add(11 * time.Minute)
+	fail(2)
+	assert.False(t, check().Locked())
+
+	// getting in clears the key but not the ip
+	assert.NoError(t, g.Succeed(ctx, check(), lockout.KeyFor(apiKey)))
+	now = now.Add(time.Hour)
+	fail(3)
+	assert.Equal(t, now.Add(time.Minute), check().Until)
+}
+
+func TestGuardIPOff(t *testing.T) {
+	ctx := context.Background()
+	m := lockout.NewMemory()
+	g := lockout.NewGuard(m, lockout.Policy{Threshold: 1, Base: time.Minute, Max: time.Minute, Window: time.Minute})
+
+	assert.NoError(t, g.Fail(ctx, lockout.AgentFor("ad4b99e1-dec8-4682-862a-6b017e7c7c70"), lockout.IPFor(ip)))
+	assert.Len(t, m.Entries, 1)
+
+	s, err := g.Check(ctx, lockout.AgentFor("ad4b99e1-dec8-4682-862a-6b017e7c7c70"))
+	assert.NoError(t, err)
+	assert.Equal(t, lockout.CodeAgentLocked, s.Code)
+
+	assert.NoError(t, g.Clear(ctx, lockout.AgentFor("ad4b99e1-dec8-4682-862a-6b017e7c7c70")))
+	assert.Empty(t, m.Entries)
+}
+
+func TestGuardExpire(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	m := lockout.NewMemory()
+	g := lockout.NewGuard(m, lockout.Policy{Threshold: 2, IPThreshold: 2, Base: time.Minute, Max: 5 * time.Minute, Window: 10 * time.Minute})
+	g.Now = func() time.Time {
+		return now
+	}
+
+	assert.NoError(t, g.Fail(ctx, lockout.IPFor(ip)))
+	now = now.Add(10 * time.Minute)
+	assert.NoError(t, g.Fail(ctx, lockout.KeyFor(apiKey)))
+	assert.Len(t, m.Entries, 2)
+
+	// the ip has been quiet for the window and the max, the key hasn't
+	now = now.Add(10 * time.Minute)
+	assert.NoError(t, g.Fail(ctx, lockout.KeyFor(apiKey)))
+	assert.Len(t, m.Entries, 1)
+	assert.Contains(t, m.Entries, lockout.KeyFor(apiKey))
+}
@@ -0,0 +1,120 @@
+package lockout_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/lockout"
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostgres(t *testing.T) {
+	if os.Getenv("GITHUB_ACTOR") == "" {
+		err := godotenv.Load("../../.env")
+		if err != nil {
+			t.Errorf("godotenv err: %v", err)
+		}
+	}
+	details := store.ConnectDetails{
+		Host:     os.Getenv("DB_HOSTNAME"),
+		Port:     os.Getenv("DB_PORT"),
+		Username: os.Getenv("DB_USERNAME"),
+		Password: os.Getenv("DB_PASSWORD"),
+		Database: os.Getenv("DB_DATABASE"),
+	}
+
+	db, err := sql.Open("postgres", details.DSN())
+	if err != nil {
+		t.Fatalf("db.open: %v", err)
+	}
+	defer func() {
+		err := db.Close()
+		if err != nil {
+			fmt.Printf("db.close: %v", err)
+		}
+	}()
+
+	ctx := context.Background()
+	p := lockout.NewPostgres(db)
+	key := lockout.KeyFor(apiKey)
+	defer func() {
+		if err := p.Delete(ctx, key); err != nil {
+			t.Errorf("delete err: %v", err)
+		}
+	}()
+
+	entries, err := p.Get(ctx, key)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// failures from every container at once are all counted
+	pol := lockout.Policy{Threshold: 50, Base: time.Minute, Max: 3 * time.Minute, Window: 10 * time.Minute}
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.Fail(ctx, key, now, pol.Threshold, pol)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	entries, err = p.Get(ctx, key, lockout.IPFor(ip))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, 20, entries[key].Failures)
+	assert.True(t, now.Equal(entries[key].LastFailure))
+
+	// the failure at the threshold locks in the same statement, and each lockout doubles
+	e, err := p.Fail(ctx, key, now, 21, pol)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, e.Failures)
+	assert.Equal(t, 1, e.Lockouts)
+	assert.True(t, now.Add(time.Minute).Equal(e.LockedUntil))
+	now = now.Add(11 * time.Minute)
+	e, err = p.Fail(ctx, key, now, 1, pol)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, e.Lockouts)
+	assert.True(t, now.Add(2*time.Minute).Equal(e.LockedUntil))
+
+	// failures outside the window are forgotten, and lockouts after the window and the max
+	now = now.Add(11 * time.Minute)
+	e, err = p.Fail(ctx, key, now, 3, pol)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, e.Failures)
+	assert.Equal(t, 2, e.Lockouts)
+	now = now.Add(14 * time.Minute)
+	e, err = p.Fail(ctx, key, now, 1, pol)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, e.Lockouts)
+	assert.True(t, now.Add(time.Minute).Equal(e.LockedUntil))
+
+	// a first failure can lock too
+	first := lockout.IPFor(ip)
+	defer func() {
+		if err := p.Delete(ctx, first); err != nil {
+			t.Errorf("delete err: %v", err)
+		}
+	}()
+	e, err = p.Fail(ctx, first, now, 1, pol)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, e.Lockouts)
+	assert.True(t, now.Add(time.Minute).Equal(e.LockedUntil))
+
+	// quiet entries are expired
+	n, err := p.Expire(ctx, now.Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, n, int64(2))
+	entries, err = p.Get(ctx, key, first)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
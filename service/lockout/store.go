@@ -0,0 +1,178 @@
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Postgres keeps the entries in the lockout table so every container sees them
+type Postgres struct {
+	db *sql.DB
+}
+
+// NewPostgres uses an open pool, normally the one the store has
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{
+		db: db,
+	}
+}
+
+// Get reads the entries there are for the keys
+func (p *Postgres) Get(ctx context.Context, keys ...string) (map[string]Entry, error) {
+	rows, err := p.db.QueryContext(ctx, `
+SELECT key, failures, lockouts, last_failure, locked_until
+FROM lockout
+WHERE key = ANY($1)`, pq.Array(keys))
+	if err != nil {
+		return nil, fmt.Errorf("lockout postgres get: %w", err)
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			fmt.Printf("lockout postgres rows.close: %v\n", err)
+		}
+	}()
+
+	entries := map[string]Entry{}
+	for rows.Next() {
+		var key string
+		e := Entry{}
+		if err := rows.Scan(&key, &e.Failures, &e.Lockouts, &e.LastFailure, &e.LockedUntil); err != nil {
+			return nil, fmt.Errorf("lockout postgres scan: %w", err)
+		}
+		entries[key] = e
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("lockout postgres rows: %w", err)
+	}
+
+	return entries, nil
+}
+
+// counted is the failures with this one, $2 being now and $4 the window in seconds, and
+// kept the lockouts there have been, forgotten with $6 the max lockout in seconds
+const (
+	counted = `(CASE WHEN l.last_failure < $2::timestamptz - $4::float8 * interval '1 second' THEN 0 ELSE l.failures END) + 1`
+	kept    = `(CASE WHEN l.last_failure < $2::timestamptz - ($4::float8 + $6::float8) * interval '1 second' THEN 0 ELSE l.lockouts END)`
+)
+
+// failQuery is Policy.fail as one upsert, $3 is the threshold and $5 the base lockout
+// in seconds. Concurrent failures wait on the row so none are lost
+const failQuery = `
+INSERT INTO lockout AS l (key, failures, lockouts, last_failure, locked_until)
+VALUES ($1,
+  CASE WHEN $3::int <= 1 THEN 0 ELSE 1 END,
+  CASE WHEN $3::int <= 1 THEN 1 ELSE 0 END,
+  $2::timestamptz,
+  CASE WHEN $3::int <= 1 THEN $2::timestamptz + LEAST($5::float8, $6::float8) * interval '1 second' ELSE $2::timestamptz END)
+ON CONFLICT (key) DO UPDATE SET
+  failures = CASE WHEN ` + counted + ` >= $3::int THEN 0 ELSE ` + counted + ` END,
+  lockouts = CASE WHEN ` + counted + ` >= $3::int THEN ` + kept + ` + 1 ELSE ` + kept + ` END,
+  locked_until = CASE WHEN ` + counted + ` >= $3::int
+    THEN $2::timestamptz + LEAST($6::float8, $5::float8 * power(2, ` + kept + `)) * interval '1 second'
+    ELSE l.locked_until END,
+  last_failure = $2::timestamptz
+RETURNING failures, lockouts, last_failure, locked_until`
+
+// Fail counts a failure against the key in the one statement
+func (p *Postgres) Fail(ctx context.Context, key string, now time.Time, threshold int, pol Policy) (Entry, error) {
+	e := Entry{}
+	err := p.db.QueryRowContext(ctx, failQuery,
+		key, now.UTC(), threshold, pol.Window.Seconds(), pol.Base.Seconds(), pol.Max.Seconds(),
+	).Scan(&e.Failures, &e.Lockouts, &e.LastFailure, &e.LockedUntil)
+	if err != nil {
+		return Entry{}, fmt.Errorf("lockout postgres fail: %w", err)
+	}
+
+	return e, nil
+}
+
+// Delete removes the entry for a key
+func (p *Postgres) Delete(ctx context.Context, key string) error {
+	_, err := p.db.ExecContext(ctx, "DELETE FROM lockout WHERE key = $1", key)
+	if err != nil {
+		return fmt.Errorf("lockout postgres delete: %w", err)
+	}
+
+	return nil
+}
+
+// Expire removes the entries last failed before the time, whose lockouts are over by then too
+func (p *Postgres) Expire(ctx context.Context, before time.Time) (int64, error) {
+	res, err := p.db.ExecContext(ctx, "DELETE FROM lockout WHERE last_failure < $1 AND locked_until < $1", before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("lockout postgres expire: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("lockout postgres expire: %w", err)
+	}
+	return n, nil
+}
+
+// Memory keeps the entries for a single container, for tests and the fixture store
+type Memory struct {
+	sync.Mutex
+	Entries map[string]Entry
+}
+
+// NewMemory makes an empty in memory store
+func NewMemory() *Memory {
+	return &Memory{
+		Entries: map[string]Entry{},
+	}
+}
+
+// Get reads the entries there are for the keys
+func (m *Memory) Get(ctx context.Context, keys ...string) (map[string]Entry, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	entries := map[string]Entry{}
+	for _, k := range keys {
+		if e, ok := m.Entries[k]; ok {
+			entries[k] = e
+		}
+	}
+	return entries, nil
+}
+
+// Fail counts a failure against the key
+func (m *Memory) Fail(ctx context.Context, key string, now time.Time, threshold int, p Policy) (Entry, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	e := p.fail(m.Entries[key], now, threshold)
+	m.Entries[key] = e
+	return e, nil
+}
+
+// Delete removes the entry for a key
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.Entries, key)
+	return nil
+}
+
+// Expire removes the entries last failed before the time, whose lockouts are over by then too
+func (m *Memory) Expire(ctx context.Context, before time.Time) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var n int64
+	for k, e := range m.Entries {
+		if e.LastFailure.Before(before) && e.LockedUntil.Before(before) {
+			delete(m.Entries, k)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,71 @@
+package nonce
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Header is where clients put the nonce, one per request
+const Header = "x-request-nonce"
+
+// MaxLength is the longest nonce kept, a uuid fits several times over
+const MaxLength = 128
+
+// maxNonces is when expired nonces get dropped
+const maxNonces = 100000
+
+// Store remembers the nonces used within the ttl
+type Store interface {
+	// Use records the nonce for the agent, false means it was already used
+	Use(ctx context.Context, agentID, nonce string, ttl time.Duration) (bool, error)
+}
+
+// Key is the agent and nonce together, agents can't use up each other's nonces
+func Key(agentID, nonce string) string {
+	return agentID + ":" + nonce
+}
+
+// Memory is a Store for a single container, a request replayed to another warm
+// lambda isn't caught
+type Memory struct {
+	sync.Mutex
+	expires map[string]time.Time
+
+	// Now is the clock, replaced in tests
+	Now func() time.Time
+}
+
+// NewMemory makes an empty in memory store
+func NewMemory() *Memory {
+	return &Memory{
+		expires: map[string]time.Time{},
+		Now:     time.Now,
+	}
+}
+
+// Use records the nonce for the agent
+func (m *Memory) Use(ctx context.Context, agentID, nonce string, ttl time.Duration) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.Now()
+	key := Key(agentID, nonce)
+	if expires, ok := m.expires[key]; ok && now.Before(expires) {
+		return false, nil
+	}
+	if len(m.expires) >= maxNonces {
+		m.prune(now)
+	}
+	m.expires[key] = now.Add(ttl)
+
+	return true, nil
+}
+
+func (m *Memory) prune(now time.Time) {
+	for k, expires := range m.expires {
+		if !now.Before(expires) {
+			delete(m.expires, k)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package nonce_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/nonce"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	m := nonce.NewMemory()
+	m.Now = func() time.Time {
+		return now
+	}
+
+	use := func(agentID, n string) bool {
+		ok, err := m.Use(ctx, agentID, n, time.Minute)
+		assert.NoError(t, err)
+		return ok
+	}
+
+	assert.True(t, use("ad4b99e1-dec8-4682-862a-6b017e7c7c70", "6b0e1c2a"))
+	assert.False(t, use("ad4b99e1-dec8-4682-862a-6b017e7c7c70", "6b0e1c2a"))
+	assert.True(t, use("ad4b99e1-dec8-4682-862a-6b017e7c7c71", "6b0e1c2a"), "another agent's nonce")
+
+	now = now.Add(time.Minute)
+	assert.True(t, use("ad4b99e1-dec8-4682-862a-6b017e7c7c70", "6b0e1c2a"), "after the ttl")
+}
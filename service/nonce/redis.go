@@ -0,0 +1,32 @@
+package nonce
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis is a Store shared by every container, each nonce is a key under nonce: that
+// expires with the ttl
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis uses the client the other shared parts have
+func NewRedis(c *redis.Client) *Redis {
+	return &Redis{
+		client: c,
+	}
+}
+
+// Use records the nonce for the agent, only the first container to set it gets true
+func (r *Redis) Use(ctx context.Context, agentID, nonce string, ttl time.Duration) (bool, error) {
+	set, err := r.client.SetNX(ctx, "nonce:"+Key(agentID, nonce), 1, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("nonce redis: %w", err)
+	}
+
+	return set, nil
+}
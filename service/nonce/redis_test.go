@@ -0,0 +1,38 @@
+package nonce_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bugfixes/authorizer/service/nonce"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedis(t *testing.T) {
+	ctx := context.Background()
+	m := miniredis.RunT(t)
+	c := redis.NewClient(&redis.Options{Addr: m.Addr()})
+
+	// two containers sharing the one redis
+	first, second := nonce.NewRedis(c), nonce.NewRedis(c)
+	use := func(r *nonce.Redis, agentID, n string) bool {
+		ok, err := r.Use(ctx, agentID, n, time.Minute)
+		assert.NoError(t, err)
+		return ok
+	}
+
+	assert.True(t, use(first, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "6b0e1c2a"))
+	assert.False(t, use(second, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "6b0e1c2a"))
+	assert.True(t, use(second, "ad4b99e1-dec8-4682-862a-6b017e7c7c71", "6b0e1c2a"), "another agent's nonce")
+
+	assert.True(t, m.Exists("nonce:ad4b99e1-dec8-4682-862a-6b017e7c7c70:6b0e1c2a"))
+	m.FastForward(time.Minute)
+	assert.True(t, use(first, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "6b0e1c2a"), "after the ttl")
+
+	m.Close()
+	_, err := first.Use(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "9c4d2f1e", time.Minute)
+	assert.Error(t, err)
+}
@@ -0,0 +1,176 @@
+package opa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// DefaultPath is the rule the bundled policies/authorizer.rego exposes
+const DefaultPath = "bugfixes/authz/decision"
+
+// DefaultTimeout caps one evaluation
+const DefaultTimeout = 500 * time.Millisecond
+
+// Engine evaluates a rego policy in the authorizer, it's compiled once when it's
+// loaded so a decision is only the evaluation
+type Engine struct {
+	Path    string
+	Timeout time.Duration
+
+	query rego.PreparedEvalQuery
+}
+
+// New compiles the policy, name is where it came from for errors and path is the rule to evaluate
+func New(ctx context.Context, name, src, path string, timeout time.Duration) (*Engine, error) {
+	if path == "" {
+		path = DefaultPath
+	}
+	path = strings.Trim(path, "/")
+
+	query, err := rego.New(
+		rego.Query("data."+strings.ReplaceAll(path, "/", ".")),
+		rego.Module(name, src),
+	).PrepareForEval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("opa compile %s: %w", name, err)
+	}
+
+	return &Engine{
+		Path:    path,
+		Timeout: timeout,
+		query:   query,
+	}, nil
+}
+
+// Load compiles the rego file, one shipped in the deployment package
+func Load(ctx context.Context, file, path string, timeout time.Duration) (*Engine, error) {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("opa read: %w", err)
+	}
+
+	return New(ctx, file, string(src), path, timeout)
+}
+
+// Principal is the resolved identity
+type Principal struct {
+	AgentID   string   `json:"agentId"`
+	CompanyID string   `json:"companyId"`
+	Roles     []string `json:"roles"`
+	Scopes    []string `json:"scopes"`
+
+	Plan          string `json:"plan"`
+	CompanyStatus string `json:"companyStatus"`
+}
+
+// Request is the part of the API Gateway event a policy can look at
+type Request struct {
+	MethodArn   string            `json:"methodArn"`
+	Verb        string            `json:"verb"`
+	Resource    string            `json:"resource"`
+	Stage       string            `json:"stage"`
+	Path        string            `json:"path"`
+	SourceIP    string            `json:"sourceIp"`
+	Headers     map[string]string `json:"headers"`
+	QueryString map[string]string `json:"queryStringParameters"`
+}
+
+// Input is the input document
+type Input struct {
+	Principal Principal `json:"principal"`
+	Request   Request   `json:"request"`
+	Routes    []string  `json:"routes"`
+	Entitled  bool      `json:"entitled"`
+	Time      string    `json:"time"`
+}
+
+// Result is what the rule has to evaluate to, Routes is optional and lets the
+// policy grant more than the request so API Gateway can cache the decision
+type Result struct {
+	Allow   bool                   `json:"allow"`
+	Reason  string                 `json:"reason"`
+	Routes  []string               `json:"routes"`
+	Context map[string]interface{} `json:"context"`
+}
+
+// Decide evaluates the rule with the input document
+func (e *Engine) Decide(ctx context.Context, in Input) (Result, error) {
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+
+	rs, err := e.query.Eval(ctx, rego.EvalInput(in))
+	if err != nil {
+		return Result{}, fmt.Errorf("opa eval: %w", err)
+	}
+	if len(rs) == 0 || len(rs[0].Expressions) == 0 {
+		return Result{}, fmt.Errorf("opa result: %s is undefined", e.Path)
+	}
+
+	// through json so numbers come out as they would from the data api
+	b, err := json.Marshal(rs[0].Expressions[0].Value)
+	if err != nil {
+		return Result{}, fmt.Errorf("opa result marshal: %w", err)
+	}
+	out := Result{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return Result{}, fmt.Errorf("opa result: %w", err)
+	}
+
+	return out, nil
+}
+
+// Apply turns the result into statements and context on the builder
+func (r Result) Apply(b *policy.Builder, arn policy.ARN) error {
+	for k, v := range r.Context {
+		switch v.(type) {
+		case string, float64, bool:
+			b.WithContext(k, v)
+		default:
+			return fmt.Errorf("opa context %s: only strings, numbers and booleans can be passed on", k)
+		}
+	}
+	if r.Reason != "" {
+		b.WithContext("reason", r.Reason)
+	}
+
+	if !r.Allow {
+		return nil
+	}
+
+	if len(r.Routes) == 0 {
+		b.AllowResource(arn.String())
+		return nil
+	}
+
+	routes, err := policy.ParseRoutes(strings.Join(r.Routes, ","))
+	if err != nil {
+		return fmt.Errorf("opa routes: %w", err)
+	}
+	b.Allow(routes...)
+
+	return nil
+}
+
+// SafeHeaders drops credentials so a policy can't log or return them, an agent id
+// is a credential on its own
+func SafeHeaders(headers map[string]string) map[string]string {
+	safe := map[string]string{}
+	for k, v := range headers {
+		switch strings.ToLower(k) {
+		case "x-api-secret", "x-agent-id", "authorization":
+			continue
+		}
+		safe[k] = v
+	}
+	return safe
+}
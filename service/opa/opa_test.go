@@ -0,0 +1,216 @@
+package opa_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bugfixes/authorizer/policies"
+	"github.com/bugfixes/authorizer/service/opa"
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+func testInput(sourceIP string, entitled bool) opa.Input {
+	return opa.Input{
+		Principal: opa.Principal{
+			AgentID:   "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+			CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+			Roles:     []string{"ingest"},
+		},
+		Request: opa.Request{
+			MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			Verb:      "POST",
+			Resource:  "bug",
+			Stage:     "live",
+			SourceIP:  sourceIP,
+		},
+		Routes:   []string{"POST /bug"},
+		Entitled: entitled,
+		Time:     "2021-03-16T10:00:00Z",
+	}
+}
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		input  opa.Input
+		expect opa.Result
+		err    bool
+	}{
+		{
+			name:  "entitled",
+			input: testInput("192.0.2.1", true),
+			expect: opa.Result{
+				Allow:   true,
+				Context: map[string]interface{}{"policy": "rego"},
+			},
+		},
+		{
+			name:  "blocked network",
+			input: testInput("203.0.113.9", true),
+			expect: opa.Result{
+				Allow:  false,
+				Reason: "blocked network",
+			},
+		},
+		{
+			name:  "not entitled",
+			input: testInput("192.0.2.1", false),
+			expect: opa.Result{
+				Allow:  false,
+				Reason: "not entitled",
+			},
+		},
+		{
+			name:  "undefined rule",
+			path:  "bugfixes/missing",
+			input: testInput("192.0.2.1", true),
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := opa.New(context.Background(), "authorizer.rego", policies.Authorizer, test.path, time.Second)
+			assert.NoError(t, err)
+			resp, err := e.Decide(context.Background(), test.input)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expect, resp)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+
+	// the file shipped in the deployment package is the one built in
+	e, err := opa.Load(ctx, "../../policies/authorizer.rego", "", time.Second)
+	assert.NoError(t, err)
+	resp, err := e.Decide(ctx, testInput("192.0.2.1", true))
+	assert.NoError(t, err)
+	assert.True(t, resp.Allow)
+
+	_, err = opa.Load(ctx, "../../policies/missing.rego", "", time.Second)
+	assert.Error(t, err)
+
+	_, err = opa.New(ctx, "broken.rego", "package bugfixes.authz\n\ndecision := {", "", time.Second)
+	assert.Error(t, err)
+}
+
+func TestApply(t *testing.T) {
+	arn, err := policy.ParseARN("arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		result opa.Result
+		expect events.APIGatewayCustomAuthorizerResponse
+		err    bool
+	}{
+		{
+			name: "allow request",
+			result: opa.Result{
+				Allow:   true,
+				Context: map[string]interface{}{"policy": "rego"},
+			},
+			expect: events.APIGatewayCustomAuthorizerResponse{
+				PrincipalID: "tester",
+				PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+					Version: "2012-10-17",
+					Statement: []events.IAMPolicyStatement{
+						{
+							Action:   []string{"execute-api:Invoke"},
+							Effect:   "Allow",
+							Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug"},
+						},
+					},
+				},
+				Context: map[string]interface{}{"policy": "rego"},
+			},
+		},
+		{
+			name: "allow routes",
+			result: opa.Result{
+				Allow:  true,
+				Routes: []string{"POST /bug", "POST /log"},
+			},
+			expect: events.APIGatewayCustomAuthorizerResponse{
+				PrincipalID: "tester",
+				PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+					Version: "2012-10-17",
+					Statement: []events.IAMPolicyStatement{
+						{
+							Action: []string{"execute-api:Invoke"},
+							Effect: "Allow",
+							Resource: []string{
+								"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+								"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/log",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "deny with reason",
+			result: opa.Result{
+				Reason: "blocked network",
+			},
+			expect: events.APIGatewayCustomAuthorizerResponse{
+				PrincipalID: "tester",
+				PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+					Version: "2012-10-17",
+					Statement: []events.IAMPolicyStatement{
+						{
+							Action:   []string{"execute-api:Invoke"},
+							Effect:   "Deny",
+							Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug"},
+						},
+					},
+				},
+				Context: map[string]interface{}{"reason": "blocked network"},
+			},
+		},
+		{
+			name: "nested context",
+			result: opa.Result{
+				Allow:   true,
+				Context: map[string]interface{}{"nested": map[string]interface{}{"a": 1}},
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := policy.NewBuilder("tester", arn)
+			err := test.result.Apply(b, arn)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expect, b.Build())
+		})
+	}
+}
+
+func TestSafeHeaders(t *testing.T) {
+	assert.Equal(t, map[string]string{
+		"x-api-key":  "94365b00-c6df-483f-804e-363312750500",
+		"User-Agent": "bugfixes-go",
+	}, opa.SafeHeaders(map[string]string{
+		"x-api-key":     "94365b00-c6df-483f-804e-363312750500",
+		"X-Agent-Id":    "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+		"X-Api-Secret":  "f7356946-5814-4b5e-ad45-0348a89576ef",
+		"Authorization": "Bearer f7356946",
+		"User-Agent":    "bugfixes-go",
+	}))
+}
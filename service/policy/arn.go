@@ -0,0 +1,258 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Wildcard matches any value in an ARN component or route
+const Wildcard = "*"
+
+// ARN is an execute-api method ARN split into its components
+// arn:{partition}:execute-api:{region}:{account}:{apiId}/{stage}/{verb}/{resource}
+type ARN struct {
+	Partition string
+	Region    string
+	AccountID string
+	APIID     string
+	Stage     string
+	Verb      string
+	Resource  string
+}
+
+// ParseARN splits a MethodArn into its components
+func ParseARN(methodArn string) (ARN, error) {
+	parts := strings.SplitN(methodArn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "execute-api" {
+		return ARN{}, fmt.Errorf("parse arn: not an execute-api arn: %s", methodArn)
+	}
+
+	path := strings.SplitN(parts[5], "/", 4)
+	if len(path) < 3 {
+		return ARN{}, fmt.Errorf("parse arn: missing api, stage or verb: %s", methodArn)
+	}
+
+	a := ARN{
+		Partition: parts[1],
+		Region:    parts[3],
+		AccountID: parts[4],
+		APIID:     path[0],
+		Stage:     path[1],
+		Verb:      path[2],
+	}
+	if len(path) == 4 {
+		a.Resource = path[3]
+	}
+
+	return a, nil
+}
+
+// String builds the ARN back into the form API Gateway expects
+func (a ARN) String() string {
+	return fmt.Sprintf(
+		"arn:%s:execute-api:%s:%s:%s/%s/%s/%s",
+		a.Partition,
+		a.Region,
+		a.AccountID,
+		a.APIID,
+		a.Stage,
+		a.Verb,
+		a.Resource)
+}
+
+// Route returns a copy of the ARN pointing at the given verb and resource
+func (a ARN) Route(r Route) ARN {
+	a.Verb = r.Verb
+	a.Resource = r.Resource
+	return a
+}
+
+// Route is an HTTP verb and resource path, either of which can contain wildcards
+type Route struct {
+	Verb     string
+	Resource string
+}
+
+// NewRoute normalizes the verb and resource, "/bug" and "bug" are the same resource
+func NewRoute(verb, resource string) Route {
+	if verb == "" {
+		verb = Wildcard
+	}
+
+	return Route{
+		Verb:     strings.ToUpper(verb),
+		Resource: strings.TrimPrefix(resource, "/"),
+	}
+}
+
+// ParseRoute reads a route written as "POST /bug" or "* /admin/*"
+func ParseRoute(s string) (Route, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return Route{}, fmt.Errorf("parse route: expected \"VERB /path\", got: %q", s)
+	}
+
+	return NewRoute(fields[0], fields[1]), nil
+}
+
+// ParseRoutes reads a comma separated list of routes
+func ParseRoutes(s string) ([]Route, error) {
+	var routes []Route
+	for _, r := range strings.Split(s, ",") {
+		if strings.TrimSpace(r) == "" {
+			continue
+		}
+
+		route, err := ParseRoute(r)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+// String writes the route the same way ParseRoute reads it
+func (r Route) String() string {
+	return r.Verb + " /" + r.Resource
+}
+
+// Matches reports whether the verb and resource fall under this route,
+// "*" matches any run of characters and "?" matches a single one, the same as IAM
+func (r Route) Matches(verb, resource string) bool {
+	return match(r.Verb, strings.ToUpper(verb)) && match(r.Resource, strings.TrimPrefix(resource, "/"))
+}
+
+// Covers reports whether this route matches every request o matches, it's
+// stricter than Matches as wildcards in o can only be covered by wildcards in r
+func (r Route) Covers(o Route) bool {
+	return covers(r.Verb, o.Verb) && covers(r.Resource, o.Resource)
+}
+
+// Intersect returns routes that are in both lists, a route is kept when the
+// other list has a route covering it so the result never grants more than either
+func Intersect(a, b []Route) []Route {
+	var routes []Route
+	keep := func(r Route, other []Route) {
+		for _, o := range other {
+			if o.Covers(r) {
+				for _, existing := range routes {
+					if existing == r {
+						return
+					}
+				}
+				routes = append(routes, r)
+				return
+			}
+		}
+	}
+
+	for _, r := range a {
+		keep(r, b)
+	}
+	for _, r := range b {
+		keep(r, a)
+	}
+
+	return routes
+}
+
+// ReadVerbs are the verbs that don't change anything
+var ReadVerbs = []string{"GET", "HEAD", "OPTIONS"}
+
+// ReadOnly narrows routes to their read verbs, "* /bug" becomes "GET /bug",
+// "HEAD /bug" and "OPTIONS /bug" and "POST /bug" is dropped
+func ReadOnly(routes []Route) []Route {
+	var read []Route
+	for _, r := range routes {
+		for _, verb := range ReadVerbs {
+			if !match(r.Verb, verb) {
+				continue
+			}
+			route := Route{Verb: verb, Resource: r.Resource}
+			duplicate := false
+			for _, existing := range read {
+				if existing == route {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				read = append(read, route)
+			}
+		}
+	}
+
+	return read
+}
+
+// IsRead is true for verbs in ReadVerbs
+func IsRead(verb string) bool {
+	for _, v := range ReadVerbs {
+		if strings.EqualFold(v, verb) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers is match where s is itself a pattern, a "*" in s needs a "*" in pattern
+// and a "?" in s needs a "?" or "*"
+func covers(pattern, s string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+
+	if pattern[0] == '*' {
+		for i := 0; i <= len(s); i++ {
+			if covers(pattern[1:], s[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if s == "" || s[0] == '*' {
+		return false
+	}
+	if pattern[0] == '?' || pattern[0] == s[0] {
+		return covers(pattern[1:], s[1:])
+	}
+
+	return false
+}
+
+// Glob matches s against a pattern using the same wildcards as routes
+func Glob(pattern, s string) bool {
+	return match(pattern, s)
+}
+
+// match is a glob match, a "*" in the pattern is checked before a literal so it
+// still backtracks when s has a "*" of its own, as stage wide resources do
+func match(pattern, s string) bool {
+	star, backtrack := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, backtrack = p, i
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case star != -1:
+			p = star + 1
+			backtrack++
+			i = backtrack
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
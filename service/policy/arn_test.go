@@ -0,0 +1,227 @@
+package policy_test
+
+import (
+	"testing"
+
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseARN(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		expect  policy.ARN
+		err     bool
+	}{
+		{
+			name:    "root resource",
+			request: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/ESTestInvoke-stage/GET/",
+			expect: policy.ARN{
+				Partition: "aws",
+				Region:    "eu-west-2",
+				AccountID: "123456789",
+				APIID:     "wmcwzleu0i",
+				Stage:     "ESTestInvoke-stage",
+				Verb:      "GET",
+				Resource:  "",
+			},
+		},
+		{
+			name:    "nested resource",
+			request: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug/1234/comment",
+			expect: policy.ARN{
+				Partition: "aws",
+				Region:    "eu-west-2",
+				AccountID: "123456789",
+				APIID:     "wmcwzleu0i",
+				Stage:     "live",
+				Verb:      "POST",
+				Resource:  "bug/1234/comment",
+			},
+		},
+		{
+			name:    "not execute-api",
+			request: "arn:aws:lambda:eu-west-2:123456789:function:authorizer",
+			err:     true,
+		},
+		{
+			name:    "missing verb",
+			request: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live",
+			err:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := policy.ParseARN(test.request)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expect, resp)
+			assert.Equal(t, test.request, resp.String())
+		})
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		route    string
+		verb     string
+		resource string
+		expect   bool
+	}{
+		{
+			name:     "exact",
+			route:    "POST /bug",
+			verb:     "POST",
+			resource: "bug",
+			expect:   true,
+		},
+		{
+			name:     "wrong verb",
+			route:    "POST /bug",
+			verb:     "GET",
+			resource: "bug",
+			expect:   false,
+		},
+		{
+			name:     "wildcard verb",
+			route:    "* /bug",
+			verb:     "DELETE",
+			resource: "/bug",
+			expect:   true,
+		},
+		{
+			name:     "wildcard resource",
+			route:    "GET /admin/*",
+			verb:     "get",
+			resource: "admin/company/1234",
+			expect:   true,
+		},
+		{
+			name:     "wildcard does not match parent",
+			route:    "GET /admin/*",
+			verb:     "GET",
+			resource: "admin",
+			expect:   false,
+		},
+		{
+			name:     "single character",
+			route:    "GET /v?/bug",
+			verb:     "GET",
+			resource: "v2/bug",
+			expect:   true,
+		},
+		{
+			name:     "wildcard over a literal star",
+			route:    "GET /bug/*",
+			verb:     "GET",
+			resource: "bug/*/comment",
+			expect:   true,
+		},
+		{
+			name:     "catch all over a leading star",
+			route:    "* *",
+			verb:     "*",
+			resource: "*/comment",
+			expect:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route, err := policy.ParseRoute(test.route)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expect, route.Matches(test.verb, test.resource))
+		})
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := policy.ParseRoutes("POST /bug, post /log,,GET /admin/*")
+	assert.NoError(t, err)
+	assert.Equal(t, []policy.Route{
+		{Verb: "POST", Resource: "bug"},
+		{Verb: "POST", Resource: "log"},
+		{Verb: "GET", Resource: "admin/*"},
+	}, routes)
+
+	_, err = policy.ParseRoutes("POST")
+	assert.Error(t, err)
+}
+
+func TestIntersect(t *testing.T) {
+	tests := []struct {
+		name   string
+		a      string
+		b      string
+		expect []policy.Route
+	}{
+		{
+			name: "scope narrower than role",
+			a:    "* /*",
+			b:    "POST /bug",
+			expect: []policy.Route{
+				{Verb: "POST", Resource: "bug"},
+			},
+		},
+		{
+			name: "role narrower than scope",
+			a:    "GET /bug/1234",
+			b:    "GET /bug/*",
+			expect: []policy.Route{
+				{Verb: "GET", Resource: "bug/1234"},
+			},
+		},
+		{
+			name: "nothing in common",
+			a:    "POST /bug,POST /log",
+			b:    "GET /bug/*",
+		},
+		{
+			name: "single character wildcard doesnt cover a run",
+			a:    "GET /bug/?",
+			b:    "GET /bug/*",
+			expect: []policy.Route{
+				{Verb: "GET", Resource: "bug/?"},
+			},
+		},
+		{
+			name: "wildcard isnt covered by a literal",
+			a:    "* /bug",
+			b:    "POST /bug",
+			expect: []policy.Route{
+				{Verb: "POST", Resource: "bug"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := policy.ParseRoutes(test.a)
+			assert.NoError(t, err)
+			b, err := policy.ParseRoutes(test.b)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expect, policy.Intersect(a, b))
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	routes, err := policy.ParseRoutes("POST /bug,GET /bug/*,* /agent,G?T /log,GET /bug/*")
+	assert.NoError(t, err)
+	assert.Equal(t, []policy.Route{
+		{Verb: "GET", Resource: "bug/*"},
+		{Verb: "GET", Resource: "agent"},
+		{Verb: "HEAD", Resource: "agent"},
+		{Verb: "OPTIONS", Resource: "agent"},
+		{Verb: "GET", Resource: "log"},
+	}, policy.ReadOnly(routes))
+
+	assert.True(t, policy.IsRead("get"))
+	assert.False(t, policy.IsRead("POST"))
+}
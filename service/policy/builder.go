@@ -0,0 +1,127 @@
+package policy
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Builder collects Allow and Deny routes against the ARN of a request and
+// turns them into a policy document with one statement per effect
+type Builder struct {
+	principalID string
+	arn         ARN
+	allow       []string
+	deny        []string
+	context     map[string]interface{}
+	usageKey    string
+	limit       int
+}
+
+// NewBuilder starts a policy for the principal, routes are resolved relative to the arn
+func NewBuilder(principalID string, arn ARN) *Builder {
+	return &Builder{
+		principalID: principalID,
+		arn:         arn,
+		limit:       MaxPolicySize,
+	}
+}
+
+// Allow adds routes the principal may invoke
+func (b *Builder) Allow(routes ...Route) *Builder {
+	for _, r := range routes {
+		b.allow = appendUnique(b.allow, b.arn.Route(r).String())
+	}
+	return b
+}
+
+// Deny adds routes the principal may not invoke, these win over any Allow
+func (b *Builder) Deny(routes ...Route) *Builder {
+	for _, r := range routes {
+		b.deny = appendUnique(b.deny, b.arn.Route(r).String())
+	}
+	return b
+}
+
+// AllowResource adds a fully formed resource arn, for when the caller already has one
+func (b *Builder) AllowResource(resource string) *Builder {
+	b.allow = appendUnique(b.allow, resource)
+	return b
+}
+
+// DenyResource adds a fully formed resource arn to the Deny statement
+func (b *Builder) DenyResource(resource string) *Builder {
+	b.deny = appendUnique(b.deny, resource)
+	return b
+}
+
+// WithContext adds a value to the context handed to the backend integration
+func (b *Builder) WithContext(key string, value interface{}) *Builder {
+	if b.context == nil {
+		b.context = map[string]interface{}{}
+	}
+	b.context[key] = value
+	return b
+}
+
+// WithUsageKey sets the API Gateway api key value that usage plans meter the request against
+func (b *Builder) WithUsageKey(key string) *Builder {
+	b.usageKey = key
+	return b
+}
+
+// Build creates the response, a builder with no routes denies the request arn
+func (b *Builder) Build() events.APIGatewayCustomAuthorizerResponse {
+	authResponse := b.build()
+	if b.oversized(authResponse.PolicyDocument) {
+		fmt.Printf("policy over %d bytes, collapsing to %s\n", b.limit, b.arn)
+		b.collapse()
+		authResponse = b.build()
+	}
+
+	return authResponse
+}
+
+func (b *Builder) build() events.APIGatewayCustomAuthorizerResponse {
+	authResponse := events.APIGatewayCustomAuthorizerResponse{
+		PrincipalID: b.principalID,
+		PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+			Version: "2012-10-17",
+		},
+		Context:            b.context,
+		UsageIdentifierKey: b.usageKey,
+	}
+
+	deny := b.deny
+	if len(b.allow) == 0 && len(deny) == 0 {
+		deny = []string{b.arn.String()}
+	}
+
+	if len(b.allow) > 0 {
+		authResponse.PolicyDocument.Statement = append(authResponse.PolicyDocument.Statement, statement("Allow", b.allow))
+	}
+	if len(deny) > 0 {
+		authResponse.PolicyDocument.Statement = append(authResponse.PolicyDocument.Statement, statement("Deny", deny))
+	}
+
+	return authResponse
+}
+
+func statement(effect string, resources []string) events.IAMPolicyStatement {
+	return events.IAMPolicyStatement{
+		Action: []string{
+			"execute-api:Invoke",
+		},
+		Effect:   effect,
+		Resource: resources,
+	}
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, l := range list {
+		if l == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
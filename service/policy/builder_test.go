@@ -0,0 +1,125 @@
+package policy_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuilder(t *testing.T) {
+	arn, err := policy.ParseARN("arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug")
+	if err != nil {
+		t.Fatalf("parse arn: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		build  func(b *policy.Builder) *policy.Builder
+		expect events.APIGatewayCustomAuthorizerResponse
+	}{
+		{
+			name: "allow and deny",
+			build: func(b *policy.Builder) *policy.Builder {
+				return b.
+					Allow(policy.NewRoute("POST", "/bug"), policy.NewRoute("POST", "/log")).
+					Deny(policy.NewRoute("GET", "/admin/*")).
+					WithContext("agentId", "tester")
+			},
+			expect: events.APIGatewayCustomAuthorizerResponse{
+				PrincipalID: "tester",
+				PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+					Version: "2012-10-17",
+					Statement: []events.IAMPolicyStatement{
+						{
+							Action: []string{"execute-api:Invoke"},
+							Effect: "Allow",
+							Resource: []string{
+								"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+								"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/log",
+							},
+						},
+						{
+							Action:   []string{"execute-api:Invoke"},
+							Effect:   "Deny",
+							Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/admin/*"},
+						},
+					},
+				},
+				Context: map[string]interface{}{
+					"agentId": "tester",
+				},
+			},
+		},
+		{
+			name: "duplicate routes",
+			build: func(b *policy.Builder) *policy.Builder {
+				return b.
+					Allow(policy.NewRoute("post", "bug"), policy.NewRoute("POST", "/bug"))
+			},
+			expect: events.APIGatewayCustomAuthorizerResponse{
+				PrincipalID: "tester",
+				PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+					Version: "2012-10-17",
+					Statement: []events.IAMPolicyStatement{
+						{
+							Action:   []string{"execute-api:Invoke"},
+							Effect:   "Allow",
+							Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "nothing allowed",
+			build: func(b *policy.Builder) *policy.Builder {
+				return b
+			},
+			expect: events.APIGatewayCustomAuthorizerResponse{
+				PrincipalID: "tester",
+				PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+					Version: "2012-10-17",
+					Statement: []events.IAMPolicyStatement{
+						{
+							Action:   []string{"execute-api:Invoke"},
+							Effect:   "Deny",
+							Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "usage key",
+			build: func(b *policy.Builder) *policy.Builder {
+				return b.AllowResource(arn.String()).WithUsageKey("bugfixes-company-usage-key")
+			},
+			expect: events.APIGatewayCustomAuthorizerResponse{
+				PrincipalID: "tester",
+				PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+					Version: "2012-10-17",
+					Statement: []events.IAMPolicyStatement{
+						{
+							Action:   []string{"execute-api:Invoke"},
+							Effect:   "Allow",
+							Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug"},
+						},
+					},
+				},
+				UsageIdentifierKey: "bugfixes-company-usage-key",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := test.build(policy.NewBuilder("tester", arn)).Build()
+			passed := assert.Equal(t, test.expect, resp)
+			if !passed {
+				t.Errorf("builder equal failed: %+v, %+v", test.expect, resp)
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package policy_test
 
 import (
+	"context"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/bugfixes/authorizer/policies"
+	"github.com/bugfixes/authorizer/service/opa"
 	"github.com/bugfixes/authorizer/service/policy"
 	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
@@ -14,7 +18,7 @@ func TestGenerateAllow(t *testing.T) {
 	if os.Getenv("GITHUB_ACTOR") == "" {
 		err := godotenv.Load()
 		if err != nil {
-			t.Errorf("godotenv err: %w", err)
+			t.Errorf("godotenv err: %v", err)
 		}
 	}
 
@@ -70,7 +74,7 @@ func TestGenerateDeny(t *testing.T) {
 	if os.Getenv("GITHUB_ACTOR") == "" {
 		err := godotenv.Load()
 		if err != nil {
-			t.Errorf("godotenv err: %w", err)
+			t.Errorf("godotenv err: %v", err)
 		}
 	}
 
@@ -128,7 +132,7 @@ func BenchmarkGenerateAllow(b *testing.B) {
 	if os.Getenv("GITHUB_ACTOR") == "" {
 		err := godotenv.Load()
 		if err != nil {
-			b.Errorf("godotenv err: %w", err)
+			b.Errorf("godotenv err: %v", err)
 		}
 	}
 
@@ -175,13 +179,63 @@ func BenchmarkGenerateAllow(b *testing.B) {
 	}
 }
 
+// BenchmarkDecide evaluates the bundled rego and builds the policy from its result,
+// the decision latency the rego engine adds over BenchmarkGenerateAllow
+func BenchmarkDecide(b *testing.B) {
+	b.ReportAllocs()
+
+	ctx := context.Background()
+	e, err := opa.New(ctx, "authorizer.rego", policies.Authorizer, "", time.Second)
+	if err != nil {
+		b.Fatalf("opa: %v", err)
+	}
+	in := opa.Input{
+		Principal: opa.Principal{
+			AgentID:   "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+			CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+			Roles:     []string{"ingest"},
+		},
+		Request: opa.Request{
+			MethodArn: "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug",
+			Verb:      "POST",
+			Resource:  "bug",
+			Stage:     "live",
+			SourceIP:  "192.0.2.1",
+		},
+		Routes:   []string{"POST /bug"},
+		Entitled: true,
+		Time:     "2021-03-16T10:00:00Z",
+	}
+	arn, err := policy.ParseARN(in.Request.MethodArn)
+	if err != nil {
+		b.Fatalf("parse arn: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := e.Decide(ctx, in)
+		if err != nil {
+			b.Fatalf("decide: %v", err)
+		}
+		if !resp.Allow {
+			b.Fatalf("decide: expected allow, got %+v", resp)
+		}
+
+		builder := policy.NewBuilder(in.Principal.AgentID, arn)
+		if err := resp.Apply(builder, arn); err != nil {
+			b.Fatalf("apply: %v", err)
+		}
+		builder.Build()
+	}
+}
+
 func BenchmarkGenerateDeny(b *testing.B) {
 	b.ReportAllocs()
 
 	if os.Getenv("GITHUB_ACTOR") == "" {
 		err := godotenv.Load()
 		if err != nil {
-			b.Errorf("godotenv err: %w", err)
+			b.Errorf("godotenv err: %v", err)
 		}
 	}
 
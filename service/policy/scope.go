@@ -0,0 +1,131 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// MaxPolicySize is the largest policy document we hand back, API Gateway
+// rejects authorizer responses with policies much over 8KB
+const MaxPolicySize = 8192
+
+// Scope controls how much of the API an Allow covers, anything wider than
+// ScopeMethod lets API Gateway reuse a cached decision on other routes
+type Scope string
+
+const (
+	// ScopeMethod allows only the MethodArn of the request
+	ScopeMethod Scope = "method"
+	// ScopeRoutes allows every route the identity is entitled to
+	ScopeRoutes Scope = "routes"
+	// ScopeStage allows the whole stage, only used when the identity is entitled to everything
+	ScopeStage Scope = "stage"
+)
+
+// ParseScope reads a scope, empty defaults to ScopeMethod
+func ParseScope(s string) (Scope, error) {
+	switch Scope(s) {
+	case "", ScopeMethod:
+		return ScopeMethod, nil
+	case ScopeRoutes, ScopeStage:
+		return Scope(s), nil
+	}
+
+	return ScopeMethod, fmt.Errorf("parse scope: unknown scope: %s", s)
+}
+
+// Grant allows the entitled routes at the given scope, if the request itself
+// isn't covered by them the policy still denies it
+func (b *Builder) Grant(scope Scope, routes ...Route) *Builder {
+	switch scope {
+	case ScopeStage:
+		if entitledToAll(routes) {
+			return b.Allow(NewRoute(Wildcard, Wildcard))
+		}
+		return b.Allow(routes...)
+	case ScopeRoutes:
+		return b.Allow(routes...)
+	}
+
+	for _, r := range routes {
+		if r.Matches(b.arn.Verb, b.arn.Resource) {
+			return b.AllowResource(b.arn.String())
+		}
+	}
+	return b
+}
+
+// Limit sets the maximum policy size in bytes, 0 turns the guard off
+func (b *Builder) Limit(size int) *Builder {
+	b.limit = size
+	return b
+}
+
+// collapse shrinks the policy down to the request arn, it keeps the decision
+// for this request but gives up on the cache covering other routes
+func (b *Builder) collapse() {
+	arn := b.arn.String()
+
+	allow := b.allow
+	b.allow = nil
+	for _, a := range allow {
+		if match(a, arn) {
+			b.allow = []string{arn}
+			break
+		}
+	}
+
+	deny := b.deny
+	b.deny = nil
+	for _, d := range deny {
+		if match(d, arn) {
+			b.deny = []string{arn}
+			break
+		}
+	}
+}
+
+func (b *Builder) oversized(doc events.APIGatewayCustomAuthorizerPolicy) bool {
+	if b.limit <= 0 {
+		return false
+	}
+
+	j, err := json.Marshal(doc)
+	if err != nil {
+		return true
+	}
+	return len(j) > b.limit
+}
+
+func entitledToAll(routes []Route) bool {
+	for _, r := range routes {
+		if r.Verb == Wildcard && r.Resource == Wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate reports whether the policy lets the MethodArn through, an explicit
+// Deny wins over any Allow and anything not allowed is denied, as API Gateway does
+func Evaluate(doc events.APIGatewayCustomAuthorizerPolicy, methodArn string) bool {
+	allowed := false
+	for _, s := range doc.Statement {
+		for _, r := range s.Resource {
+			if !match(r, methodArn) {
+				continue
+			}
+
+			if s.Effect == "Deny" {
+				return false
+			}
+			if s.Effect == "Allow" {
+				allowed = true
+			}
+		}
+	}
+
+	return allowed
+}
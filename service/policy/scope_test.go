@@ -0,0 +1,142 @@
+package policy_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	bugArn   = "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug"
+	logArn   = "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/log"
+	adminArn = "arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/GET/admin/company"
+)
+
+func TestGrantCachedAcrossRoutes(t *testing.T) {
+	ingest := []policy.Route{
+		policy.NewRoute("POST", "/bug"),
+		policy.NewRoute("POST", "/log"),
+	}
+	everything := []policy.Route{
+		policy.NewRoute(policy.Wildcard, policy.Wildcard),
+	}
+
+	tests := []struct {
+		name   string
+		scope  policy.Scope
+		routes []policy.Route
+		first  string
+		expect map[string]bool
+	}{
+		{
+			name:   "method scope only covers the first call",
+			scope:  policy.ScopeMethod,
+			routes: ingest,
+			first:  bugArn,
+			expect: map[string]bool{
+				bugArn:   true,
+				logArn:   false,
+				adminArn: false,
+			},
+		},
+		{
+			name:   "routes scope covers every entitled route",
+			scope:  policy.ScopeRoutes,
+			routes: ingest,
+			first:  bugArn,
+			expect: map[string]bool{
+				bugArn:   true,
+				logArn:   true,
+				adminArn: false,
+			},
+		},
+		{
+			name:   "routes scope first call not entitled",
+			scope:  policy.ScopeRoutes,
+			routes: ingest,
+			first:  adminArn,
+			expect: map[string]bool{
+				bugArn:   true,
+				logArn:   true,
+				adminArn: false,
+			},
+		},
+		{
+			name:   "stage scope without full entitlement falls back to routes",
+			scope:  policy.ScopeStage,
+			routes: ingest,
+			first:  logArn,
+			expect: map[string]bool{
+				bugArn:   true,
+				logArn:   true,
+				adminArn: false,
+			},
+		},
+		{
+			name:   "stage scope with full entitlement",
+			scope:  policy.ScopeStage,
+			routes: everything,
+			first:  logArn,
+			expect: map[string]bool{
+				bugArn:   true,
+				logArn:   true,
+				adminArn: true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			arn, err := policy.ParseARN(test.first)
+			assert.NoError(t, err)
+
+			// API Gateway reuses this response for every call inside the ttl
+			cached := policy.NewBuilder("tester", arn).Grant(test.scope, test.routes...).Build()
+			for methodArn, allowed := range test.expect {
+				assert.Equal(t, allowed, policy.Evaluate(cached.PolicyDocument, methodArn), methodArn)
+			}
+		})
+	}
+}
+
+func TestBuilderLimit(t *testing.T) {
+	arn, err := policy.ParseARN(bugArn)
+	assert.NoError(t, err)
+
+	routes := []policy.Route{
+		policy.NewRoute("POST", "/bug"),
+	}
+	for i := 0; i < 200; i++ {
+		routes = append(routes, policy.NewRoute("GET", fmt.Sprintf("/report/%d", i)))
+	}
+
+	resp := policy.NewBuilder("tester", arn).
+		Grant(policy.ScopeRoutes, routes...).
+		Deny(policy.NewRoute("GET", "/admin/*")).
+		Build()
+	assert.Len(t, resp.PolicyDocument.Statement, 1)
+	assert.Equal(t, []string{bugArn}, resp.PolicyDocument.Statement[0].Resource)
+	assert.True(t, policy.Evaluate(resp.PolicyDocument, bugArn))
+
+	resp = policy.NewBuilder("tester", arn).
+		Limit(0).
+		Grant(policy.ScopeRoutes, routes...).
+		Build()
+	assert.Len(t, resp.PolicyDocument.Statement[0].Resource, len(routes))
+}
+
+func TestParseScope(t *testing.T) {
+	scope, err := policy.ParseScope("")
+	assert.NoError(t, err)
+	assert.Equal(t, policy.ScopeMethod, scope)
+
+	scope, err = policy.ParseScope("stage")
+	assert.NoError(t, err)
+	assert.Equal(t, policy.ScopeStage, scope)
+
+	scope, err = policy.ParseScope("everything")
+	assert.Error(t, err)
+	assert.Equal(t, policy.ScopeMethod, scope)
+}
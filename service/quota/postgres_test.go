@@ -0,0 +1,59 @@
+package quota_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/bugfixes/authorizer/service/quota"
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostgres(t *testing.T) {
+	if os.Getenv("GITHUB_ACTOR") == "" {
+		err := godotenv.Load("../../.env")
+		if err != nil {
+			t.Errorf("godotenv err: %v", err)
+		}
+	}
+	details := store.ConnectDetails{
+		Host:     os.Getenv("DB_HOSTNAME"),
+		Port:     os.Getenv("DB_PORT"),
+		Username: os.Getenv("DB_USERNAME"),
+		Password: os.Getenv("DB_PASSWORD"),
+		Database: os.Getenv("DB_DATABASE"),
+	}
+
+	db, err := sql.Open("postgres", details.DSN())
+	if err != nil {
+		t.Fatalf("db.open: %v", err)
+	}
+	defer func() {
+		err := db.Close()
+		if err != nil {
+			fmt.Printf("db.close: %v", err)
+		}
+	}()
+	defer func() {
+		if _, err := db.Exec("DELETE FROM quota WHERE company_id = $1", company); err != nil {
+			t.Errorf("delete err: %v", err)
+		}
+	}()
+
+	ctx := context.Background()
+	p := quota.NewPostgres(db)
+
+	used, err := p.Usage(ctx, company, "2021-03")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), used)
+
+	assert.NoError(t, p.Add(ctx, "2021-03", map[string]int64{company: 3}))
+	assert.NoError(t, p.Add(ctx, "2021-03", map[string]int64{company: 4}))
+	used, err = p.Usage(ctx, company, "2021-03")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), used)
+}
@@ -0,0 +1,202 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultPlan is used for companies without a plan, or with one that isn't configured
+const DefaultPlan = "default"
+
+// Allowance is the requests a company can make in a month, Soft is the fraction
+// of it after which the warning flag is set, a zero Monthly is unlimited
+type Allowance struct {
+	Monthly int64   `json:"monthly"`
+	Soft    float64 `json:"soft"`
+}
+
+// Unlimited is true when there's no allowance to track
+func (a Allowance) Unlimited() bool {
+	return a.Monthly <= 0
+}
+
+// Allowances is the allowance by plan name
+type Allowances map[string]Allowance
+
+// ParseAllowances reads the allowances, e.g. {"default": {"monthly": 10000, "soft": 0.8}}
+func ParseAllowances(s string) (Allowances, error) {
+	a := Allowances{}
+	if err := json.Unmarshal([]byte(s), &a); err != nil {
+		return nil, fmt.Errorf("quota allowances: %w", err)
+	}
+
+	for name, allowance := range a {
+		if allowance.Monthly < 0 || allowance.Soft < 0 || allowance.Soft > 1 {
+			return nil, fmt.Errorf("quota allowances: %s needs a positive monthly and soft between 0 and 1", name)
+		}
+	}
+
+	return a, nil
+}
+
+// For the named plan, falling back to the default plan
+func (a Allowances) For(plan string) Allowance {
+	if allowance, ok := a[plan]; ok {
+		return allowance
+	}
+	return a[DefaultPlan]
+}
+
+// Period is the month the time is counted against
+func Period(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// Store keeps the counts, Add is given every count since the last flush at once
+type Store interface {
+	Usage(ctx context.Context, companyID, period string) (int64, error)
+	Add(ctx context.Context, period string, counts map[string]int64) error
+}
+
+// State is where a company is against its allowance
+type State struct {
+	Used     int64
+	Exceeded bool
+	Warning  bool
+}
+
+type usage struct {
+	used    int64
+	period  string
+	fetched time.Time
+}
+
+// Tracker counts requests in memory and writes them in batches, so each container
+// can be behind by up to a batch and the stored usage is reread every Refresh. A batch
+// is only written by the next request, so one a container is holding when lambda
+// recycles it is lost
+type Tracker struct {
+	sync.Mutex
+	store   Store
+	usage   map[string]*usage
+	pending map[string]int64
+	period  string
+	total   int64
+	flushed time.Time
+
+	// FlushSize and FlushInterval are how many requests or how long before counts are written
+	FlushSize     int64
+	FlushInterval time.Duration
+
+	// Refresh is how long the stored usage of a company is trusted for
+	Refresh time.Duration
+
+	// Now is the clock, replaced in tests
+	Now func() time.Time
+}
+
+// NewTracker counts against the store
+func NewTracker(s Store) *Tracker {
+	return &Tracker{
+		store:         s,
+		usage:         map[string]*usage{},
+		pending:       map[string]int64{},
+		flushed:       time.Now(),
+		FlushSize:     100,
+		FlushInterval: 10 * time.Second,
+		Refresh:       time.Minute,
+		Now:           time.Now,
+	}
+}
+
+// Check is the state of the company this month, including counts not written yet
+func (t *Tracker) Check(ctx context.Context, companyID string, a Allowance) (State, error) {
+	if a.Unlimited() {
+		return State{}, nil
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	now := t.Now()
+	period := Period(now)
+	u, ok := t.usage[companyID]
+	if !ok || u.period != period || now.Sub(u.fetched) >= t.Refresh {
+		used, err := t.store.Usage(ctx, companyID, period)
+		if err != nil {
+			return State{}, fmt.Errorf("quota usage: %w", err)
+		}
+		u = &usage{
+			used:    used,
+			period:  period,
+			fetched: now,
+		}
+		t.usage[companyID] = u
+	}
+
+	s := State{
+		Used: u.used,
+	}
+	if t.period == period {
+		s.Used += t.pending[companyID]
+	}
+	s.Exceeded = s.Used >= a.Monthly
+	s.Warning = a.Soft > 0 && float64(s.Used) >= float64(a.Monthly)*a.Soft
+
+	return s, nil
+}
+
+// Record counts an accepted request, writing the batch when it's due
+func (t *Tracker) Record(ctx context.Context, companyID string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	// counts from last month are written before this month's start
+	now := t.Now()
+	if period := Period(now); period != t.period {
+		if err := t.flush(ctx); err != nil {
+			return err
+		}
+		t.period = period
+	}
+
+	t.pending[companyID]++
+	t.total++
+	if t.total < t.FlushSize && now.Sub(t.flushed) < t.FlushInterval {
+		return nil
+	}
+
+	return t.flush(ctx)
+}
+
+// Flush writes the pending counts
+func (t *Tracker) Flush(ctx context.Context) error {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.flush(ctx)
+}
+
+func (t *Tracker) flush(ctx context.Context) error {
+	t.flushed = t.Now()
+	if t.total == 0 {
+		return nil
+	}
+
+	if err := t.store.Add(ctx, t.period, t.pending); err != nil {
+		return fmt.Errorf("quota flush: %w", err)
+	}
+
+	for companyID, count := range t.pending {
+		if u, ok := t.usage[companyID]; ok && u.period == t.period {
+			u.used += count
+		}
+	}
+	t.pending = map[string]int64{}
+	t.total = 0
+
+	return nil
+}
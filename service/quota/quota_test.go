@@ -0,0 +1,103 @@
+package quota_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/quota"
+	"github.com/stretchr/testify/assert"
+)
+
+const company = "b9e9153a-028c-4173-a7a8-e5063334416a"
+
+func TestParseAllowances(t *testing.T) {
+	a, err := quota.ParseAllowances(`{"default": {"monthly": 1000, "soft": 0.8}, "business": {"monthly": 100000}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, quota.Allowance{Monthly: 100000}, a.For("business"))
+	assert.Equal(t, quota.Allowance{Monthly: 1000, Soft: 0.8}, a.For("free"))
+
+	_, err = quota.ParseAllowances(`{"default": {"monthly": 1000, "soft": 80}}`)
+	assert.Error(t, err)
+}
+
+func TestTracker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	s := quota.NewMemory()
+	tr := quota.NewTracker(s)
+	tr.FlushSize = 3
+	tr.FlushInterval = time.Hour
+	tr.Now = func() time.Time {
+		return now
+	}
+	allowance := quota.Allowance{Monthly: 5, Soft: 0.6}
+
+	state, err := tr.Check(ctx, company, allowance)
+	assert.NoError(t, err)
+	assert.Equal(t, quota.State{}, state)
+
+	// counts are batched until the flush size
+	assert.NoError(t, tr.Record(ctx, company))
+	assert.NoError(t, tr.Record(ctx, company))
+	assert.Empty(t, s.Counts)
+
+	state, err = tr.Check(ctx, company, allowance)
+	assert.NoError(t, err)
+	assert.Equal(t, quota.State{Used: 2}, state)
+
+	assert.NoError(t, tr.Record(ctx, company))
+	assert.Equal(t, map[string]int64{"2021-03/" + company: 3}, s.Counts)
+
+	state, err = tr.Check(ctx, company, allowance)
+	assert.NoError(t, err)
+	assert.Equal(t, quota.State{Used: 3, Warning: true}, state)
+
+	assert.NoError(t, tr.Record(ctx, company))
+	assert.NoError(t, tr.Record(ctx, company))
+	state, err = tr.Check(ctx, company, allowance)
+	assert.NoError(t, err)
+	assert.Equal(t, quota.State{Used: 5, Exceeded: true, Warning: true}, state)
+
+	// a new month starts from nothing, last month's counts are written first
+	now = time.Date(2021, time.April, 1, 0, 0, 0, 0, time.UTC)
+	state, err = tr.Check(ctx, company, allowance)
+	assert.NoError(t, err)
+	assert.Equal(t, quota.State{}, state)
+
+	assert.NoError(t, tr.Record(ctx, company))
+	assert.Equal(t, int64(5), s.Counts["2021-03/"+company])
+	assert.NoError(t, tr.Flush(ctx))
+	assert.Equal(t, int64(1), s.Counts["2021-04/"+company])
+
+	// unlimited isn't tracked
+	state, err = tr.Check(ctx, company, quota.Allowance{})
+	assert.NoError(t, err)
+	assert.Equal(t, quota.State{}, state)
+}
+
+func TestTrackerRefresh(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	s := quota.NewMemory()
+	tr := quota.NewTracker(s)
+	tr.Now = func() time.Time {
+		return now
+	}
+	allowance := quota.Allowance{Monthly: 100}
+
+	state, err := tr.Check(ctx, company, allowance)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), state.Used)
+
+	// other containers writing aren't seen until the refresh
+	assert.NoError(t, s.Add(ctx, "2021-03", map[string]int64{company: 100}))
+	state, err = tr.Check(ctx, company, allowance)
+	assert.NoError(t, err)
+	assert.False(t, state.Exceeded)
+
+	now = now.Add(tr.Refresh)
+	state, err = tr.Check(ctx, company, allowance)
+	assert.NoError(t, err)
+	assert.True(t, state.Exceeded)
+}
@@ -0,0 +1,99 @@
+package quota
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Postgres keeps the counts in the quota table
+type Postgres struct {
+	db *sql.DB
+}
+
+// NewPostgres uses an open pool, normally the one the store has
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{
+		db: db,
+	}
+}
+
+// Usage is the count for the company in the period
+func (p *Postgres) Usage(ctx context.Context, companyID, period string) (int64, error) {
+	var count int64
+	err := p.db.QueryRowContext(ctx, "SELECT count FROM quota WHERE company_id = $1 AND period = $2", companyID, period).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("quota postgres usage: %w", err)
+	}
+
+	return count, nil
+}
+
+// Add increments the counts in one transaction, the rows are locked in company order
+// so containers flushing the same companies at once wait for each other rather than deadlock
+func (p *Postgres) Add(ctx context.Context, period string, counts map[string]int64) error {
+	companyIDs := make([]string, 0, len(counts))
+	for companyID := range counts {
+		companyIDs = append(companyIDs, companyID)
+	}
+	sort.Strings(companyIDs)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("quota postgres begin: %w", err)
+	}
+
+	for _, companyID := range companyIDs {
+		_, err := tx.ExecContext(ctx, `
+INSERT INTO quota (company_id, period, count) VALUES ($1, $2, $3)
+ON CONFLICT (company_id, period) DO UPDATE SET count = quota.count + EXCLUDED.count`, companyID, period, counts[companyID])
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				fmt.Printf("quota postgres rollback: %v\n", rbErr)
+			}
+			return fmt.Errorf("quota postgres add: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("quota postgres commit: %w", err)
+	}
+	return nil
+}
+
+// Memory keeps the counts in memory, for tests and the fixture store
+type Memory struct {
+	sync.Mutex
+	Counts map[string]int64
+}
+
+// NewMemory makes an empty in memory store
+func NewMemory() *Memory {
+	return &Memory{
+		Counts: map[string]int64{},
+	}
+}
+
+// Usage is the count for the company in the period
+func (m *Memory) Usage(ctx context.Context, companyID, period string) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Counts[period+"/"+companyID], nil
+}
+
+// Add increments the counts
+func (m *Memory) Add(ctx context.Context, period string, counts map[string]int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for companyID, count := range counts {
+		m.Counts[period+"/"+companyID] += count
+	}
+	return nil
+}
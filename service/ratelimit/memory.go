@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxBuckets is when idle buckets get dropped, a full bucket is the same as no bucket
+const maxBuckets = 10000
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+func (b *bucket) refill(now time.Time, l Limit) {
+	b.tokens = math.Min(l.capacity(), b.tokens+now.Sub(b.updated).Seconds()*l.Rate)
+	b.updated = now
+	b.limit = l
+}
+
+// Memory is a Limiter for a single container, each warm lambda counts on its own
+type Memory struct {
+	sync.Mutex
+	buckets map[string]*bucket
+
+	// Now is the clock, replaced in tests
+	Now func() time.Time
+}
+
+// NewMemory makes an empty in memory limiter
+func NewMemory() *Memory {
+	return &Memory{
+		buckets: map[string]*bucket{},
+		Now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket for key
+func (m *Memory) Allow(ctx context.Context, key string, l Limit) (bool, error) {
+	if l.Unlimited() {
+		return true, nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.Now()
+	b, ok := m.buckets[key]
+	if !ok {
+		if len(m.buckets) >= maxBuckets {
+			m.prune(now)
+		}
+		b = &bucket{
+			tokens:  l.capacity(),
+			updated: now,
+		}
+		m.buckets[key] = b
+	}
+	b.refill(now, l)
+
+	if b.tokens < 1 {
+		return false, nil
+	}
+	b.tokens--
+
+	return true, nil
+}
+
+func (m *Memory) prune(now time.Time) {
+	for k, b := range m.buckets {
+		b.refill(now, b.limit)
+		if b.tokens >= b.limit.capacity() {
+			delete(m.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// refillQuery takes a token in one statement so every container sees the same bucket,
+// $2 is the capacity, $3 the rate a second and $4 the time of the request
+const refillQuery = `
+INSERT INTO rate_limit (key, tokens, allowed, updated_at) VALUES ($1, $2::float8 - 1, true, $4::timestamptz)
+ON CONFLICT (key) DO UPDATE SET
+  allowed = ` + refilled + ` >= 1,
+  tokens = ` + refilled + ` - CASE WHEN ` + refilled + ` >= 1 THEN 1 ELSE 0 END,
+  updated_at = GREATEST(rate_limit.updated_at, $4::timestamptz)
+RETURNING allowed`
+
+const refilled = `LEAST($2::float8, rate_limit.tokens + GREATEST(0, EXTRACT(EPOCH FROM ($4::timestamptz - rate_limit.updated_at))::float8) * $3::float8)`
+
+// Postgres is a Limiter shared by every container, using the rate_limit table
+type Postgres struct {
+	db *sql.DB
+
+	// Now is the clock, replaced in tests
+	Now func() time.Time
+}
+
+// NewPostgres uses an open pool, normally the one the store has
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{
+		db:  db,
+		Now: time.Now,
+	}
+}
+
+// Allow takes a token from the bucket for key
+func (p *Postgres) Allow(ctx context.Context, key string, l Limit) (bool, error) {
+	if l.Unlimited() {
+		return true, nil
+	}
+
+	var allowed bool
+	err := p.db.QueryRowContext(ctx, refillQuery, key, l.capacity(), l.Rate, p.Now().UTC()).Scan(&allowed)
+	if err != nil {
+		return false, fmt.Errorf("ratelimit postgres: %w", err)
+	}
+
+	return allowed, nil
+}
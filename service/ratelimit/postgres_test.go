@@ -0,0 +1,70 @@
+package ratelimit_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/ratelimit"
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostgres(t *testing.T) {
+	if os.Getenv("GITHUB_ACTOR") == "" {
+		err := godotenv.Load("../../.env")
+		if err != nil {
+			t.Errorf("godotenv err: %v", err)
+		}
+	}
+	details := store.ConnectDetails{
+		Host:     os.Getenv("DB_HOSTNAME"),
+		Port:     os.Getenv("DB_PORT"),
+		Username: os.Getenv("DB_USERNAME"),
+		Password: os.Getenv("DB_PASSWORD"),
+		Database: os.Getenv("DB_DATABASE"),
+	}
+
+	db, err := sql.Open("postgres", details.DSN())
+	if err != nil {
+		t.Fatalf("db.open: %v", err)
+	}
+	defer func() {
+		err := db.Close()
+		if err != nil {
+			fmt.Printf("db.close: %v", err)
+		}
+	}()
+
+	key := ratelimit.AgentKey("ad4b99e1-dec8-4682-862a-6b017e7c7c70")
+	defer func() {
+		if _, err := db.Exec("DELETE FROM rate_limit WHERE key = $1", key); err != nil {
+			t.Errorf("delete err: %v", err)
+		}
+	}()
+
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	p := ratelimit.NewPostgres(db)
+	p.Now = func() time.Time {
+		return now
+	}
+	l := ratelimit.Limit{Rate: 2, Burst: 2}
+
+	allow := func() bool {
+		ok, err := p.Allow(context.Background(), key, l)
+		assert.NoError(t, err)
+		return ok
+	}
+
+	assert.True(t, allow())
+	assert.True(t, allow())
+	assert.False(t, allow())
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, allow())
+	assert.False(t, allow())
+}
@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// DefaultPlan is used for companies without a plan, or with one that isn't configured
+const DefaultPlan = "default"
+
+// Limit is a token bucket, Rate tokens are added a second up to Burst, a zero Rate is unlimited
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+// Unlimited is true when the limit doesn't apply
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+func (l Limit) capacity() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return l.Burst
+}
+
+// Plan is the limits for each agent and for the company as a whole
+type Plan struct {
+	Agent   Limit `json:"agent"`
+	Company Limit `json:"company"`
+}
+
+// Plans is the limits by plan name
+type Plans map[string]Plan
+
+// ParsePlans reads the limits, e.g. {"default": {"agent": {"rate": 5, "burst": 20}}}
+func ParsePlans(s string) (Plans, error) {
+	p := Plans{}
+	if err := json.Unmarshal([]byte(s), &p); err != nil {
+		return nil, fmt.Errorf("ratelimit plans: %w", err)
+	}
+
+	for name, plan := range p {
+		for _, l := range []Limit{plan.Agent, plan.Company} {
+			if l.Rate < 0 || l.Burst < 0 {
+				return nil, fmt.Errorf("ratelimit plans: %s has a negative limit", name)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// For the named plan, falling back to the default plan
+func (p Plans) For(name string) Plan {
+	if plan, ok := p[name]; ok {
+		return plan
+	}
+	return p[DefaultPlan]
+}
+
+// Limiter takes a token from the bucket for key, false means the bucket was empty
+type Limiter interface {
+	Allow(ctx context.Context, key string, l Limit) (bool, error)
+}
+
+// AgentKey is the bucket for a single agent
+func AgentKey(id string) string {
+	return "agent:" + id
+}
+
+// CompanyKey is the bucket shared by every agent of a company
+func CompanyKey(id string) string {
+	return "company:" + id
+}
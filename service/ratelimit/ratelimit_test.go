@@ -0,0 +1,71 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePlans(t *testing.T) {
+	p, err := ratelimit.ParsePlans(`{
+		"default": {"agent": {"rate": 5, "burst": 20}},
+		"business": {"agent": {"rate": 50, "burst": 200}, "company": {"rate": 500, "burst": 2000}}
+	}`)
+	assert.NoError(t, err)
+	assert.Equal(t, ratelimit.Limit{Rate: 50, Burst: 200}, p.For("business").Agent)
+	assert.Equal(t, ratelimit.Limit{Rate: 5, Burst: 20}, p.For("free").Agent)
+	assert.True(t, p.For("free").Company.Unlimited())
+
+	_, err = ratelimit.ParsePlans(`{"default": {"agent": {"rate": -1}}}`)
+	assert.Error(t, err)
+
+	_, err = ratelimit.ParsePlans(`[]`)
+	assert.Error(t, err)
+}
+
+func TestMemory(t *testing.T) {
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	m := ratelimit.NewMemory()
+	m.Now = func() time.Time {
+		return now
+	}
+	ctx := context.Background()
+	l := ratelimit.Limit{Rate: 2, Burst: 3}
+
+	allow := func(key string) bool {
+		ok, err := m.Allow(ctx, key, l)
+		assert.NoError(t, err)
+		return ok
+	}
+
+	// the burst goes straight away
+	assert.True(t, allow("agent:1"))
+	assert.True(t, allow("agent:1"))
+	assert.True(t, allow("agent:1"))
+	assert.False(t, allow("agent:1"))
+
+	// buckets are separate
+	assert.True(t, allow("agent:2"))
+
+	// half a second at 2 a second is one more token
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, allow("agent:1"))
+	assert.False(t, allow("agent:1"))
+
+	// a long wait only refills to the burst
+	now = now.Add(time.Hour)
+	assert.True(t, allow("agent:1"))
+	assert.True(t, allow("agent:1"))
+	assert.True(t, allow("agent:1"))
+	assert.False(t, allow("agent:1"))
+
+	// unlimited never runs out
+	for i := 0; i < 100; i++ {
+		ok, err := m.Allow(ctx, "agent:3", ratelimit.Limit{})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+}
@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// refillScript takes a token the same way the postgres limiter does, the bucket is a
+// hash at KEYS[1], ARGV[1] is the capacity, ARGV[2] the rate a second, ARGV[3] the time
+// of the request in milliseconds and ARGV[4] how long an untouched bucket is kept
+var refillScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1])
+local updated = tonumber(bucket[2])
+if tokens == nil or updated == nil then
+  tokens = capacity
+  updated = now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - updated) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(math.max(now, updated)))
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return allowed`)
+
+// Redis is a Limiter shared by every container, each bucket is a hash under ratelimit:
+type Redis struct {
+	client *redis.Client
+
+	// Now is the clock, replaced in tests
+	Now func() time.Time
+}
+
+// NewRedis uses the client the other shared parts have
+func NewRedis(c *redis.Client) *Redis {
+	return &Redis{
+		client: c,
+		Now:    time.Now,
+	}
+}
+
+// Allow takes a token from the bucket for key
+func (r *Redis) Allow(ctx context.Context, key string, l Limit) (bool, error) {
+	if l.Unlimited() {
+		return true, nil
+	}
+
+	// a bucket left long enough to refill is the same as no bucket
+	keep := int64(math.Ceil(l.capacity()/l.Rate*1000)) + 1000
+	allowed, err := refillScript.Run(ctx, r.client, []string{"ratelimit:" + key},
+		l.capacity(), l.Rate, r.Now().UnixNano()/int64(time.Millisecond), keep).Int64()
+	if err != nil {
+		return false, fmt.Errorf("ratelimit redis: %w", err)
+	}
+
+	return allowed == 1, nil
+}
@@ -0,0 +1,60 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bugfixes/authorizer/service/ratelimit"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedis(t *testing.T) {
+	ctx := context.Background()
+	m := miniredis.RunT(t)
+	c := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	key := ratelimit.AgentKey("ad4b99e1-dec8-4682-862a-6b017e7c7c70")
+
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	r := ratelimit.NewRedis(c)
+	r.Now = func() time.Time {
+		return now
+	}
+	l := ratelimit.Limit{Rate: 2, Burst: 2}
+
+	allow := func() bool {
+		ok, err := r.Allow(ctx, key, l)
+		assert.NoError(t, err)
+		return ok
+	}
+
+	assert.True(t, allow())
+	assert.True(t, allow())
+	assert.False(t, allow())
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, allow())
+	assert.False(t, allow())
+
+	// a long wait only refills to the burst
+	now = now.Add(time.Hour)
+	assert.True(t, allow())
+	assert.True(t, allow())
+	assert.False(t, allow())
+
+	// an untouched bucket is dropped once it would have refilled
+	assert.True(t, m.Exists("ratelimit:"+key))
+	m.FastForward(2 * time.Second)
+	assert.False(t, m.Exists("ratelimit:"+key))
+}
+
+func TestRedisDown(t *testing.T) {
+	m := miniredis.RunT(t)
+	r := ratelimit.NewRedis(redis.NewClient(&redis.Options{Addr: m.Addr()}))
+	m.Close()
+
+	_, err := r.Allow(context.Background(), ratelimit.AgentKey("ad4b99e1-dec8-4682-862a-6b017e7c7c70"), ratelimit.Limit{Rate: 2, Burst: 2})
+	assert.Error(t, err)
+}
@@ -0,0 +1,251 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Golden files are pairs in one directory, name.event.json and name.expect.json
+const (
+	EventSuffix  = ".event.json"
+	ExpectSuffix = ".expect.json"
+)
+
+// Redacted replaces credentials when an event is sanitized
+const Redacted = "REDACTED"
+
+// Case is a recorded event and the response it got
+type Case struct {
+	Name   string
+	Event  events.APIGatewayCustomAuthorizerRequestTypeRequest
+	Expect events.APIGatewayCustomAuthorizerResponse
+}
+
+// Handler is anything that answers authorizer events, service.Handler in practice
+type Handler func(context.Context, events.APIGatewayCustomAuthorizerRequestTypeRequest) (events.APIGatewayCustomAuthorizerResponse, error)
+
+// Load reads every pair in the directory, an event without an expectation is an error
+func Load(dir string) ([]Case, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+EventSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("replay load: %w", err)
+	}
+	sort.Strings(names)
+
+	var cases []Case
+	for _, n := range names {
+		c := Case{
+			Name: strings.TrimSuffix(filepath.Base(n), EventSuffix),
+		}
+		if err := readJSON(n, &c.Event); err != nil {
+			return nil, fmt.Errorf("replay load %s: %w", c.Name, err)
+		}
+		if err := readJSON(filepath.Join(dir, c.Name+ExpectSuffix), &c.Expect); err != nil {
+			return nil, fmt.Errorf("replay load %s: %w", c.Name, err)
+		}
+		cases = append(cases, c)
+	}
+
+	return cases, nil
+}
+
+// Record writes the pair for a case, events from production should go through Sanitize first
+func Record(dir string, c Case) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("replay record: %w", err)
+	}
+	if err := writeJSON(filepath.Join(dir, c.Name+EventSuffix), c.Event); err != nil {
+		return fmt.Errorf("replay record %s: %w", c.Name, err)
+	}
+	if err := writeJSON(filepath.Join(dir, c.Name+ExpectSuffix), c.Expect); err != nil {
+		return fmt.Errorf("replay record %s: %w", c.Name, err)
+	}
+
+	return nil
+}
+
+// Sanitize redacts credentials so a production event can be committed, agents in the
+// fixture store used for replay need Redacted as their secret, or as their id when the
+// event has x-agent-id
+func Sanitize(event events.APIGatewayCustomAuthorizerRequestTypeRequest) events.APIGatewayCustomAuthorizerRequestTypeRequest {
+	headers := map[string]string{}
+	for k, v := range event.Headers {
+		switch strings.ToLower(k) {
+		case "x-api-secret", "authorization", "x-agent-id":
+			v = Redacted
+		}
+		headers[k] = v
+	}
+	if event.Headers != nil {
+		event.Headers = headers
+	}
+
+	multi := map[string][]string{}
+	for k, vs := range event.MultiValueHeaders {
+		switch strings.ToLower(k) {
+		case "x-api-secret", "authorization", "x-agent-id":
+			vs = []string{Redacted}
+		}
+		multi[k] = vs
+	}
+	if event.MultiValueHeaders != nil {
+		event.MultiValueHeaders = multi
+	}
+
+	if event.RequestContext.Identity.APIKey != "" {
+		event.RequestContext.Identity.APIKey = Redacted
+	}
+
+	return event
+}
+
+// Result is the outcome of replaying one case, Diff is empty when nothing changed
+type Result struct {
+	Name string
+	Got  events.APIGatewayCustomAuthorizerResponse
+	Diff string
+	Err  error
+}
+
+// Passed is true when the response is the same as recorded
+func (r Result) Passed() bool {
+	return r.Err == nil && r.Diff == ""
+}
+
+// Report is every result of a replay
+type Report struct {
+	Results []Result
+}
+
+// Run replays each case through the handler, with the context a lambda invocation would have
+func Run(ctx context.Context, h Handler, cases []Case) Report {
+	r := Report{}
+	for _, c := range cases {
+		res := Result{
+			Name: c.Name,
+		}
+		res.Got, res.Err = h(ctx, c.Event)
+		if res.Err == nil {
+			res.Diff, res.Err = Diff(c.Expect, res.Got)
+		}
+		r.Results = append(r.Results, res)
+	}
+
+	return r
+}
+
+// Failed is the results that changed
+func (r Report) Failed() []Result {
+	var failed []Result
+	for _, res := range r.Results {
+		if !res.Passed() {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// String is the summary followed by a diff for every case that changed
+func (r Report) String() string {
+	failed := r.Failed()
+
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "replayed %d, %d changed\n", len(r.Results), len(failed))
+	for _, res := range failed {
+		fmt.Fprintf(&sb, "\n=== %s\n", res.Name)
+		if res.Err != nil {
+			fmt.Fprintf(&sb, "error: %v\n", res.Err)
+			continue
+		}
+		sb.WriteString(res.Diff)
+	}
+
+	return sb.String()
+}
+
+// Diff compares the responses as indented json, lines only in expect start
+// with "-" and lines only in got start with "+"
+func Diff(expect, got events.APIGatewayCustomAuthorizerResponse) (string, error) {
+	e, err := json.MarshalIndent(expect, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("replay diff expect: %w", err)
+	}
+	g, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("replay diff got: %w", err)
+	}
+	if string(e) == string(g) {
+		return "", nil
+	}
+
+	return diffLines(strings.Split(string(e), "\n"), strings.Split(string(g), "\n")), nil
+}
+
+// diffLines is a longest common subsequence diff, responses are small enough for it
+func diffLines(a, b []string) string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	sb := strings.Builder{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			fmt.Fprintf(&sb, "  %s\n", a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&sb, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&sb, "+ %s\n", b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		fmt.Fprintf(&sb, "- %s\n", a[i])
+	}
+	for ; j < len(b); j++ {
+		fmt.Fprintf(&sb, "+ %s\n", b[j])
+	}
+
+	return sb.String()
+}
+
+func readJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func writeJSON(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,117 @@
+package replay_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bugfixes/authorizer/service/replay"
+	"github.com/stretchr/testify/assert"
+)
+
+func response(effect string) events.APIGatewayCustomAuthorizerResponse {
+	return events.APIGatewayCustomAuthorizerResponse{
+		PrincipalID: "tester",
+		PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+			Version: "2012-10-17",
+			Statement: []events.IAMPolicyStatement{
+				{
+					Action:   []string{"execute-api:Invoke"},
+					Effect:   effect,
+					Resource: []string{"arn:aws:execute-api:eu-west-2:123456789:wmcwzleu0i/live/POST/bug"},
+				},
+			},
+		},
+	}
+}
+
+func TestDiff(t *testing.T) {
+	d, err := replay.Diff(response("Allow"), response("Allow"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", d)
+
+	d, err = replay.Diff(response("Allow"), response("Deny"))
+	assert.NoError(t, err)
+	assert.Contains(t, d, "-         \"Effect\": \"Allow\",\n")
+	assert.Contains(t, d, "+         \"Effect\": \"Deny\",\n")
+	assert.Contains(t, d, "    \"principalId\": \"tester\",\n")
+}
+
+func TestSanitize(t *testing.T) {
+	event := events.APIGatewayCustomAuthorizerRequestTypeRequest{
+		Headers: map[string]string{
+			"X-Api-Key":     "94365b00-c6df-483f-804e-363312750500",
+			"X-Api-Secret":  "f7356946-5814-4b5e-ad45-0348a89576ef",
+			"Authorization": "Bearer f7356946",
+			"X-Agent-Id":    "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+		},
+		MultiValueHeaders: map[string][]string{
+			"x-api-secret": {"f7356946-5814-4b5e-ad45-0348a89576ef"},
+			"x-agent-id":   {"ad4b99e1-dec8-4682-862a-6b017e7c7c70"},
+		},
+	}
+	event.RequestContext.Identity.APIKey = "bugfixes-agent-usage-key"
+	event.RequestContext.Identity.SourceIP = "203.0.113.10"
+	e := replay.Sanitize(event)
+
+	assert.Equal(t, map[string]string{
+		"X-Api-Key":     "94365b00-c6df-483f-804e-363312750500",
+		"X-Api-Secret":  replay.Redacted,
+		"Authorization": replay.Redacted,
+		"X-Agent-Id":    replay.Redacted,
+	}, e.Headers)
+	assert.Equal(t, map[string][]string{
+		"x-api-secret": {replay.Redacted},
+		"x-agent-id":   {replay.Redacted},
+	}, e.MultiValueHeaders)
+	assert.Equal(t, replay.Redacted, e.RequestContext.Identity.APIKey)
+	assert.Equal(t, "203.0.113.10", e.RequestContext.Identity.SourceIP)
+
+	// the event passed in is left as it was
+	assert.Equal(t, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", event.Headers["X-Agent-Id"])
+}
+
+func TestRecordAndRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	for _, c := range []replay.Case{
+		{Name: "allowed", Expect: response("Allow")},
+		{Name: "denied", Expect: response("Deny")},
+		{Name: "broken", Expect: response("Deny")},
+	} {
+		c.Event.MethodArn = c.Name
+		assert.NoError(t, replay.Record(dir, c))
+	}
+
+	cases, err := replay.Load(dir)
+	assert.NoError(t, err)
+	assert.Len(t, cases, 3)
+
+	report := replay.Run(context.Background(), func(ctx context.Context, e events.APIGatewayCustomAuthorizerRequestTypeRequest) (events.APIGatewayCustomAuthorizerResponse, error) {
+		if e.MethodArn == "broken" {
+			return events.APIGatewayCustomAuthorizerResponse{}, errors.New("broken")
+		}
+		return response("Allow"), nil
+	}, cases)
+
+	failed := report.Failed()
+	assert.Len(t, failed, 2)
+	assert.Equal(t, "broken", failed[0].Name)
+	assert.Error(t, failed[0].Err)
+	assert.Equal(t, "denied", failed[1].Name)
+	assert.Contains(t, report.String(), "replayed 3, 2 changed\n")
+
+	assert.NoError(t, os.Remove(filepath.Join(dir, "denied"+replay.ExpectSuffix)))
+	_, err = replay.Load(dir)
+	assert.Error(t, err)
+}
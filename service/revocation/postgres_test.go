@@ -0,0 +1,147 @@
+package revocation_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/revocation"
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostgres(t *testing.T) {
+	if os.Getenv("GITHUB_ACTOR") == "" {
+		err := godotenv.Load("../../.env")
+		if err != nil {
+			t.Errorf("godotenv err: %v", err)
+		}
+	}
+	details := store.ConnectDetails{
+		Host:     os.Getenv("DB_HOSTNAME"),
+		Port:     os.Getenv("DB_PORT"),
+		Username: os.Getenv("DB_USERNAME"),
+		Password: os.Getenv("DB_PASSWORD"),
+		Database: os.Getenv("DB_DATABASE"),
+	}
+
+	db, err := sql.Open("postgres", details.DSN())
+	if err != nil {
+		t.Fatalf("db.open: %v", err)
+	}
+	defer func() {
+		err := db.Close()
+		if err != nil {
+			fmt.Printf("db.close: %v", err)
+		}
+	}()
+
+	ctx := context.Background()
+	_, err = db.Exec("INSERT INTO agent (id, name) VALUES ($1, $2)", agentID, "bugfixes test agent -- revocation")
+	if err != nil {
+		t.Fatalf("inject agent err: %v", err)
+	}
+	defer func() {
+		if _, err := db.Exec("DELETE FROM revocation WHERE agent_id = $1", agentID); err != nil {
+			t.Errorf("delete revocation err: %v", err)
+		}
+		if _, err := db.Exec("DELETE FROM agent WHERE id = $1", agentID); err != nil {
+			t.Errorf("delete agent err: %v", err)
+		}
+	}()
+
+	p := revocation.NewPostgres(db)
+	latest, err := p.Latest(ctx)
+	assert.NoError(t, err)
+
+	r, err := p.Revoke(ctx, agentID)
+	assert.NoError(t, err)
+	assert.Greater(t, r.Version, latest)
+	assert.False(t, r.RevokedAt.IsZero())
+
+	rs, err := p.Since(ctx, latest)
+	assert.NoError(t, err)
+	assert.Len(t, rs, 1)
+	assert.Equal(t, agentID, rs[0].AgentID)
+
+	// a new checker looks back by when revocations were made
+	revokedSince := func(at time.Time) []string {
+		rs, err := p.RevokedSince(ctx, at)
+		assert.NoError(t, err)
+		var ids []string
+		for _, r := range rs {
+			ids = append(ids, r.AgentID)
+		}
+		return ids
+	}
+	assert.Contains(t, revokedSince(r.RevokedAt), agentID)
+	assert.NotContains(t, revokedSince(r.RevokedAt.Add(time.Second)), agentID)
+
+	var revokedAt sql.NullTime
+	assert.NoError(t, db.QueryRow("SELECT revoked_at FROM agent WHERE id = $1", agentID).Scan(&revokedAt))
+	assert.True(t, revokedAt.Valid)
+
+	_, err = p.Revoke(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c7f")
+	assert.Error(t, err)
+
+	// a revocation still in flight holds back the one after it, so a container that has
+	// read the later one can't have skipped the earlier
+	first, second := "ad4b99e1-dec8-4682-862a-6b017e7c7c7d", "ad4b99e1-dec8-4682-862a-6b017e7c7c7e"
+	for _, id := range []string{first, second} {
+		if _, err := db.Exec("INSERT INTO agent (id, name) VALUES ($1, $2)", id, "bugfixes test agent -- revocation order"); err != nil {
+			t.Fatalf("inject agent err: %v", err)
+		}
+	}
+	defer func() {
+		for _, id := range []string{first, second} {
+			if _, err := db.Exec("DELETE FROM revocation WHERE agent_id = $1", id); err != nil {
+				t.Errorf("delete revocation err: %v", err)
+			}
+			if _, err := db.Exec("DELETE FROM agent WHERE id = $1", id); err != nil {
+				t.Errorf("delete agent err: %v", err)
+			}
+		}
+	}()
+
+	latest, err = p.Latest(ctx)
+	assert.NoError(t, err)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("begin err: %v", err)
+	}
+	var version int64
+	assert.NoError(t, tx.QueryRow("UPDATE revocation_version SET version = version + 1 RETURNING version").Scan(&version))
+	_, err = tx.Exec("INSERT INTO revocation (version, agent_id, revoked_at) VALUES ($1, $2, now())", version, first)
+	assert.NoError(t, err)
+
+	done := make(chan revocation.Revocation)
+	go func() {
+		r, err := p.Revoke(ctx, second)
+		assert.NoError(t, err)
+		done <- r
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("second revocation committed before the first")
+	case <-time.After(200 * time.Millisecond):
+	}
+	rs, err = p.Since(ctx, latest)
+	assert.NoError(t, err)
+	assert.Empty(t, rs)
+
+	assert.NoError(t, tx.Commit())
+	r = <-done
+	assert.Equal(t, version+1, r.Version)
+
+	rs, err = p.Since(ctx, latest)
+	assert.NoError(t, err)
+	if assert.Len(t, rs, 2) {
+		assert.Equal(t, first, rs[0].AgentID)
+		assert.Equal(t, second, rs[1].AgentID)
+	}
+}
@@ -0,0 +1,111 @@
+package revocation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// versionKey holds the latest version
+const versionKey = "revocation:version"
+
+// StoreEvery is how often, in polls, the store is asked even though redis hasn't moved,
+// so a revocation whose publish was lost is still seen, every 30 seconds by default
+const StoreEvery = 30
+
+// publishScript only ever moves the version forward, so revocations made at the same
+// time can be published in any order, 0 is set when there's no version yet
+var publishScript = redis.NewScript(`
+local version = redis.call('GET', KEYS[1])
+if not version or tonumber(ARGV[1]) > tonumber(version) then
+  redis.call('SET', KEYS[1], ARGV[1])
+end
+return 0`)
+
+// Redis puts the latest version in redis in front of another store, containers poll
+// redis and only ask the store for the revocations once the version has moved. The
+// store is asked directly while redis can't be
+type Redis struct {
+	Store  Store
+	client *redis.Client
+
+	// Every is how often, in polls, the store is asked anyway, 0 for never
+	Every uint32
+	polls uint32
+}
+
+// NewRedis wraps the store, normally the postgres one
+func NewRedis(c *redis.Client, s Store) *Redis {
+	return &Redis{
+		Store:  s,
+		client: c,
+		Every:  StoreEvery,
+	}
+}
+
+// Latest is the version in redis, it's taken from the store when redis doesn't have one
+func (r *Redis) Latest(ctx context.Context) (int64, error) {
+	version, err := r.client.Get(ctx, versionKey).Int64()
+	if err == nil {
+		return version, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		fmt.Printf("revocation redis latest: %v\n", err)
+	}
+
+	version, err = r.Store.Latest(ctx)
+	if err != nil {
+		return 0, err
+	}
+	r.publish(ctx, version)
+	return version, nil
+}
+
+// Since asks the store only when redis has a later version than the one given, or
+// every Every polls in case a publish didn't make it
+func (r *Redis) Since(ctx context.Context, version int64) ([]Revocation, error) {
+	poll := atomic.AddUint32(&r.polls, 1)
+	latest, err := r.client.Get(ctx, versionKey).Int64()
+	if err == nil && latest <= version && (r.Every == 0 || poll%r.Every != 0) {
+		return nil, nil
+	}
+	if err != nil && !errors.Is(err, redis.Nil) {
+		fmt.Printf("revocation redis since: %v\n", err)
+	}
+
+	rs, err := r.Store.Since(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(rs); n > 0 {
+		version = rs[n-1].Version
+	}
+	r.publish(ctx, version)
+	return rs, nil
+}
+
+// RevokedSince is only asked when a checker starts, so it goes straight to the store
+func (r *Redis) RevokedSince(ctx context.Context, t time.Time) ([]Revocation, error) {
+	return r.Store.RevokedSince(ctx, t)
+}
+
+// Revoke revokes in the store and then moves the version on
+func (r *Redis) Revoke(ctx context.Context, agentID string) (Revocation, error) {
+	rev, err := r.Store.Revoke(ctx, agentID)
+	if err != nil {
+		return Revocation{}, err
+	}
+	r.publish(ctx, rev.Version)
+	return rev, nil
+}
+
+// publish moves the version in redis on, a failure is logged as the store has the revocation
+func (r *Redis) publish(ctx context.Context, version int64) {
+	if err := publishScript.Run(ctx, r.client, []string{versionKey}, version).Err(); err != nil {
+		fmt.Printf("revocation redis publish %d: %v\n", version, err)
+	}
+}
@@ -0,0 +1,126 @@
+package revocation_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bugfixes/authorizer/service/revocation"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// counting is a store that counts the polls that reach it
+type counting struct {
+	*revocation.Memory
+	since int
+}
+
+func (c *counting) Since(ctx context.Context, version int64) ([]revocation.Revocation, error) {
+	c.since++
+	return c.Memory.Since(ctx, version)
+}
+
+func TestRedis(t *testing.T) {
+	ctx := context.Background()
+	m := miniredis.RunT(t)
+	c := redis.NewClient(&redis.Options{Addr: m.Addr()})
+
+	s := &counting{Memory: revocation.NewMemory()}
+	_, err := s.Revoke(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c71")
+	assert.NoError(t, err)
+
+	// one container revokes, the other's checker sees it through the version
+	revoker := revocation.NewRedis(c, s)
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	checker := revocation.NewChecker(revocation.NewRedis(c, s), time.Second)
+	checker.Now = func() time.Time {
+		return now
+	}
+	revoked := func() bool {
+		r, err := checker.Revoked(ctx, agentID)
+		assert.NoError(t, err)
+		return r
+	}
+
+	assert.False(t, revoked())
+	assert.Equal(t, int64(1), checker.Version())
+
+	// nothing new, the store isn't asked
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Second)
+		assert.False(t, revoked())
+	}
+	assert.Equal(t, 0, s.since)
+
+	_, err = revoker.Revoke(ctx, agentID)
+	assert.NoError(t, err)
+	now = now.Add(time.Second)
+	assert.True(t, revoked())
+	assert.Equal(t, int64(2), checker.Version())
+	assert.Equal(t, 1, s.since)
+
+	// an older version published late doesn't move it back
+	_, err = revocation.NewRedis(c, &late{Memory: revocation.NewMemory()}).Revoke(ctx, agentID)
+	assert.NoError(t, err)
+	v, err := m.Get("revocation:version")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", v)
+}
+
+// late is a store whose revocations all come out as the first, as one whose publish
+// was held up until after the next
+type late struct {
+	*revocation.Memory
+}
+
+func (l *late) Revoke(ctx context.Context, agentID string) (revocation.Revocation, error) {
+	return revocation.Revocation{Version: 1, AgentID: agentID}, nil
+}
+
+func TestRedisLostPublish(t *testing.T) {
+	ctx := context.Background()
+	m := miniredis.RunT(t)
+	s := &counting{Memory: revocation.NewMemory()}
+	r := revocation.NewRedis(redis.NewClient(&redis.Options{Addr: m.Addr()}), s)
+	r.Every = 3
+
+	latest, err := r.Latest(ctx)
+	assert.NoError(t, err)
+
+	// revoked without the version moving in redis, as when the revoker couldn't reach it
+	_, err = s.Revoke(ctx, agentID)
+	assert.NoError(t, err)
+
+	var rs []revocation.Revocation
+	for i := 0; i < 3; i++ {
+		rs, err = r.Since(ctx, latest)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, s.since)
+	if assert.Len(t, rs, 1) {
+		assert.Equal(t, agentID, rs[0].AgentID)
+	}
+	v, err := m.Get("revocation:version")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", v)
+}
+
+func TestRedisDown(t *testing.T) {
+	ctx := context.Background()
+	s := &counting{Memory: revocation.NewMemory()}
+	r := revocation.NewRedis(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"}), s)
+
+	// the store is asked directly
+	rev, err := r.Revoke(ctx, agentID)
+	assert.NoError(t, err)
+	latest, err := r.Latest(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, rev.Version, latest)
+
+	rs, err := r.Since(ctx, 0)
+	assert.NoError(t, err)
+	assert.Len(t, rs, 1)
+	assert.Equal(t, 1, s.since)
+}
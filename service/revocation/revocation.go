@@ -0,0 +1,124 @@
+package revocation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is how often a container asks for new revocations
+const DefaultInterval = time.Second
+
+// Revocation is an agent whose credentials were revoked, Version goes up by one for each
+type Revocation struct {
+	Version   int64
+	AgentID   string
+	RevokedAt time.Time
+}
+
+// Store records revocations and hands out the ones a container hasn't seen
+type Store interface {
+	// Latest is the version of the last revocation, 0 when there hasn't been one
+	Latest(ctx context.Context) (int64, error)
+
+	// Since is every revocation after the version, oldest first
+	Since(ctx context.Context, version int64) ([]Revocation, error)
+
+	// RevokedSince is every revocation made at or after t, oldest first
+	RevokedSince(ctx context.Context, t time.Time) ([]Revocation, error)
+
+	// Revoke stops the agent's credentials working
+	Revoke(ctx context.Context, agentID string) (Revocation, error)
+}
+
+// Checker keeps the agents revoked since the container started, so an agent that was
+// looked up before it was revoked, and kept, is still turned away within Interval
+type Checker struct {
+	Store    Store
+	Interval time.Duration
+	Now      func() time.Time
+
+	// Lookback is how far back a new checker reads revocations, for agents looked up
+	// before it started and kept somewhere it can't see, like the shared identity cache
+	Lookback time.Duration
+
+	mu      sync.Mutex
+	started bool
+	version int64
+	checked time.Time
+	revoked map[string]time.Time
+}
+
+// NewChecker polls the store at most once an interval
+func NewChecker(s Store, interval time.Duration) *Checker {
+	return &Checker{
+		Store:    s,
+		Interval: interval,
+		Now:      time.Now,
+		revoked:  map[string]time.Time{},
+	}
+}
+
+// Revoked is whether the agent has been revoked, if the store can't be asked the
+// agents already known about are still revoked and the error says it may be stale
+func (c *Checker) Revoked(ctx context.Context, agentID string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.refresh(ctx)
+	_, revoked := c.revoked[agentID]
+	return revoked, err
+}
+
+// Version is the last revocation the checker has seen
+func (c *Checker) Version() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.version
+}
+
+func (c *Checker) refresh(ctx context.Context) error {
+	now := c.Now()
+	if c.started && now.Sub(c.checked) < c.Interval {
+		return nil
+	}
+
+	// a new container starts at the latest version, anything revoked before it was
+	// started is already marked revoked in the store, but an agent cached before then
+	// isn't, so the revocations within Lookback are read as well
+	if !c.started {
+		v, err := c.Store.Latest(ctx)
+		if err != nil {
+			return fmt.Errorf("revocation latest: %w", err)
+		}
+		if c.Lookback > 0 {
+			rs, err := c.Store.RevokedSince(ctx, now.Add(-c.Lookback))
+			if err != nil {
+				return fmt.Errorf("revocation revoked since: %w", err)
+			}
+			for _, r := range rs {
+				c.revoked[r.AgentID] = r.RevokedAt
+			}
+		}
+		c.version = v
+		c.started = true
+		c.checked = now
+		return nil
+	}
+
+	rs, err := c.Store.Since(ctx, c.version)
+	if err != nil {
+		return fmt.Errorf("revocation since %d: %w", c.version, err)
+	}
+	for _, r := range rs {
+		c.revoked[r.AgentID] = r.RevokedAt
+		if r.Version > c.version {
+			c.version = r.Version
+		}
+	}
+	c.checked = now
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package revocation_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/revocation"
+	"github.com/stretchr/testify/assert"
+)
+
+const agentID = "ad4b99e1-dec8-4682-862a-6b017e7c7c70"
+
+// failing is a store that can be switched off
+type failing struct {
+	*revocation.Memory
+	down bool
+}
+
+func (f *failing) Since(ctx context.Context, version int64) ([]revocation.Revocation, error) {
+	if f.down {
+		return nil, errors.New("connection refused")
+	}
+	return f.Memory.Since(ctx, version)
+}
+
+func TestChecker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	s := &failing{Memory: revocation.NewMemory()}
+
+	// revoked before the container started, the store marks the agent itself
+	_, err := s.Revoke(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c71")
+	assert.NoError(t, err)
+
+	c := revocation.NewChecker(s, time.Second)
+	c.Now = func() time.Time {
+		return now
+	}
+	revoked := func(id string) bool {
+		r, err := c.Revoked(ctx, id)
+		assert.NoError(t, err)
+		return r
+	}
+
+	assert.False(t, revoked(agentID))
+	assert.False(t, revoked("ad4b99e1-dec8-4682-862a-6b017e7c7c71"))
+	assert.Equal(t, int64(1), c.Version())
+
+	// picked up on the next poll, not before
+	_, err = s.Revoke(ctx, agentID)
+	assert.NoError(t, err)
+	now = now.Add(500 * time.Millisecond)
+	assert.False(t, revoked(agentID))
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, revoked(agentID))
+	assert.Equal(t, int64(2), c.Version())
+
+	// known revocations hold while the store is down
+	s.down = true
+	now = now.Add(time.Second)
+	r, err := c.Revoked(ctx, agentID)
+	assert.Error(t, err)
+	assert.True(t, r)
+}
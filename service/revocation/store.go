@@ -0,0 +1,189 @@
+package revocation
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Postgres marks the agent revoked and numbers each revocation in the revocation table,
+// the number comes from the revocation_version row so revocations commit in order
+type Postgres struct {
+	db *sql.DB
+}
+
+// NewPostgres uses an open pool, normally the one the store has
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{
+		db: db,
+	}
+}
+
+// Latest is the highest version in the revocation table
+func (p *Postgres) Latest(ctx context.Context) (int64, error) {
+	var version int64
+	if err := p.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM revocation").Scan(&version); err != nil {
+		return 0, fmt.Errorf("revocation postgres latest: %w", err)
+	}
+
+	return version, nil
+}
+
+// Since reads the revocations after the version
+func (p *Postgres) Since(ctx context.Context, version int64) ([]Revocation, error) {
+	rows, err := p.db.QueryContext(ctx, `
+SELECT version, agent_id, revoked_at
+FROM revocation
+WHERE version > $1
+ORDER BY version`, version)
+	if err != nil {
+		return nil, fmt.Errorf("revocation postgres since: %w", err)
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			fmt.Printf("revocation postgres rows.close: %v\n", err)
+		}
+	}()
+
+	var rs []Revocation
+	for rows.Next() {
+		r := Revocation{}
+		if err := rows.Scan(&r.Version, &r.AgentID, &r.RevokedAt); err != nil {
+			return nil, fmt.Errorf("revocation postgres scan: %w", err)
+		}
+		rs = append(rs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("revocation postgres rows: %w", err)
+	}
+
+	return rs, nil
+}
+
+// RevokedSince reads the revocations made at or after t
+func (p *Postgres) RevokedSince(ctx context.Context, t time.Time) ([]Revocation, error) {
+	rows, err := p.db.QueryContext(ctx, `
+SELECT version, agent_id, revoked_at
+FROM revocation
+WHERE revoked_at >= $1
+ORDER BY version`, t)
+	if err != nil {
+		return nil, fmt.Errorf("revocation postgres revoked since: %w", err)
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			fmt.Printf("revocation postgres rows.close: %v\n", err)
+		}
+	}()
+
+	var rs []Revocation
+	for rows.Next() {
+		r := Revocation{}
+		if err := rows.Scan(&r.Version, &r.AgentID, &r.RevokedAt); err != nil {
+			return nil, fmt.Errorf("revocation postgres scan: %w", err)
+		}
+		rs = append(rs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("revocation postgres rows: %w", err)
+	}
+
+	return rs, nil
+}
+
+// Revoke sets revoked_at on the agent and adds the revocation in one transaction, the
+// version row stays locked until it commits so the next revocation waits for it
+func (p *Postgres) Revoke(ctx context.Context, agentID string) (Revocation, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Revocation{}, fmt.Errorf("revocation postgres begin: %w", err)
+	}
+
+	r := Revocation{
+		AgentID: agentID,
+	}
+	err = tx.QueryRowContext(ctx, "UPDATE agent SET revoked_at = COALESCE(revoked_at, now()) WHERE id = $1 RETURNING revoked_at", agentID).Scan(&r.RevokedAt)
+	if err == nil {
+		err = tx.QueryRowContext(ctx, "UPDATE revocation_version SET version = version + 1 RETURNING version").Scan(&r.Version)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "INSERT INTO revocation (version, agent_id, revoked_at) VALUES ($1, $2, $3)", r.Version, agentID, r.RevokedAt)
+	}
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			fmt.Printf("revocation postgres rollback: %v\n", rbErr)
+		}
+		if err == sql.ErrNoRows {
+			return Revocation{}, fmt.Errorf("revocation postgres revoke: unknown agent: %s", agentID)
+		}
+		return Revocation{}, fmt.Errorf("revocation postgres revoke: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Revocation{}, fmt.Errorf("revocation postgres commit: %w", err)
+	}
+	return r, nil
+}
+
+// Memory keeps the revocations in the container, for tests and the fixture store
+type Memory struct {
+	Revocations []Revocation
+
+	mu sync.Mutex
+}
+
+// NewMemory is an empty store
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Latest is the version of the last revocation
+func (m *Memory) Latest(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return int64(len(m.Revocations)), nil
+}
+
+// Since is the revocations after the version
+func (m *Memory) Since(ctx context.Context, version int64) ([]Revocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if version >= int64(len(m.Revocations)) {
+		return nil, nil
+	}
+	return append([]Revocation(nil), m.Revocations[version:]...), nil
+}
+
+// RevokedSince is the revocations made at or after t
+func (m *Memory) RevokedSince(ctx context.Context, t time.Time) ([]Revocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rs []Revocation
+	for _, r := range m.Revocations {
+		if !r.RevokedAt.Before(t) {
+			rs = append(rs, r)
+		}
+	}
+	return rs, nil
+}
+
+// Revoke adds the revocation
+func (m *Memory) Revoke(ctx context.Context, agentID string) (Revocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := Revocation{
+		Version:   int64(len(m.Revocations)) + 1,
+		AgentID:   agentID,
+		RevokedAt: time.Now(),
+	}
+	m.Revocations = append(m.Revocations, r)
+	return r, nil
+}
@@ -0,0 +1,86 @@
+package role
+
+import (
+	"sort"
+
+	"github.com/bugfixes/authorizer/service/policy"
+)
+
+// Built in roles, seeded by .ci/dev/structure.sql
+const (
+	Ingest       = "ingest"
+	Dashboard    = "dashboard"
+	CompanyAdmin = "company-admin"
+	Operator     = "operator"
+)
+
+// Role is a named set of routes, plus the routes of every role it inherits
+type Role struct {
+	Name        string
+	Inherits    []string
+	Permissions []policy.Route
+}
+
+// Roles is every known role by name
+type Roles map[string]Role
+
+// Resolve collects the routes for the named roles and everything they inherit,
+// unknown is any role name that has no definition
+func (rs Roles) Resolve(names ...string) (routes []policy.Route, unknown []string) {
+	seen := map[string]bool{}
+	queue := append([]string{}, names...)
+
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		r, ok := rs[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+
+		for _, p := range r.Permissions {
+			routes = appendRoute(routes, p)
+		}
+		queue = append(queue, r.Inherits...)
+	}
+
+	sort.Strings(unknown)
+	return routes, unknown
+}
+
+// Add merges a role into the set, used when roles are loaded a row at a time
+func (rs Roles) Add(name, inherits string, permission *policy.Route) {
+	r := rs[name]
+	r.Name = name
+	if inherits != "" {
+		r.Inherits = appendName(r.Inherits, inherits)
+	}
+	if permission != nil {
+		r.Permissions = appendRoute(r.Permissions, *permission)
+	}
+	rs[name] = r
+}
+
+func appendRoute(routes []policy.Route, route policy.Route) []policy.Route {
+	for _, r := range routes {
+		if r == route {
+			return routes
+		}
+	}
+	return append(routes, route)
+}
+
+func appendName(names []string, name string) []string {
+	for _, n := range names {
+		if n == name {
+			return names
+		}
+	}
+	return append(names, name)
+}
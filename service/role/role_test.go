@@ -0,0 +1,104 @@
+package role_test
+
+import (
+	"testing"
+
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/bugfixes/authorizer/service/role"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRoles() role.Roles {
+	rs := role.Roles{}
+	rs.Add(role.Ingest, "", &policy.Route{Verb: "POST", Resource: "bug"})
+	rs.Add(role.Ingest, "", &policy.Route{Verb: "POST", Resource: "log"})
+	rs.Add(role.Dashboard, "", &policy.Route{Verb: "GET", Resource: "bug/*"})
+	rs.Add(role.CompanyAdmin, role.Ingest, nil)
+	rs.Add(role.CompanyAdmin, role.Dashboard, &policy.Route{Verb: "*", Resource: "agent/*"})
+	rs.Add(role.Operator, role.CompanyAdmin, &policy.Route{Verb: "*", Resource: "admin/*"})
+
+	// loops shouldn't be possible, but shouldn't hang either
+	rs.Add("loop-a", "loop-b", &policy.Route{Verb: "GET", Resource: "a"})
+	rs.Add("loop-b", "loop-a", &policy.Route{Verb: "GET", Resource: "b"})
+
+	return rs
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		roles   []string
+		expect  []policy.Route
+		unknown []string
+	}{
+		{
+			name:  "ingest only",
+			roles: []string{role.Ingest},
+			expect: []policy.Route{
+				{Verb: "POST", Resource: "bug"},
+				{Verb: "POST", Resource: "log"},
+			},
+		},
+		{
+			name:  "company admin inherits ingest and dashboard",
+			roles: []string{role.CompanyAdmin},
+			expect: []policy.Route{
+				{Verb: "*", Resource: "agent/*"},
+				{Verb: "POST", Resource: "bug"},
+				{Verb: "POST", Resource: "log"},
+				{Verb: "GET", Resource: "bug/*"},
+			},
+		},
+		{
+			name:  "operator inherits through company admin",
+			roles: []string{role.Operator},
+			expect: []policy.Route{
+				{Verb: "*", Resource: "admin/*"},
+				{Verb: "*", Resource: "agent/*"},
+				{Verb: "POST", Resource: "bug"},
+				{Verb: "POST", Resource: "log"},
+				{Verb: "GET", Resource: "bug/*"},
+			},
+		},
+		{
+			name:  "overlapping roles",
+			roles: []string{role.Ingest, role.CompanyAdmin},
+			expect: []policy.Route{
+				{Verb: "POST", Resource: "bug"},
+				{Verb: "POST", Resource: "log"},
+				{Verb: "*", Resource: "agent/*"},
+				{Verb: "GET", Resource: "bug/*"},
+			},
+		},
+		{
+			name:  "inheritance loop",
+			roles: []string{"loop-a"},
+			expect: []policy.Route{
+				{Verb: "GET", Resource: "a"},
+				{Verb: "GET", Resource: "b"},
+			},
+		},
+		{
+			name:    "unknown role",
+			roles:   []string{"nobody", role.Ingest},
+			unknown: []string{"nobody"},
+			expect: []policy.Route{
+				{Verb: "POST", Resource: "bug"},
+				{Verb: "POST", Resource: "log"},
+			},
+		},
+		{
+			name:  "no roles",
+			roles: []string{},
+		},
+	}
+
+	rs := testRoles()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			routes, unknown := rs.Resolve(test.roles...)
+			assert.Equal(t, test.expect, routes)
+			assert.Equal(t, test.unknown, unknown)
+		})
+	}
+}
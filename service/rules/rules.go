@@ -0,0 +1,337 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/ipfilter"
+	"github.com/bugfixes/authorizer/service/policy"
+)
+
+// Effects a rule can have
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// File is the policy file, rules are checked in order and the first match wins
+type File struct {
+	Default string `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Rule is a single entry in the policy file
+type Rule struct {
+	Name    string                 `json:"name"`
+	Effect  string                 `json:"effect"`
+	Match   Match                  `json:"match"`
+	Context map[string]interface{} `json:"context,omitempty"`
+}
+
+// Match is what a request must look like for the rule to apply, every field
+// that's set has to match and a field with a list matches any entry in it
+type Match struct {
+	// Principal is attribute name to patterns, e.g. {"roles": ["ingest"]}
+	Principal map[string][]string `json:"principal,omitempty"`
+	Company   []string            `json:"company,omitempty"`
+	Routes    []string            `json:"routes,omitempty"`
+	Verbs     []string            `json:"verbs,omitempty"`
+	SourceIP  []string            `json:"sourceIp,omitempty"`
+	Time      *TimeWindow         `json:"time,omitempty"`
+
+	// Entitled matches on whether the roles and scopes of the principal cover the route
+	Entitled *bool `json:"entitled,omitempty"`
+}
+
+// TimeWindow limits a rule to days of the week and a time of day, From and To are "15:04"
+type TimeWindow struct {
+	Days     []string `json:"days,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       string   `json:"to,omitempty"`
+	Location string   `json:"location,omitempty"`
+}
+
+// Input is the request as the rules see it
+type Input struct {
+	Principal map[string][]string
+	Company   string
+	Verb      string
+	Resource  string
+	SourceIP  string
+	Time      time.Time
+	Entitled  bool
+}
+
+// Decision is the outcome, Rule is empty when nothing matched and the default was used
+type Decision struct {
+	Effect  string
+	Rule    string
+	Context map[string]interface{}
+}
+
+// Allowed is true when the decision lets the request through
+func (d Decision) Allowed() bool {
+	return d.Effect == Allow
+}
+
+// Engine holds the compiled rules
+type Engine struct {
+	def   string
+	rules []compiled
+}
+
+type compiled struct {
+	Rule
+	routes []policy.Route
+	verbs  []string
+	nets   []*net.IPNet
+	days   map[time.Weekday]bool
+	from   int
+	to     int
+	loc    *time.Location
+}
+
+// Load reads and compiles a policy file
+func Load(path string) (*Engine, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("rules load: %w", err)
+	}
+
+	return Parse(b)
+}
+
+// Parse compiles a policy file already in memory
+func Parse(b []byte) (*Engine, error) {
+	f := File{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("rules parse: %w", err)
+	}
+
+	return Compile(f)
+}
+
+// Compile checks the rules and does the parsing up front so evaluating is cheap
+func Compile(f File) (*Engine, error) {
+	e := &Engine{
+		def: strings.ToLower(f.Default),
+	}
+	if e.def == "" {
+		e.def = Deny
+	}
+	if e.def != Allow && e.def != Deny {
+		return nil, fmt.Errorf("rules compile: unknown default effect: %s", f.Default)
+	}
+
+	for i, r := range f.Rules {
+		c, err := compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("rules compile rule %d %q: %w", i, r.Name, err)
+		}
+		e.rules = append(e.rules, c)
+	}
+
+	return e, nil
+}
+
+func compile(r Rule) (compiled, error) {
+	c := compiled{
+		Rule: r,
+	}
+
+	c.Effect = strings.ToLower(r.Effect)
+	if c.Effect != Allow && c.Effect != Deny {
+		return c, fmt.Errorf("unknown effect: %s", r.Effect)
+	}
+
+	for k, v := range r.Context {
+		switch v.(type) {
+		case string, float64, bool:
+		default:
+			return c, fmt.Errorf("context %s: only strings, numbers and booleans can be passed on", k)
+		}
+	}
+
+	for _, s := range r.Match.Routes {
+		route, err := policy.ParseRoute(s)
+		if err != nil {
+			return c, err
+		}
+		c.routes = append(c.routes, route)
+	}
+
+	for _, v := range r.Match.Verbs {
+		c.verbs = append(c.verbs, strings.ToUpper(v))
+	}
+
+	for _, s := range r.Match.SourceIP {
+		n, err := ipfilter.ParseNet(s)
+		if err != nil {
+			return c, err
+		}
+		c.nets = append(c.nets, n)
+	}
+
+	if r.Match.Time != nil {
+		if err := c.compileTime(*r.Match.Time); err != nil {
+			return c, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *compiled) compileTime(w TimeWindow) error {
+	c.loc = time.UTC
+	if w.Location != "" {
+		loc, err := time.LoadLocation(w.Location)
+		if err != nil {
+			return fmt.Errorf("time location: %w", err)
+		}
+		c.loc = loc
+	}
+
+	if len(w.Days) > 0 {
+		c.days = map[time.Weekday]bool{}
+		for _, d := range w.Days {
+			day, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return fmt.Errorf("unknown day: %s", d)
+			}
+			c.days[day] = true
+		}
+	}
+
+	c.from, c.to = 0, 24*60
+	if w.From != "" {
+		t, err := time.Parse("15:04", w.From)
+		if err != nil {
+			return fmt.Errorf("time from: %w", err)
+		}
+		c.from = t.Hour()*60 + t.Minute()
+	}
+	if w.To != "" {
+		t, err := time.Parse("15:04", w.To)
+		if err != nil {
+			return fmt.Errorf("time to: %w", err)
+		}
+		c.to = t.Hour()*60 + t.Minute()
+	}
+
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Evaluate runs the input through the rules and returns the first match
+func (e *Engine) Evaluate(in Input) Decision {
+	for _, r := range e.rules {
+		if r.matches(in) {
+			return Decision{
+				Effect:  r.Effect,
+				Rule:    r.Name,
+				Context: r.Context,
+			}
+		}
+	}
+
+	return Decision{
+		Effect: e.def,
+	}
+}
+
+func (c compiled) matches(in Input) bool {
+	m := c.Match
+
+	if m.Entitled != nil && *m.Entitled != in.Entitled {
+		return false
+	}
+
+	for attr, patterns := range m.Principal {
+		if !anyMatch(patterns, in.Principal[attr]) {
+			return false
+		}
+	}
+
+	if len(m.Company) > 0 && !anyMatch(m.Company, []string{in.Company}) {
+		return false
+	}
+
+	if len(c.verbs) > 0 && !anyMatch(c.verbs, []string{strings.ToUpper(in.Verb)}) {
+		return false
+	}
+
+	if len(c.routes) > 0 {
+		matched := false
+		for _, r := range c.routes {
+			if r.Matches(in.Verb, in.Resource) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(c.nets) > 0 {
+		ip := net.ParseIP(in.SourceIP)
+		if ip == nil {
+			return false
+		}
+		matched := false
+		for _, n := range c.nets {
+			if n.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if m.Time != nil && !c.inWindow(in.Time) {
+		return false
+	}
+
+	return true
+}
+
+func (c compiled) inWindow(t time.Time) bool {
+	t = t.In(c.loc)
+	if c.days != nil && !c.days[t.Weekday()] {
+		return false
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	if c.from <= c.to {
+		return minute >= c.from && minute < c.to
+	}
+
+	// windows like 22:00 to 06:00 wrap midnight
+	return minute >= c.from || minute < c.to
+}
+
+func anyMatch(patterns, values []string) bool {
+	for _, p := range patterns {
+		for _, v := range values {
+			if policy.Glob(p, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
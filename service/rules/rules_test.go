@@ -0,0 +1,212 @@
+package rules_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/rules"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluate(t *testing.T) {
+	e, err := rules.Load("../../policies/example.json")
+	if err != nil {
+		t.Fatalf("load example: %v", err)
+	}
+
+	// a tuesday, 10:00 in london
+	officeHours := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	lateNight := time.Date(2021, time.March, 16, 23, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		input  rules.Input
+		expect rules.Decision
+	}{
+		{
+			name: "abusive network beats everything",
+			input: rules.Input{
+				Principal: map[string][]string{"roles": {"operator"}},
+				Verb:      "POST",
+				Resource:  "bug",
+				SourceIP:  "203.0.113.7",
+				Time:      officeHours,
+				Entitled:  true,
+			},
+			expect: rules.Decision{
+				Effect:  rules.Deny,
+				Rule:    "block abusive network",
+				Context: map[string]interface{}{"reason": "network"},
+			},
+		},
+		{
+			name: "operator admin from the office ipv4",
+			input: rules.Input{
+				Principal: map[string][]string{"roles": {"company-admin", "operator"}},
+				Verb:      "DELETE",
+				Resource:  "admin/company/1234",
+				SourceIP:  "198.51.100.20",
+				Time:      lateNight,
+			},
+			expect: rules.Decision{
+				Effect: rules.Allow,
+				Rule:   "operators from the office",
+			},
+		},
+		{
+			name: "operator admin from the office ipv6",
+			input: rules.Input{
+				Principal: map[string][]string{"roles": {"operator"}},
+				Verb:      "GET",
+				Resource:  "admin/company",
+				SourceIP:  "2001:db8::1",
+				Time:      lateNight,
+			},
+			expect: rules.Decision{
+				Effect: rules.Allow,
+				Rule:   "operators from the office",
+			},
+		},
+		{
+			name: "operator admin from home",
+			input: rules.Input{
+				Principal: map[string][]string{"roles": {"operator"}},
+				Verb:      "GET",
+				Resource:  "admin/company",
+				SourceIP:  "192.0.2.1",
+				Time:      officeHours,
+				Entitled:  true,
+			},
+			expect: rules.Decision{
+				Effect: rules.Deny,
+				Rule:   "no admin otherwise",
+			},
+		},
+		{
+			name: "dashboard in office hours",
+			input: rules.Input{
+				Principal: map[string][]string{"roles": {"dashboard"}},
+				Verb:      "get",
+				Resource:  "bug/1234",
+				SourceIP:  "192.0.2.1",
+				Time:      officeHours,
+				Entitled:  true,
+			},
+			expect: rules.Decision{
+				Effect: rules.Allow,
+				Rule:   "dashboard in office hours",
+			},
+		},
+		{
+			name: "dashboard late at night",
+			input: rules.Input{
+				Principal: map[string][]string{"roles": {"dashboard"}},
+				Verb:      "GET",
+				Resource:  "bug/1234",
+				SourceIP:  "192.0.2.1",
+				Time:      lateNight,
+				Entitled:  true,
+			},
+			expect: rules.Decision{
+				Effect:  rules.Deny,
+				Rule:    "dashboard out of hours",
+				Context: map[string]interface{}{"reason": "out of hours"},
+			},
+		},
+		{
+			name: "ingest entitled",
+			input: rules.Input{
+				Principal: map[string][]string{"roles": {"ingest"}},
+				Verb:      "POST",
+				Resource:  "bug",
+				SourceIP:  "192.0.2.1",
+				Time:      lateNight,
+				Entitled:  true,
+			},
+			expect: rules.Decision{
+				Effect: rules.Allow,
+				Rule:   "entitled",
+			},
+		},
+		{
+			name: "nothing matches",
+			input: rules.Input{
+				Principal: map[string][]string{"roles": {"ingest"}},
+				Verb:      "GET",
+				Resource:  "bug",
+				SourceIP:  "192.0.2.1",
+				Time:      lateNight,
+			},
+			expect: rules.Decision{
+				Effect: rules.Deny,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := e.Evaluate(test.input)
+			assert.Equal(t, test.expect, d)
+			assert.Equal(t, test.expect.Effect == rules.Allow, d.Allowed())
+		})
+	}
+}
+
+func TestTimeWindowWrapsMidnight(t *testing.T) {
+	e, err := rules.Compile(rules.File{
+		Default: "allow",
+		Rules: []rules.Rule{
+			{
+				Name:   "maintenance",
+				Effect: "deny",
+				Match: rules.Match{
+					Time: &rules.TimeWindow{From: "22:00", To: "02:00"},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.False(t, e.Evaluate(rules.Input{Time: time.Date(2021, 3, 16, 23, 30, 0, 0, time.UTC)}).Allowed())
+	assert.False(t, e.Evaluate(rules.Input{Time: time.Date(2021, 3, 17, 1, 59, 0, 0, time.UTC)}).Allowed())
+	assert.True(t, e.Evaluate(rules.Input{Time: time.Date(2021, 3, 17, 2, 0, 0, 0, time.UTC)}).Allowed())
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{
+			name:    "bad effect",
+			request: `{"rules": [{"name": "x", "effect": "maybe"}]}`,
+		},
+		{
+			name:    "bad default",
+			request: `{"default": "maybe"}`,
+		},
+		{
+			name:    "bad route",
+			request: `{"rules": [{"name": "x", "effect": "allow", "match": {"routes": ["/bug"]}}]}`,
+		},
+		{
+			name:    "bad cidr",
+			request: `{"rules": [{"name": "x", "effect": "allow", "match": {"sourceIp": ["10.0.0.0/99"]}}]}`,
+		},
+		{
+			name:    "bad day",
+			request: `{"rules": [{"name": "x", "effect": "allow", "match": {"time": {"days": ["someday"]}}}]}`,
+		},
+		{
+			name:    "nested context",
+			request: `{"rules": [{"name": "x", "effect": "allow", "context": {"a": {"b": 1}}}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := rules.Parse([]byte(test.request))
+			assert.Error(t, err)
+		})
+	}
+}
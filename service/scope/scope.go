@@ -0,0 +1,81 @@
+package scope
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/bugfixes/authorizer/service/policy"
+)
+
+// Scopes a key can be narrowed to
+const (
+	BugWrite   = "bug:write"
+	BugRead    = "bug:read"
+	LogWrite   = "log:write"
+	LogRead    = "log:read"
+	AgentAdmin = "agent:admin"
+)
+
+// Mapping is the routes each scope grants
+type Mapping map[string][]policy.Route
+
+// DefaultMapping is used when SCOPE_ROUTES isn't set
+func DefaultMapping() Mapping {
+	return Mapping{
+		BugWrite: {
+			policy.NewRoute("POST", "/bug"),
+		},
+		BugRead: {
+			policy.NewRoute("GET", "/bug"),
+			policy.NewRoute("GET", "/bug/*"),
+		},
+		LogWrite: {
+			policy.NewRoute("POST", "/log"),
+		},
+		LogRead: {
+			policy.NewRoute("GET", "/log"),
+			policy.NewRoute("GET", "/log/*"),
+		},
+		AgentAdmin: {
+			policy.NewRoute(policy.Wildcard, "/agent"),
+			policy.NewRoute(policy.Wildcard, "/agent/*"),
+		},
+	}
+}
+
+// ParseMapping reads a mapping written as {"bug:write": ["POST /bug"]}
+func ParseMapping(s string) (Mapping, error) {
+	raw := map[string][]string{}
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, fmt.Errorf("parse scope mapping: %w", err)
+	}
+
+	m := Mapping{}
+	for name, routes := range raw {
+		for _, r := range routes {
+			route, err := policy.ParseRoute(r)
+			if err != nil {
+				return nil, fmt.Errorf("parse scope mapping %s: %w", name, err)
+			}
+			m[name] = append(m[name], route)
+		}
+	}
+
+	return m, nil
+}
+
+// Routes collects the routes granted by the scopes, unknown is any scope not in the mapping
+func (m Mapping) Routes(scopes ...string) (routes []policy.Route, unknown []string) {
+	for _, s := range scopes {
+		r, ok := m[s]
+		if !ok {
+			unknown = append(unknown, s)
+			continue
+		}
+		routes = append(routes, r...)
+	}
+
+	sort.Strings(unknown)
+	return routes, unknown
+}
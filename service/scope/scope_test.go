@@ -0,0 +1,60 @@
+package scope_test
+
+import (
+	"testing"
+
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/bugfixes/authorizer/service/scope"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		expect  scope.Mapping
+		err     bool
+	}{
+		{
+			name:    "crash reports only",
+			request: `{"crash:write": ["POST /bug", "POST /bug/*/attachment"]}`,
+			expect: scope.Mapping{
+				"crash:write": {
+					{Verb: "POST", Resource: "bug"},
+					{Verb: "POST", Resource: "bug/*/attachment"},
+				},
+			},
+		},
+		{
+			name:    "bad route",
+			request: `{"crash:write": ["POST"]}`,
+			err:     true,
+		},
+		{
+			name:    "bad json",
+			request: `["POST /bug"]`,
+			err:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := scope.ParseMapping(test.request)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expect, resp)
+		})
+	}
+}
+
+func TestMappingRoutes(t *testing.T) {
+	routes, unknown := scope.DefaultMapping().Routes(scope.BugWrite, scope.LogWrite, "bug:delete")
+	assert.Equal(t, []policy.Route{
+		{Verb: "POST", Resource: "bug"},
+		{Verb: "POST", Resource: "log"},
+	}, routes)
+	assert.Equal(t, []string{"bug:delete"}, unknown)
+}
@@ -0,0 +1,205 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/role"
+)
+
+// ErrCircuitOpen is returned without asking the store while the breaker is open
+var ErrCircuitOpen = errors.New("store circuit open")
+
+// Breaker states, closed lets calls through, open turns them away until the cool-down
+// is up and half-open lets probes through to see if the store has recovered
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BreakerOptions tune the breaker, zero values take the defaults
+type BreakerOptions struct {
+	// Failures is how many calls in a row have to fail to open the breaker
+	Failures int
+
+	// CoolDown is how long the breaker stays open before a probe is let through
+	CoolDown time.Duration
+
+	// Successes is how many probes in a row have to work to close it again
+	Successes int
+}
+
+// Breaker defaults
+const (
+	DefaultBreakerFailures  = 5
+	DefaultBreakerCoolDown  = 10 * time.Second
+	DefaultBreakerSuccesses = 1
+)
+
+// BreakerStats count what the breaker has done since the container started
+type BreakerStats struct {
+	State    string
+	Failures int64
+	Rejected int64
+	Opened   int64
+}
+
+// Breaker stops calling a store that keeps failing, so a struggling database isn't
+// sent every invocation to wait out a connect timeout on. ErrNotFound is an answer
+// rather than a failure, and a caller giving up isn't the store's fault
+type Breaker struct {
+	Store   Store
+	Options BreakerOptions
+	Now     func() time.Time
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	successes int
+	probing   bool
+	openedAt  time.Time
+	stats     BreakerStats
+}
+
+// NewBreaker wraps the store, closed
+func NewBreaker(s Store, o BreakerOptions) *Breaker {
+	if o.Failures <= 0 {
+		o.Failures = DefaultBreakerFailures
+	}
+	if o.CoolDown <= 0 {
+		o.CoolDown = DefaultBreakerCoolDown
+	}
+	if o.Successes <= 0 {
+		o.Successes = DefaultBreakerSuccesses
+	}
+
+	return &Breaker{
+		Store:   s,
+		Options: o,
+		Now:     time.Now,
+		state:   BreakerClosed,
+	}
+}
+
+// FindAgent asks the store unless the breaker is open
+func (b *Breaker) FindAgent(ctx context.Context, creds Credentials) (Agent, error) {
+	if err := b.allow(); err != nil {
+		return Agent{}, err
+	}
+
+	a, err := b.Store.FindAgent(ctx, creds)
+	b.record(ctx, err)
+	return a, err
+}
+
+// Roles asks the store unless the breaker is open
+func (b *Breaker) Roles(ctx context.Context) (role.Roles, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+
+	r, err := b.Store.Roles(ctx)
+	b.record(ctx, err)
+	return r, err
+}
+
+// State is closed, open or half-open
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// Stats is a snapshot of the counts
+func (b *Breaker) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.stats
+	s.State = b.state
+	return s
+}
+
+// allow is whether a call can go through, once the cool-down is up the breaker goes
+// half-open and lets one probe through at a time
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && !b.Now().Before(b.openedAt.Add(b.Options.CoolDown)) {
+		b.transition(BreakerHalfOpen)
+	}
+
+	switch {
+	case b.state == BreakerOpen, b.state == BreakerHalfOpen && b.probing:
+		b.stats.Rejected++
+		return ErrCircuitOpen
+	case b.state == BreakerHalfOpen:
+		b.probing = true
+	}
+	return nil
+}
+
+// record counts the outcome of a call that went through, a call its caller gave up on
+// counts for nothing either way
+func (b *Breaker) record(ctx context.Context, err error) {
+	canceled := err != nil && errors.Is(ctx.Err(), context.Canceled)
+	if errors.Is(err, ErrNotFound) {
+		err = nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	half := b.state == BreakerHalfOpen
+	if half {
+		b.probing = false
+	}
+	if canceled {
+		return
+	}
+
+	// calls that went through before it opened don't count once it has
+	if b.state == BreakerOpen {
+		if err != nil {
+			b.stats.Failures++
+		}
+		return
+	}
+
+	if err != nil {
+		b.stats.Failures++
+		b.failures++
+		b.successes = 0
+		if half || b.failures >= b.Options.Failures {
+			fmt.Printf("store call failed, opening the breaker: %+v\n", err)
+			b.openedAt = b.Now()
+			b.stats.Opened++
+			b.transition(BreakerOpen)
+		}
+		return
+	}
+
+	b.failures = 0
+	if half {
+		b.successes++
+		if b.successes >= b.Options.Successes {
+			b.transition(BreakerClosed)
+		}
+	}
+}
+
+// transition changes state and logs it in a form a log metric filter can pick up,
+// it's called with the lock held
+func (b *Breaker) transition(state string) {
+	b.state = state
+	b.failures = 0
+	b.successes = 0
+	fmt.Printf("metric store_breaker state=%s failures=%d rejected=%d opened=%d\n",
+		state, b.stats.Failures, b.stats.Rejected, b.stats.Opened)
+}
@@ -0,0 +1,125 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	s := &counting{Store: cacheStore()}
+	b := store.NewBreaker(s, store.BreakerOptions{Failures: 3, CoolDown: 10 * time.Second, Successes: 2})
+	b.Now = func() time.Time {
+		return now
+	}
+
+	known := store.Credentials{AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c71"}
+	unknown := store.Credentials{AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c7f"}
+	find := func(creds store.Credentials) error {
+		_, err := b.FindAgent(ctx, creds)
+		return err
+	}
+
+	// not found is an answer
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, store.ErrNotFound, find(unknown))
+	}
+	assert.Equal(t, store.BreakerClosed, b.State())
+
+	// failures have to be in a row
+	s.err = errors.New("connection refused")
+	assert.Error(t, find(known))
+	assert.Error(t, find(known))
+	s.err = nil
+	assert.NoError(t, find(known))
+	s.err = errors.New("connection refused")
+	assert.Error(t, find(known))
+	assert.Error(t, find(known))
+	assert.Equal(t, store.BreakerClosed, b.State())
+	assert.Error(t, find(known))
+	assert.Equal(t, store.BreakerOpen, b.State())
+
+	// open doesn't ask the store
+	lookups := s.lookups
+	assert.Equal(t, store.ErrCircuitOpen, find(known))
+	_, err := b.Roles(ctx)
+	assert.Equal(t, store.ErrCircuitOpen, err)
+	assert.Equal(t, lookups, s.lookups)
+
+	// a failed probe opens it again
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, "connection refused", find(known).Error())
+	assert.Equal(t, store.BreakerOpen, b.State())
+	assert.Equal(t, store.ErrCircuitOpen, find(known))
+
+	// and it takes two good probes to close
+	now = now.Add(10 * time.Second)
+	s.err = nil
+	assert.NoError(t, find(known))
+	assert.Equal(t, store.BreakerHalfOpen, b.State())
+	assert.Equal(t, store.ErrNotFound, find(unknown))
+	assert.Equal(t, store.BreakerClosed, b.State())
+	assert.NoError(t, find(known))
+
+	assert.Equal(t, store.BreakerStats{
+		State:    store.BreakerClosed,
+		Failures: 6,
+		Rejected: 3,
+		Opened:   2,
+	}, b.Stats())
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	s := &counting{Store: cacheStore(), err: errors.New("connection refused")}
+	blocked := &blocking{Store: s, started: make(chan struct{}, 10), release: make(chan struct{})}
+	b := store.NewBreaker(blocked, store.BreakerOptions{Failures: 1})
+	b.Now = func() time.Time {
+		return now
+	}
+	creds := store.Credentials{AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c71"}
+
+	close(blocked.release)
+	_, err := b.FindAgent(context.Background(), creds)
+	assert.Error(t, err)
+	assert.Equal(t, store.BreakerOpen, b.State())
+	<-blocked.started
+
+	// one probe at a time, the rest are turned away while it's out
+	now = now.Add(store.DefaultBreakerCoolDown)
+	blocked.release = make(chan struct{})
+	s.err = nil
+	probe := make(chan error, 1)
+	go func() {
+		_, err := b.FindAgent(context.Background(), creds)
+		probe <- err
+	}()
+	<-blocked.started
+	_, err = b.FindAgent(context.Background(), creds)
+	assert.Equal(t, store.ErrCircuitOpen, err)
+
+	close(blocked.release)
+	assert.NoError(t, <-probe)
+	assert.Equal(t, store.BreakerClosed, b.State())
+	assert.Equal(t, int64(2), atomic.LoadInt64(&blocked.lookups))
+}
+
+func TestBreakerCanceled(t *testing.T) {
+	s := &counting{Store: cacheStore()}
+	b := store.NewBreaker(s, store.BreakerOptions{Failures: 1})
+
+	// a caller giving up isn't the store failing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.err = context.Canceled
+	_, err := b.FindAgent(ctx, store.Credentials{AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c71"})
+	assert.Error(t, err)
+	assert.Equal(t, store.BreakerClosed, b.State())
+}
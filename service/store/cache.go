@@ -0,0 +1,327 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/role"
+)
+
+// CacheOptions size the identity cache, zero values take the defaults
+type CacheOptions struct {
+	// TTL is how long a found agent is kept
+	TTL time.Duration
+
+	// NegativeTTL is how long credentials that matched nothing are kept, short so a
+	// new agent works soon after it's made but long enough to soak up enumeration
+	NegativeTTL time.Duration
+
+	// Size is the most entries kept, the least recently used go first
+	Size int
+
+	// LogEvery is how often the stats are logged, as they're seen on a lookup
+	LogEvery time.Duration
+
+	// Shared is asked before the store and kept up to date with what it answers, so
+	// containers share lookups, nil keeps everything in the container
+	Shared SharedCache
+}
+
+// SharedCache is a second level behind the container's own entries, keyed by the hex
+// of the credentials hash. A failure is logged and the store asked as if it missed
+type SharedCache interface {
+	// Get is the entry for the key, ok is false when there isn't one and found is
+	// false for credentials that matched nothing
+	Get(ctx context.Context, key string) (a Agent, found bool, ok bool, err error)
+
+	// Set keeps the entry for ttl
+	Set(ctx context.Context, key string, a Agent, found bool, ttl time.Duration) error
+}
+
+// Cache defaults
+const (
+	DefaultCacheTTL         = 30 * time.Second
+	DefaultCacheNegativeTTL = 5 * time.Second
+	DefaultCacheSize        = 10000
+	DefaultCacheLogEvery    = time.Minute
+)
+
+// CacheStats count what the cache has done since the container started
+type CacheStats struct {
+	Hits         int64
+	NegativeHits int64
+	Misses       int64
+	Evictions    int64
+	Size         int
+
+	// Coalesced is the misses that waited on a lookup already in flight rather than making their own
+	Coalesced int64
+
+	// SharedHits is the misses the shared cache answered
+	SharedHits int64
+}
+
+// Cache keeps the agents credentials resolved to in front of another store, keyed
+// by a hash of the credentials so secrets aren't held in memory any longer than
+// the request, roles aren't cached as the store already holds them. Concurrent
+// misses for the same credentials share one lookup, and with Options.Shared set
+// the containers share them too
+type Cache struct {
+	Store   Store
+	Options CacheOptions
+	Now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List
+	calls   map[[sha256.Size]byte]*cacheCall
+	stats   CacheStats
+	logged  time.Time
+}
+
+// cacheCall is a lookup in flight, done is closed once agent and err are set
+type cacheCall struct {
+	done     chan struct{}
+	agent    Agent
+	err      error
+	canceled bool
+}
+
+type cacheEntry struct {
+	key     [sha256.Size]byte
+	agent   Agent
+	found   bool
+	expires time.Time
+}
+
+// NewCache wraps the store
+func NewCache(s Store, o CacheOptions) *Cache {
+	if o.TTL <= 0 {
+		o.TTL = DefaultCacheTTL
+	}
+	if o.NegativeTTL <= 0 {
+		o.NegativeTTL = DefaultCacheNegativeTTL
+	}
+	if o.Size <= 0 {
+		o.Size = DefaultCacheSize
+	}
+	if o.LogEvery <= 0 {
+		o.LogEvery = DefaultCacheLogEvery
+	}
+
+	return &Cache{
+		Store:   s,
+		Options: o,
+		Now:     time.Now,
+		entries: map[[sha256.Size]byte]*list.Element{},
+		order:   list.New(),
+		calls:   map[[sha256.Size]byte]*cacheCall{},
+	}
+}
+
+// FindAgent answers from the cache when it can, only a found agent or ErrNotFound
+// are kept, any other error is the store's problem and the next request tries again
+func (c *Cache) FindAgent(ctx context.Context, creds Credentials) (Agent, error) {
+	key, ok := cacheKey(creds)
+	if !ok {
+		return c.Store.FindAgent(ctx, creds)
+	}
+
+	if a, found, ok := c.get(key); ok {
+		if !found {
+			return Agent{}, ErrNotFound
+		}
+		return a, nil
+	}
+
+	return c.lookup(ctx, key, creds)
+}
+
+// lookup asks the store, or waits for the lookup of the same credentials already
+// in flight. A waiter that's cancelled stops waiting without cancelling the lookup,
+// and if the lookup was cancelled by its own caller the waiters still able to wait
+// make their own
+func (c *Cache) lookup(ctx context.Context, key [sha256.Size]byte, creds Credentials) (Agent, error) {
+	for {
+		c.mu.Lock()
+		call, ok := c.calls[key]
+		if !ok {
+			break
+		}
+		c.stats.Coalesced++
+		c.mu.Unlock()
+
+		select {
+		case <-call.done:
+			if call.canceled && ctx.Err() == nil {
+				continue
+			}
+			return call.agent, call.err
+		case <-ctx.Done():
+			return Agent{}, ctx.Err()
+		}
+	}
+
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	var shared bool
+	call.agent, shared, call.err = c.find(ctx, key, creds)
+	call.canceled = call.err != nil && ctx.Err() != nil
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if shared {
+		c.stats.SharedHits++
+	}
+	switch {
+	case call.err == nil:
+		c.put(key, call.agent, true)
+	case errors.Is(call.err, ErrNotFound):
+		c.put(key, Agent{}, false)
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.agent, call.err
+}
+
+// find asks the shared cache and then the store, true when the shared cache answered
+func (c *Cache) find(ctx context.Context, key [sha256.Size]byte, creds Credentials) (Agent, bool, error) {
+	if c.Options.Shared == nil {
+		a, err := c.Store.FindAgent(ctx, creds)
+		return a, false, err
+	}
+
+	sharedKey := hex.EncodeToString(key[:])
+	a, found, ok, err := c.Options.Shared.Get(ctx, sharedKey)
+	if err != nil {
+		fmt.Printf("identity cache shared get: %v\n", err)
+	}
+	switch {
+	case ok && found:
+		return a, true, nil
+	case ok:
+		return Agent{}, true, ErrNotFound
+	}
+
+	a, err = c.Store.FindAgent(ctx, creds)
+	found = err == nil
+	if found || errors.Is(err, ErrNotFound) {
+		ttl := c.Options.TTL
+		if !found {
+			ttl = c.Options.NegativeTTL
+		}
+		if setErr := c.Options.Shared.Set(ctx, sharedKey, a, found, ttl); setErr != nil {
+			fmt.Printf("identity cache shared set: %v\n", setErr)
+		}
+	}
+	return a, false, err
+}
+
+// Roles are passed straight through
+func (c *Cache) Roles(ctx context.Context) (role.Roles, error) {
+	return c.Store.Roles(ctx)
+}
+
+// Stats is a snapshot of the counts
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.stats
+	s.Size = c.order.Len()
+	return s
+}
+
+func (c *Cache) get(key [sha256.Size]byte) (Agent, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.Now()
+	c.logStats(now)
+
+	el, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return Agent{}, false, false
+	}
+
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		c.stats.Misses++
+		return Agent{}, false, false
+	}
+
+	c.order.MoveToFront(el)
+	if e.found {
+		c.stats.Hits++
+	} else {
+		c.stats.NegativeHits++
+	}
+	return e.agent, e.found, true
+}
+
+// put adds the entry, it's called with the lock held
+func (c *Cache) put(key [sha256.Size]byte, a Agent, found bool) {
+	ttl := c.Options.TTL
+	if !found {
+		ttl = c.Options.NegativeTTL
+	}
+	e := &cacheEntry{
+		key:     key,
+		agent:   a,
+		found:   found,
+		expires: c.Now().Add(ttl),
+	}
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(e)
+	for c.order.Len() > c.Options.Size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// logStats writes the counts in a form a log metric filter can pick up, it's called with the lock held
+func (c *Cache) logStats(now time.Time) {
+	if c.logged.IsZero() {
+		c.logged = now
+		return
+	}
+	if now.Sub(c.logged) < c.Options.LogEvery {
+		return
+	}
+	c.logged = now
+	fmt.Printf("metric identity_cache hits=%d negative_hits=%d misses=%d coalesced=%d shared_hits=%d evictions=%d size=%d\n",
+		c.stats.Hits, c.stats.NegativeHits, c.stats.Misses, c.stats.Coalesced, c.stats.SharedHits, c.stats.Evictions, c.order.Len())
+}
+
+// cacheKey hashes the credentials the same way the store matches them, key and
+// secret before agent id, false when there's nothing to look up
+func cacheKey(creds Credentials) ([sha256.Size]byte, bool) {
+	switch {
+	case creds.Key != "" && creds.Secret != "":
+		return sha256.Sum256([]byte("key\x00" + creds.Key + "\x00" + creds.Secret)), true
+	case creds.AgentID != "":
+		return sha256.Sum256([]byte("agent\x00" + creds.AgentID)), true
+	default:
+		return [sha256.Size]byte{}, false
+	}
+}
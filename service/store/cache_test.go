@@ -0,0 +1,362 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/role"
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// counting is a store that counts lookups and can be made to fail
+type counting struct {
+	store.Store
+	lookups int
+	err     error
+}
+
+func (c *counting) FindAgent(ctx context.Context, creds store.Credentials) (store.Agent, error) {
+	c.lookups++
+	if c.err != nil {
+		return store.Agent{}, c.err
+	}
+	return c.Store.FindAgent(ctx, creds)
+}
+
+func cacheStore() *store.Memory {
+	return &store.Memory{
+		Agents: []store.MemoryAgent{
+			{
+				Agent:  store.Agent{ID: "ad4b99e1-dec8-4682-862a-6b017e7c7c70", Roles: []string{role.Ingest}},
+				Key:    "94365b00-c6df-483f-804e-363312750500",
+				Secret: "f7356946-5814-4b5e-ad45-0348a89576ef",
+			},
+			{
+				Agent: store.Agent{ID: "ad4b99e1-dec8-4682-862a-6b017e7c7c71", Roles: []string{role.Ingest}},
+			},
+			{
+				Agent: store.Agent{ID: "ad4b99e1-dec8-4682-862a-6b017e7c7c72", Roles: []string{role.Ingest}},
+			},
+		},
+	}
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC)
+	s := &counting{Store: cacheStore()}
+	c := store.NewCache(s, store.CacheOptions{TTL: time.Minute, NegativeTTL: 5 * time.Second, Size: 2})
+	c.Now = func() time.Time {
+		return now
+	}
+
+	keyAndSecret := store.Credentials{Key: "94365b00-c6df-483f-804e-363312750500", Secret: "f7356946-5814-4b5e-ad45-0348a89576ef"}
+	wrongSecret := store.Credentials{Key: "94365b00-c6df-483f-804e-363312750500", Secret: "f7356946-5814-4b5e-ad45-0348a89576e0"}
+
+	// found agents are kept for the ttl
+	for i := 0; i < 3; i++ {
+		a, err := c.FindAgent(ctx, keyAndSecret)
+		assert.NoError(t, err)
+		assert.Equal(t, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", a.ID)
+	}
+	assert.Equal(t, 1, s.lookups)
+
+	// a different secret for the same key is its own entry, and a negative one
+	for i := 0; i < 3; i++ {
+		_, err := c.FindAgent(ctx, wrongSecret)
+		assert.Equal(t, store.ErrNotFound, err)
+	}
+	assert.Equal(t, 2, s.lookups)
+
+	// the negative entry goes first
+	now = now.Add(5 * time.Second)
+	_, err := c.FindAgent(ctx, wrongSecret)
+	assert.Equal(t, store.ErrNotFound, err)
+	assert.Equal(t, 3, s.lookups)
+	_, err = c.FindAgent(ctx, keyAndSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, s.lookups)
+
+	now = now.Add(time.Minute)
+	_, err = c.FindAgent(ctx, keyAndSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, s.lookups)
+
+	// errors other than not found aren't kept
+	s.err = errors.New("connection refused")
+	_, err = c.FindAgent(ctx, store.Credentials{AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c71"})
+	assert.Error(t, err)
+	s.err = nil
+	_, err = c.FindAgent(ctx, store.Credentials{AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c71"})
+	assert.NoError(t, err)
+	assert.Equal(t, 6, s.lookups)
+
+	// nothing to look up is passed through
+	_, err = c.FindAgent(ctx, store.Credentials{})
+	assert.Equal(t, store.ErrNotFound, err)
+	assert.Equal(t, 7, s.lookups)
+
+	assert.Equal(t, store.CacheStats{
+		Hits:         3,
+		NegativeHits: 2,
+		Misses:       6,
+		Evictions:    1,
+		Size:         2,
+	}, c.Stats())
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	s := &counting{Store: cacheStore()}
+	c := store.NewCache(s, store.CacheOptions{Size: 2})
+	find := func(id string) {
+		_, err := c.FindAgent(ctx, store.Credentials{AgentID: id})
+		assert.NoError(t, err)
+	}
+
+	find("ad4b99e1-dec8-4682-862a-6b017e7c7c70")
+	find("ad4b99e1-dec8-4682-862a-6b017e7c7c71")
+	find("ad4b99e1-dec8-4682-862a-6b017e7c7c70")
+	find("ad4b99e1-dec8-4682-862a-6b017e7c7c72")
+	assert.Equal(t, 3, s.lookups)
+
+	// 71 was the least recently used
+	find("ad4b99e1-dec8-4682-862a-6b017e7c7c70")
+	assert.Equal(t, 3, s.lookups)
+	find("ad4b99e1-dec8-4682-862a-6b017e7c7c71")
+	assert.Equal(t, 4, s.lookups)
+}
+
+// blocking is a store whose lookups wait to be released, or for their context to end
+type blocking struct {
+	store.Store
+	lookups int64
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blocking) FindAgent(ctx context.Context, creds store.Credentials) (store.Agent, error) {
+	atomic.AddInt64(&b.lookups, 1)
+	b.started <- struct{}{}
+	select {
+	case <-b.release:
+		return b.Store.FindAgent(ctx, creds)
+	case <-ctx.Done():
+		return store.Agent{}, ctx.Err()
+	}
+}
+
+// waitCoalesced waits until n lookups are waiting on one in flight
+func waitCoalesced(t *testing.T, c *store.Cache, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Coalesced < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("coalesced %d, want %d", c.Stats().Coalesced, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheCoalesces(t *testing.T) {
+	ctx := context.Background()
+	s := &blocking{Store: cacheStore(), started: make(chan struct{}, 100), release: make(chan struct{})}
+	c := store.NewCache(s, store.CacheOptions{})
+	creds := store.Credentials{Key: "94365b00-c6df-483f-804e-363312750500", Secret: "f7356946-5814-4b5e-ad45-0348a89576ef"}
+
+	const callers = 50
+	ids := make([]string, callers)
+	errs := make([]error, callers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a, err := c.FindAgent(ctx, creds)
+			ids[i], errs[i] = a.ID, err
+		}(i)
+	}
+
+	<-s.started
+	waitCoalesced(t, c, callers-1)
+	close(s.release)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&s.lookups))
+	for i := 0; i < callers; i++ {
+		assert.NoError(t, errs[i])
+		assert.Equal(t, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", ids[i])
+	}
+
+	// and it's cached after
+	_, err := c.FindAgent(ctx, creds)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&s.lookups))
+}
+
+func TestCacheCoalescedCancel(t *testing.T) {
+	s := &blocking{Store: cacheStore(), started: make(chan struct{}, 100), release: make(chan struct{})}
+	c := store.NewCache(s, store.CacheOptions{})
+	creds := store.Credentials{AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c71"}
+
+	type result struct {
+		agent store.Agent
+		err   error
+	}
+	find := func(ctx context.Context) chan result {
+		r := make(chan result, 1)
+		go func() {
+			a, err := c.FindAgent(ctx, creds)
+			r <- result{a, err}
+		}()
+		return r
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	defer cancelLeader()
+	leader := find(leaderCtx)
+	<-s.started
+
+	waiterCtx, cancelWaiter := context.WithCancel(context.Background())
+	defer cancelWaiter()
+	waiter := find(waiterCtx)
+	patient := find(context.Background())
+	waitCoalesced(t, c, 2)
+
+	// a waiter that gives up doesn't take the lookup with it
+	cancelWaiter()
+	r := <-waiter
+	assert.Equal(t, context.Canceled, r.err)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&s.lookups))
+
+	// when the caller making the lookup gives up, the waiters left make their own
+	cancelLeader()
+	r = <-leader
+	assert.Equal(t, context.Canceled, r.err)
+	<-s.started
+	assert.Equal(t, int64(2), atomic.LoadInt64(&s.lookups))
+
+	close(s.release)
+	r = <-patient
+	assert.NoError(t, r.err)
+	assert.Equal(t, "ad4b99e1-dec8-4682-862a-6b017e7c7c71", r.agent.ID)
+}
+
+// shared is a shared cache held in the test, it ignores the ttl and can be made to fail
+type shared struct {
+	mu      sync.Mutex
+	entries map[string]*store.Agent
+	err     error
+}
+
+func (s *shared) Get(ctx context.Context, key string) (store.Agent, bool, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return store.Agent{}, false, false, s.err
+	}
+	a, ok := s.entries[key]
+	if !ok || a == nil {
+		return store.Agent{}, false, ok, nil
+	}
+	return *a, true, true, nil
+}
+
+func (s *shared) Set(ctx context.Context, key string, a store.Agent, found bool, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	s.entries[key] = nil
+	if found {
+		s.entries[key] = &a
+	}
+	return nil
+}
+
+func TestCacheShared(t *testing.T) {
+	ctx := context.Background()
+	s := &counting{Store: cacheStore()}
+	sh := &shared{entries: map[string]*store.Agent{}}
+	first := store.NewCache(s, store.CacheOptions{Shared: sh})
+	second := store.NewCache(s, store.CacheOptions{Shared: sh})
+
+	found := store.Credentials{AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c71"}
+	unknown := store.Credentials{AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c7f"}
+
+	// one container's lookup answers the other's
+	a, err := first.FindAgent(ctx, found)
+	assert.NoError(t, err)
+	_, err = first.FindAgent(ctx, unknown)
+	assert.Equal(t, store.ErrNotFound, err)
+	assert.Equal(t, 2, s.lookups)
+
+	b, err := second.FindAgent(ctx, found)
+	assert.NoError(t, err)
+	assert.Equal(t, a, b)
+	_, err = second.FindAgent(ctx, unknown)
+	assert.Equal(t, store.ErrNotFound, err)
+	assert.Equal(t, 2, s.lookups)
+	assert.Equal(t, int64(2), second.Stats().SharedHits)
+
+	// and is kept in the container as well
+	_, err = second.FindAgent(ctx, found)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), second.Stats().Hits)
+
+	// when the shared cache fails the store is asked
+	sh.err = errors.New("connection refused")
+	third := store.NewCache(s, store.CacheOptions{Shared: sh})
+	_, err = third.FindAgent(ctx, found)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, s.lookups)
+}
+
+// benchStore is a store with as many agents as a large customer base, FindAgent
+// scans them so a lookup costs something, the way a database round-trip does
+func benchStore(n int) *store.Memory {
+	m := &store.Memory{}
+	for i := 0; i < n; i++ {
+		m.Agents = append(m.Agents, store.MemoryAgent{
+			Agent:  store.Agent{ID: fmt.Sprintf("ad4b99e1-dec8-4682-862a-%012d", i), Roles: []string{role.Ingest}},
+			Key:    fmt.Sprintf("94365b00-c6df-483f-804e-%012d", i),
+			Secret: "f7356946-5814-4b5e-ad45-0348a89576ef",
+		})
+	}
+	return m
+}
+
+func BenchmarkFindAgentCold(b *testing.B) {
+	ctx := context.Background()
+	s := benchStore(10000)
+	creds := store.Credentials{Key: "94365b00-c6df-483f-804e-000000009999", Secret: "f7356946-5814-4b5e-ad45-0348a89576ef"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.FindAgent(ctx, creds); err != nil {
+			b.Fatalf("find agent: %v", err)
+		}
+	}
+}
+
+func BenchmarkFindAgentWarm(b *testing.B) {
+	ctx := context.Background()
+	c := store.NewCache(benchStore(10000), store.CacheOptions{TTL: time.Hour})
+	creds := store.Credentials{Key: "94365b00-c6df-483f-804e-000000009999", Secret: "f7356946-5814-4b5e-ad45-0348a89576ef"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.FindAgent(ctx, creds); err != nil {
+			b.Fatalf("find agent: %v", err)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/bugfixes/authorizer/service/role"
+)
+
+// DynamoKeyIndex is the global secondary index on the agent table agents are found by key with
+const DynamoKeyIndex = "key-index"
+
+// dynamoEncoder keeps empty lists, so a key scoped to nothing doesn't come back as one that isn't scoped
+var dynamoEncoder = dynamodbattribute.NewEncoder(func(e *dynamodbattribute.Encoder) {
+	e.EnableEmptyCollections = true
+})
+
+// DynamoTables are the table names, an agent table keyed by id with DynamoKeyIndex and a role table keyed by name
+type DynamoTables struct {
+	Agents string
+	Roles  string
+}
+
+// Dynamo is the Store backed by DynamoDB, each agent is one item with its company
+// and secrets in it and its company's roles already merged into its own, so a
+// lookup is one read
+type Dynamo struct {
+	client dynamodbiface.DynamoDBAPI
+	tables DynamoTables
+
+	// ReadOnly stops lookups recording when a secret was used, for tools like simulate
+	ReadOnly bool
+}
+
+// NewDynamo uses the client for the tables
+func NewDynamo(client dynamodbiface.DynamoDBAPI, tables DynamoTables) *Dynamo {
+	return &Dynamo{
+		client: client,
+		tables: tables,
+	}
+}
+
+// dynamoAgent is the agent item
+type dynamoAgent struct {
+	ID        string   `dynamodbav:"id"`
+	Key       string   `dynamodbav:"key,omitempty"`
+	CompanyID string   `dynamodbav:"companyId,omitempty"`
+	Status    string   `dynamodbav:"status,omitempty"`
+	Roles     []string `dynamodbav:"roles"`
+
+	// Scopes is null for a key that isn't scoped and an empty list for one scoped to nothing
+	Scopes []string `dynamodbav:"scopes"`
+
+	Company  dynamoCompany `dynamodbav:"company"`
+	UsageKey string        `dynamodbav:"usageKey,omitempty"`
+	IPAllow  []string      `dynamodbav:"ipAllow,omitempty"`
+	IPDeny   []string      `dynamodbav:"ipDeny,omitempty"`
+
+	NotBefore time.Time `dynamodbav:"notBefore"`
+	ExpiresAt time.Time `dynamodbav:"expiresAt"`
+	RevokedAt time.Time `dynamodbav:"revokedAt"`
+
+	Secrets []dynamoSecret `dynamodbav:"secrets"`
+}
+
+type dynamoCompany struct {
+	ID      string   `dynamodbav:"id,omitempty"`
+	Name    string   `dynamodbav:"name,omitempty"`
+	Status  string   `dynamodbav:"status,omitempty"`
+	Plan    string   `dynamodbav:"plan,omitempty"`
+	Monthly int64    `dynamodbav:"monthlyQuota,omitempty"`
+	Rate    float64  `dynamodbav:"rateLimit,omitempty"`
+	Burst   float64  `dynamodbav:"rateBurst,omitempty"`
+	IPAllow []string `dynamodbav:"ipAllow,omitempty"`
+	IPDeny  []string `dynamodbav:"ipDeny,omitempty"`
+}
+
+type dynamoSecret struct {
+	Generation int       `dynamodbav:"generation"`
+	Status     string    `dynamodbav:"status"`
+	Secret     string    `dynamodbav:"secret"`
+	CreatedAt  time.Time `dynamodbav:"createdAt"`
+	RetiresAt  time.Time `dynamodbav:"retiresAt"`
+	LastUsedAt time.Time `dynamodbav:"lastUsedAt"`
+}
+
+// dynamoRole is the role item, permissions are routes like "POST /bug"
+type dynamoRole struct {
+	Name        string   `dynamodbav:"name"`
+	Inherits    []string `dynamodbav:"inherits,omitempty"`
+	Permissions []string `dynamodbav:"permissions,omitempty"`
+}
+
+// FindAgent looks the agent up by id, or by key on the index and then any of its active secrets
+func (d *Dynamo) FindAgent(ctx context.Context, creds Credentials) (Agent, error) {
+	var item dynamoAgent
+	var err error
+	switch {
+	case creds.Key != "" && creds.Secret != "":
+		item, err = d.agentByKey(ctx, creds.Key)
+	case creds.AgentID != "":
+		item, err = d.agentByID(ctx, creds.AgentID)
+	default:
+		return Agent{}, ErrNotFound
+	}
+	if err != nil {
+		return Agent{}, err
+	}
+
+	a := item.agent()
+	if creds.Key == "" || creds.Secret == "" {
+		return a, nil
+	}
+
+	now := time.Now()
+	for i, s := range item.Secrets {
+		if s.Secret != creds.Secret || !s.secret().Active(now) {
+			continue
+		}
+		a.SecretGeneration = s.Generation
+		if !d.ReadOnly && now.Sub(s.LastUsedAt) > SecretUseResolution {
+			d.touchSecret(ctx, item.ID, i, s.Generation, now)
+		}
+		return a, nil
+	}
+
+	return Agent{}, ErrNotFound
+}
+
+func (d *Dynamo) agentByID(ctx context.Context, id string) (dynamoAgent, error) {
+	out, err := d.client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.tables.Agents),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(id)},
+		},
+	})
+	if err != nil {
+		return dynamoAgent{}, fmt.Errorf("dynamo find agent: %w", err)
+	}
+	if out.Item == nil {
+		return dynamoAgent{}, ErrNotFound
+	}
+
+	item := dynamoAgent{}
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &item); err != nil {
+		return dynamoAgent{}, fmt.Errorf("dynamo find agent unmarshal: %w", err)
+	}
+	return item, nil
+}
+
+func (d *Dynamo) agentByKey(ctx context.Context, key string) (dynamoAgent, error) {
+	out, err := d.client.QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                aws.String(d.tables.Agents),
+		IndexName:                aws.String(DynamoKeyIndex),
+		KeyConditionExpression:   aws.String("#key = :key"),
+		ExpressionAttributeNames: map[string]*string{"#key": aws.String("key")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":key": {S: aws.String(key)},
+		},
+		Limit: aws.Int64(1),
+	})
+	if err != nil {
+		return dynamoAgent{}, fmt.Errorf("dynamo find agent by key: %w", err)
+	}
+	if len(out.Items) == 0 {
+		return dynamoAgent{}, ErrNotFound
+	}
+
+	item := dynamoAgent{}
+	if err := dynamodbattribute.UnmarshalMap(out.Items[0], &item); err != nil {
+		return dynamoAgent{}, fmt.Errorf("dynamo find agent unmarshal: %w", err)
+	}
+	return item, nil
+}
+
+// touchSecret sets when the secret was last used, as long as a rotation hasn't moved it in the list since it was read
+func (d *Dynamo) touchSecret(ctx context.Context, agentID string, i, generation int, now time.Time) {
+	at, err := dynamodbattribute.Marshal(now)
+	if err != nil {
+		fmt.Printf("dynamo secret last used: %v\n", err)
+		return
+	}
+
+	_, err = d.client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.tables.Agents),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(agentID)},
+		},
+		UpdateExpression:    aws.String(fmt.Sprintf("SET secrets[%d].lastUsedAt = :now", i)),
+		ConditionExpression: aws.String(fmt.Sprintf("secrets[%d].generation = :generation", i)),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now":        at,
+			":generation": {N: aws.String(fmt.Sprint(generation))},
+		},
+	})
+	if err != nil {
+		fmt.Printf("dynamo secret last used: %v\n", err)
+	}
+}
+
+// Roles loads every role from the role table
+func (d *Dynamo) Roles(ctx context.Context) (role.Roles, error) {
+	rs := role.Roles{}
+
+	var unmarshalErr error
+	err := d.client.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName: aws.String(d.tables.Roles),
+	}, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, i := range out.Items {
+			item := dynamoRole{}
+			if err := dynamodbattribute.UnmarshalMap(i, &item); err != nil {
+				unmarshalErr = err
+				return false
+			}
+
+			rs.Add(item.Name, "", nil)
+			for _, parent := range item.Inherits {
+				rs.Add(item.Name, parent, nil)
+			}
+			for _, p := range item.Permissions {
+				route, err := policy.ParseRoute(p)
+				if err != nil {
+					unmarshalErr = fmt.Errorf("role %s: %w", item.Name, err)
+					return false
+				}
+				rs.Add(item.Name, "", &route)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamo roles: %w", err)
+	}
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("dynamo roles unmarshal: %w", unmarshalErr)
+	}
+
+	return rs, nil
+}
+
+// Import writes the agents and roles, replacing any with the same id or name, so an export can be run again
+func (d *Dynamo) Import(ctx context.Context, agents []MemoryAgent, roles role.Roles) error {
+	for _, a := range agents {
+		item, err := dynamoEncoder.Encode(newDynamoAgent(a))
+		if err != nil {
+			return fmt.Errorf("dynamo import agent %s: %w", a.ID, err)
+		}
+		_, err = d.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(d.tables.Agents),
+			Item:      item.M,
+		})
+		if err != nil {
+			return fmt.Errorf("dynamo import agent %s: %w", a.ID, err)
+		}
+	}
+
+	for name, r := range roles {
+		dr := dynamoRole{
+			Name:     name,
+			Inherits: r.Inherits,
+		}
+		for _, p := range r.Permissions {
+			dr.Permissions = append(dr.Permissions, p.String())
+		}
+		item, err := dynamodbattribute.MarshalMap(dr)
+		if err != nil {
+			return fmt.Errorf("dynamo import role %s: %w", name, err)
+		}
+		_, err = d.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(d.tables.Roles),
+			Item:      item,
+		})
+		if err != nil {
+			return fmt.Errorf("dynamo import role %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// CreateTables makes the agent table with its key index and the role table, on demand
+// capacity so there's nothing to size
+func (d *Dynamo) CreateTables(ctx context.Context) error {
+	_, err := d.client.CreateTableWithContext(ctx, &dynamodb.CreateTableInput{
+		TableName:   aws.String(d.tables.Agents),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("key"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(DynamoKeyIndex),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{AttributeName: aws.String("key"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+				},
+				Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("dynamo create agent table: %w", err)
+	}
+
+	_, err = d.client.CreateTableWithContext(ctx, &dynamodb.CreateTableInput{
+		TableName:   aws.String(d.tables.Roles),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("name"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("name"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("dynamo create role table: %w", err)
+	}
+
+	return nil
+}
+
+func newDynamoAgent(a MemoryAgent) dynamoAgent {
+	item := dynamoAgent{
+		ID:        a.ID,
+		Key:       a.Key,
+		CompanyID: a.CompanyID,
+		Status:    a.Status,
+		Roles:     a.Roles,
+		Scopes:    a.Scopes,
+		Company: dynamoCompany{
+			ID:      a.Company.ID,
+			Name:    a.Company.Name,
+			Status:  a.Company.Status,
+			Plan:    a.Company.Plan,
+			Monthly: a.Company.Limits.Monthly,
+			Rate:    a.Company.Limits.Rate,
+			Burst:   a.Company.Limits.Burst,
+			IPAllow: a.Company.IPAllow,
+			IPDeny:  a.Company.IPDeny,
+		},
+		UsageKey:  a.UsageKey,
+		IPAllow:   a.IPAllow,
+		IPDeny:    a.IPDeny,
+		NotBefore: a.NotBefore,
+		ExpiresAt: a.ExpiresAt,
+		RevokedAt: a.RevokedAt,
+	}
+	if a.Secret != "" {
+		item.Secrets = append(item.Secrets, dynamoSecret{Generation: 1, Status: SecretPrimary, Secret: a.Secret})
+	}
+	for _, s := range a.Secrets {
+		item.Secrets = append(item.Secrets, dynamoSecret{
+			Generation: s.Generation,
+			Status:     s.Status,
+			Secret:     s.Value,
+			CreatedAt:  s.CreatedAt,
+			RetiresAt:  s.RetiresAt,
+			LastUsedAt: s.LastUsedAt,
+		})
+	}
+	return item
+}
+
+func (item dynamoAgent) agent() Agent {
+	return Agent{
+		ID:        item.ID,
+		CompanyID: item.CompanyID,
+		Status:    item.Status,
+		Roles:     item.Roles,
+		Scopes:    item.Scopes,
+		Company: Company{
+			ID:     item.Company.ID,
+			Name:   item.Company.Name,
+			Status: item.Company.Status,
+			Plan:   item.Company.Plan,
+			Limits: Limits{
+				Monthly: item.Company.Monthly,
+				Rate:    item.Company.Rate,
+				Burst:   item.Company.Burst,
+			},
+			IPAllow: item.Company.IPAllow,
+			IPDeny:  item.Company.IPDeny,
+		},
+		UsageKey:  item.UsageKey,
+		IPAllow:   item.IPAllow,
+		IPDeny:    item.IPDeny,
+		NotBefore: item.NotBefore,
+		ExpiresAt: item.ExpiresAt,
+		RevokedAt: item.RevokedAt,
+	}
+}
+
+func (s dynamoSecret) secret() Secret {
+	return Secret{
+		Generation: s.Generation,
+		Status:     s.Status,
+		CreatedAt:  s.CreatedAt,
+		RetiresAt:  s.RetiresAt,
+		LastUsedAt: s.LastUsedAt,
+	}
+}
@@ -0,0 +1,166 @@
+package store_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/bugfixes/authorizer/service/role"
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// dynamoClient is a client for DynamoDB Local, started with
+// docker run -d -p 8000:8000 amazon/dynamodb-local
+func dynamoClient(t *testing.T) dynamodbiface.DynamoDBAPI {
+	t.Helper()
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_ENDPOINT isn't set")
+	}
+
+	sess, err := session.NewSession(aws.NewConfig().
+		WithEndpoint(endpoint).
+		WithRegion("eu-west-2").
+		WithCredentials(credentials.NewStaticCredentials("tester", "tester", "")))
+	if err != nil {
+		t.Fatalf("dynamo session: %v", err)
+	}
+	return dynamodb.New(sess)
+}
+
+func TestDynamo(t *testing.T) {
+	ctx := context.Background()
+	client := dynamoClient(t)
+	suffix := time.Now().UnixNano()
+	tables := store.DynamoTables{
+		Agents: fmt.Sprintf("agent-%d", suffix),
+		Roles:  fmt.Sprintf("role-%d", suffix),
+	}
+	d := store.NewDynamo(client, tables)
+	if err := d.CreateTables(ctx); err != nil {
+		t.Fatalf("create tables: %v", err)
+	}
+	defer func() {
+		for _, table := range []string{tables.Agents, tables.Roles} {
+			if _, err := client.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(table)}); err != nil {
+				t.Errorf("delete table %s: %v", table, err)
+			}
+		}
+	}()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	company := store.Company{
+		ID:      "b9e9153a-028c-4173-a7a8-e5063334416a",
+		Name:    "bugfixes test company",
+		Status:  store.CompanyActive,
+		Plan:    "business",
+		Limits:  store.Limits{Monthly: 1000000, Rate: 50, Burst: 100},
+		IPAllow: []string{"10.0.0.0/8"},
+	}
+	scoped := store.Agent{
+		ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+		CompanyID: company.ID,
+		Status:    store.AgentActive,
+		Roles:     []string{role.Ingest},
+		Scopes:    []string{},
+		Company:   company,
+		UsageKey:  "bugfixes-company-usage-key",
+		ExpiresAt: now.Add(time.Hour),
+	}
+	unscoped := store.Agent{
+		ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c71",
+		CompanyID: company.ID,
+		Roles:     []string{role.Operator},
+		Company:   company,
+	}
+	err := d.Import(ctx, []store.MemoryAgent{
+		{
+			Agent: scoped,
+			Key:   "94365b00-c6df-483f-804e-363312750500",
+			Secrets: []store.MemorySecret{
+				{Secret: store.Secret{Generation: 1, Status: store.SecretSecondary, RetiresAt: now.Add(-time.Minute)}, Value: "f7356946-5814-4b5e-ad45-0348a89576ef"},
+				{Secret: store.Secret{Generation: 2, Status: store.SecretSecondary, RetiresAt: now.Add(time.Hour)}, Value: "f7356946-5814-4b5e-ad45-0348a89576e1"},
+				{Secret: store.Secret{Generation: 3, Status: store.SecretPrimary}, Value: "f7356946-5814-4b5e-ad45-0348a89576e2"},
+			},
+		},
+		{
+			Agent: unscoped,
+		},
+	}, role.Roles{
+		role.Ingest:   {Name: role.Ingest, Permissions: []policy.Route{policy.NewRoute("POST", "/bug")}},
+		role.Operator: {Name: role.Operator, Inherits: []string{role.Ingest}, Permissions: []policy.Route{policy.NewRoute("GET", "/bug")}},
+	})
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	withGeneration := func(a store.Agent, generation int) store.Agent {
+		a.SecretGeneration = generation
+		return a
+	}
+	tests := []struct {
+		name   string
+		creds  store.Credentials
+		expect store.Agent
+		err    error
+	}{
+		{
+			name:   "agent id",
+			creds:  store.Credentials{AgentID: scoped.ID},
+			expect: scoped,
+		},
+		{
+			name:   "not scoped",
+			creds:  store.Credentials{AgentID: unscoped.ID},
+			expect: unscoped,
+		},
+		{
+			name:   "primary secret",
+			creds:  store.Credentials{Key: "94365b00-c6df-483f-804e-363312750500", Secret: "f7356946-5814-4b5e-ad45-0348a89576e2"},
+			expect: withGeneration(scoped, 3),
+		},
+		{
+			name:   "secondary secret",
+			creds:  store.Credentials{Key: "94365b00-c6df-483f-804e-363312750500", Secret: "f7356946-5814-4b5e-ad45-0348a89576e1"},
+			expect: withGeneration(scoped, 2),
+		},
+		{
+			name:  "retired secret",
+			creds: store.Credentials{Key: "94365b00-c6df-483f-804e-363312750500", Secret: "f7356946-5814-4b5e-ad45-0348a89576ef"},
+			err:   store.ErrNotFound,
+		},
+		{
+			name:  "unknown key",
+			creds: store.Credentials{Key: "94365b00-c6df-483f-804e-363312750501", Secret: "f7356946-5814-4b5e-ad45-0348a89576e2"},
+			err:   store.ErrNotFound,
+		},
+		{
+			name:  "unknown agent",
+			creds: store.Credentials{AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c7f"},
+			err:   store.ErrNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := d.FindAgent(ctx, test.creds)
+			assert.Equal(t, test.err, err)
+			assert.Equal(t, test.expect, a)
+		})
+	}
+
+	rs, err := d.Roles(ctx)
+	assert.NoError(t, err)
+	routes, unknown := rs.Resolve(role.Operator)
+	assert.Empty(t, unknown)
+	assert.ElementsMatch(t, []policy.Route{policy.NewRoute("GET", "/bug"), policy.NewRoute("POST", "/bug")}, routes)
+}
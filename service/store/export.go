@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/bugfixes/authorizer/service/role"
+)
+
+// Exporter lists every agent with its credentials, so they can be moved to another store
+type Exporter interface {
+	Export(ctx context.Context) ([]MemoryAgent, error)
+	Roles(ctx context.Context) (role.Roles, error)
+}
+
+// Importer takes agents and roles from an Exporter, replacing any it already has
+type Importer interface {
+	Import(ctx context.Context, agents []MemoryAgent, roles role.Roles) error
+}
+
+// Export lists every agent the same way FindAgent finds it, company roles merged
+// into its own, along with all its secrets, retired ones included
+func (p *Postgres) Export(ctx context.Context) ([]MemoryAgent, error) {
+	secrets, err := p.exportSecrets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.QueryContext(ctx, "SELECT id, COALESCE(key, '') FROM agent ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("postgres export: %w", err)
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			fmt.Printf("postgres export rows.close: %v\n", err)
+		}
+	}()
+
+	var agents []MemoryAgent
+	for rows.Next() {
+		a := MemoryAgent{}
+		if err := rows.Scan(&a.ID, &a.Key); err != nil {
+			return nil, fmt.Errorf("postgres export scan: %w", err)
+		}
+		agents = append(agents, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgres export rows: %w", err)
+	}
+
+	for i, a := range agents {
+		found, _, err := findAgent(ctx, p.db, Credentials{AgentID: a.ID})
+		if err != nil {
+			return nil, fmt.Errorf("postgres export agent %s: %w", a.ID, err)
+		}
+		agents[i].Agent = found
+		agents[i].Secrets = secrets[a.ID]
+	}
+
+	return agents, nil
+}
+
+func (p *Postgres) exportSecrets(ctx context.Context) (map[string][]MemorySecret, error) {
+	rows, err := p.db.QueryContext(ctx, `
+SELECT agent_id, generation, status, secret, created_at, retires_at, last_used_at
+FROM agent_secret
+ORDER BY agent_id, generation`)
+	if err != nil {
+		return nil, fmt.Errorf("postgres export secrets: %w", err)
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			fmt.Printf("postgres export secrets rows.close: %v\n", err)
+		}
+	}()
+
+	secrets := map[string][]MemorySecret{}
+	for rows.Next() {
+		var agentID string
+		s := MemorySecret{}
+		var retiresAt, lastUsedAt sql.NullTime
+		if err := rows.Scan(&agentID, &s.Generation, &s.Status, &s.Value, &s.CreatedAt, &retiresAt, &lastUsedAt); err != nil {
+			return nil, fmt.Errorf("postgres export secrets scan: %w", err)
+		}
+		if retiresAt.Valid {
+			s.RetiresAt = retiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			s.LastUsedAt = lastUsedAt.Time
+		}
+		secrets[agentID] = append(secrets[agentID], s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgres export secrets rows: %w", err)
+	}
+
+	return secrets, nil
+}
+
+// Export copies the agents, a lone Secret becomes the first generation
+func (m *Memory) Export(ctx context.Context) ([]MemoryAgent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var agents []MemoryAgent
+	for _, a := range m.Agents {
+		a = *m.agent(a.ID)
+		a.Secrets = append([]MemorySecret{}, a.Secrets...)
+		agents = append(agents, a)
+	}
+	return agents, nil
+}
+
+// Import adds the agents and roles, replacing any with the same id or name
+func (m *Memory) Import(ctx context.Context, agents []MemoryAgent, roles role.Roles) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, a := range agents {
+		if existing := m.agent(a.ID); existing != nil {
+			*existing = a
+			continue
+		}
+		m.Agents = append(m.Agents, a)
+	}
+
+	if m.RoleDefinitions == nil {
+		m.RoleDefinitions = role.Roles{}
+	}
+	for name, r := range roles {
+		m.RoleDefinitions[name] = r
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/bugfixes/authorizer/service/role"
+)
+
+// Fixture is the file format for a Memory store, so agents and roles can be written by hand
+type Fixture struct {
+	Companies []FixtureCompany       `json:"companies"`
+	Agents    []FixtureAgent         `json:"agents"`
+	Roles     map[string]FixtureRole `json:"roles"`
+}
+
+// FixtureCompany is a company, agents pick it up by companyId
+type FixtureCompany struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Status   string   `json:"status"`
+	Plan     string   `json:"plan"`
+	UsageKey string   `json:"usageKey"`
+	IPAllow  []string `json:"ipAllow"`
+	IPDeny   []string `json:"ipDeny"`
+	Limits   struct {
+		Monthly int64   `json:"monthly"`
+		Rate    float64 `json:"rate"`
+		Burst   float64 `json:"burst"`
+	} `json:"limits"`
+}
+
+// FixtureAgent is an agent and its credentials
+type FixtureAgent struct {
+	ID        string   `json:"id"`
+	CompanyID string   `json:"companyId"`
+	Roles     []string `json:"roles"`
+	Scopes    []string `json:"scopes"`
+	Status    string   `json:"status"`
+	UsageKey  string   `json:"usageKey"`
+	Key       string   `json:"key"`
+	Secret    string   `json:"secret"`
+
+	// Secrets are for agents part way through a rotation, instead of Secret
+	Secrets []FixtureSecret `json:"secrets"`
+
+	IPAllow []string `json:"ipAllow"`
+	IPDeny  []string `json:"ipDeny"`
+
+	NotBefore time.Time `json:"notBefore"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	RevokedAt time.Time `json:"revokedAt"`
+}
+
+// FixtureSecret is a generation of an agent's secret
+type FixtureSecret struct {
+	Generation int       `json:"generation"`
+	Status     string    `json:"status"`
+	Secret     string    `json:"secret"`
+	RetiresAt  time.Time `json:"retiresAt"`
+}
+
+// FixtureRole is a role, permissions are routes like "POST /bug"
+type FixtureRole struct {
+	Inherits    []string `json:"inherits"`
+	Permissions []string `json:"permissions"`
+}
+
+// LoadFixture reads a fixture file into a Memory store
+func LoadFixture(path string) (*Memory, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fixture load: %w", err)
+	}
+
+	return ParseFixture(b)
+}
+
+// ParseFixture builds a Memory store from a fixture already in memory
+func ParseFixture(b []byte) (*Memory, error) {
+	f := Fixture{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("fixture parse: %w", err)
+	}
+
+	m := &Memory{
+		RoleDefinitions: role.Roles{},
+	}
+	companies := map[string]FixtureCompany{}
+	for _, c := range f.Companies {
+		companies[c.ID] = c
+	}
+
+	for _, a := range f.Agents {
+		c := companies[a.CompanyID]
+		usageKey := a.UsageKey
+		if usageKey == "" {
+			usageKey = c.UsageKey
+		}
+
+		ma := MemoryAgent{
+			Agent: Agent{
+				ID:        a.ID,
+				CompanyID: a.CompanyID,
+				Roles:     a.Roles,
+				Scopes:    a.Scopes,
+				Status:    a.Status,
+				Company: Company{
+					ID:     c.ID,
+					Name:   c.Name,
+					Status: c.Status,
+					Plan:   c.Plan,
+					Limits: Limits{
+						Monthly: c.Limits.Monthly,
+						Rate:    c.Limits.Rate,
+						Burst:   c.Limits.Burst,
+					},
+					IPAllow: c.IPAllow,
+					IPDeny:  c.IPDeny,
+				},
+				UsageKey: usageKey,
+
+				IPAllow: a.IPAllow,
+				IPDeny:  a.IPDeny,
+
+				NotBefore: a.NotBefore,
+				ExpiresAt: a.ExpiresAt,
+				RevokedAt: a.RevokedAt,
+			},
+			Key:    a.Key,
+			Secret: a.Secret,
+		}
+		for _, s := range a.Secrets {
+			ma.Secrets = append(ma.Secrets, MemorySecret{
+				Secret: Secret{
+					Generation: s.Generation,
+					Status:     s.Status,
+					RetiresAt:  s.RetiresAt,
+				},
+				Value: s.Secret,
+			})
+		}
+		m.Agents = append(m.Agents, ma)
+	}
+
+	for name, r := range f.Roles {
+		def := role.Role{
+			Name:     name,
+			Inherits: r.Inherits,
+		}
+		for _, p := range r.Permissions {
+			route, err := policy.ParseRoute(p)
+			if err != nil {
+				return nil, fmt.Errorf("fixture role %s: %w", name, err)
+			}
+			def.Permissions = append(def.Permissions, route)
+		}
+		m.RoleDefinitions[name] = def
+	}
+
+	return m, nil
+}
@@ -0,0 +1,213 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/role"
+)
+
+// MemoryAgent is an agent with the credentials it's found by
+type MemoryAgent struct {
+	Agent
+	Key string
+
+	// Secret is a secret that never retires, it becomes the first of Secrets when the agent is rotated
+	Secret  string
+	Secrets []MemorySecret
+}
+
+// MemorySecret is a generation of an agent's secret along with the secret
+type MemorySecret struct {
+	Secret
+	Value string
+}
+
+// Memory is a Store held in memory, for tests and tooling that shouldn't need a database
+type Memory struct {
+	Agents          []MemoryAgent
+	RoleDefinitions role.Roles
+	StatusChanges   []StatusChange
+
+	mu sync.Mutex
+}
+
+// FindAgent matches the credentials the same way the postgres store does
+func (m *Memory) FindAgent(ctx context.Context, creds Credentials) (Agent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for i, a := range m.Agents {
+		switch {
+		case creds.Key != "" && creds.Secret != "":
+			if a.Key != creds.Key {
+				continue
+			}
+			if a.Secret != "" && a.Secret == creds.Secret {
+				a.Agent.SecretGeneration = 1
+				return a.Agent, nil
+			}
+			for j, s := range a.Secrets {
+				if s.Value == creds.Secret && s.Active(now) {
+					m.Agents[i].Secrets[j].LastUsedAt = now
+					a.Agent.SecretGeneration = s.Generation
+					return a.Agent, nil
+				}
+			}
+		case creds.AgentID != "":
+			if a.ID == creds.AgentID {
+				return a.Agent, nil
+			}
+		}
+	}
+
+	return Agent{}, ErrNotFound
+}
+
+// Roles returns the role definitions
+func (m *Memory) Roles(ctx context.Context) (role.Roles, error) {
+	if m.RoleDefinitions == nil {
+		return role.Roles{}, nil
+	}
+	return m.RoleDefinitions, nil
+}
+
+// Secrets lists the generations of the agent's secret
+func (m *Memory) Secrets(ctx context.Context, agentID string) ([]Secret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := m.agent(agentID)
+	if a == nil {
+		return nil, ErrNotFound
+	}
+
+	var secrets []Secret
+	for _, s := range a.Secrets {
+		secrets = append(secrets, s.Secret)
+	}
+	return secrets, nil
+}
+
+// Rotate adds the new primary secret and retires the rest after overlap
+func (m *Memory) Rotate(ctx context.Context, agentID, secret string, overlap time.Duration) (Secret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := m.agent(agentID)
+	if a == nil {
+		return Secret{}, ErrNotFound
+	}
+
+	now := time.Now()
+	retiresAt := now.Add(overlap)
+	generation := 0
+	for i, s := range a.Secrets {
+		if s.Generation > generation {
+			generation = s.Generation
+		}
+		if s.RetiresAt.IsZero() || s.RetiresAt.After(retiresAt) {
+			a.Secrets[i].Status = SecretSecondary
+			a.Secrets[i].RetiresAt = retiresAt
+		}
+	}
+
+	s := Secret{
+		Generation: generation + 1,
+		Status:     SecretPrimary,
+		CreatedAt:  now,
+	}
+	a.Secrets = append(a.Secrets, MemorySecret{Secret: s, Value: secret})
+	return s, nil
+}
+
+// Retire stops a secondary secret working
+func (m *Memory) Retire(ctx context.Context, agentID string, generation int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := m.agent(agentID)
+	if a == nil {
+		return ErrNotFound
+	}
+
+	now := time.Now()
+	for i, s := range a.Secrets {
+		if s.Generation != generation {
+			continue
+		}
+		if s.Status == SecretPrimary {
+			return ErrPrimarySecret
+		}
+		if s.Active(now) {
+			a.Secrets[i].RetiresAt = now
+		}
+		return nil
+	}
+	return ErrSecretNotFound
+}
+
+// agent finds the agent to change its secrets, a lone Secret becomes the first generation
+func (m *Memory) agent(id string) *MemoryAgent {
+	for i := range m.Agents {
+		a := &m.Agents[i]
+		if a.ID != id {
+			continue
+		}
+		if a.Secret != "" {
+			a.Secrets = append([]MemorySecret{{
+				Secret: Secret{Generation: 1, Status: SecretPrimary},
+				Value:  a.Secret,
+			}}, a.Secrets...)
+			a.Secret = ""
+		}
+		return a
+	}
+	return nil
+}
+
+// SetStatus changes the agent's status and records the change
+func (m *Memory) SetStatus(ctx context.Context, agentID, status, by, note string) (StatusChange, error) {
+	if err := checkStatusChange(status, by); err != nil {
+		return StatusChange{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := m.agent(agentID)
+	if a == nil {
+		return StatusChange{}, ErrNotFound
+	}
+
+	c := StatusChange{
+		AgentID: agentID,
+		From:    a.Status,
+		To:      status,
+		By:      by,
+		Note:    note,
+		At:      time.Now(),
+	}
+	if c.From == "" {
+		c.From = AgentActive
+	}
+	a.Status = status
+	m.StatusChanges = append(m.StatusChanges, c)
+	return c, nil
+}
+
+// StatusHistory is the agent's status changes, oldest first
+func (m *Memory) StatusHistory(ctx context.Context, agentID string) ([]StatusChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var changes []StatusChange
+	for _, c := range m.StatusChanges {
+		if c.AgentID == agentID {
+			changes = append(changes, c)
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,437 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/policy"
+	"github.com/bugfixes/authorizer/service/role"
+	"github.com/lib/pq"
+)
+
+// ConnectDetails for the postgres database
+type ConnectDetails struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	Database string
+
+	// Replicas are read replicas for credential lookups, as host or host:port
+	Replicas []string
+}
+
+// DSN builds the lib/pq connection string
+func (c ConnectDetails) DSN() string {
+	return fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		c.Host,
+		c.Port,
+		c.Username,
+		c.Password,
+		c.Database)
+}
+
+// Postgres is the Store backed by the agent and role tables, lookups go to the
+// replicas when there are any and everything else to the primary
+type Postgres struct {
+	db       *sql.DB
+	replicas []*replica
+	next     uint32
+
+	// ReadOnly stops lookups recording when a secret was used, for tools like simulate
+	ReadOnly bool
+}
+
+// NewPostgres opens the connection pools, they're kept for the life of the container
+func NewPostgres(c ConnectDetails) (*Postgres, error) {
+	db, err := sql.Open("postgres", c.DSN())
+	if err != nil {
+		return nil, fmt.Errorf("postgres open: %w", err)
+	}
+
+	p := &Postgres{
+		db: db,
+	}
+	for _, r := range c.ReplicaDetails() {
+		rdb, err := sql.Open("postgres", r.DSN())
+		if err != nil {
+			return nil, fmt.Errorf("postgres open replica %s: %w", r.Host, err)
+		}
+		p.replicas = append(p.replicas, &replica{host: net.JoinHostPort(r.Host, r.Port), db: rdb})
+	}
+
+	return p, nil
+}
+
+// DB is the primary's connection pool, so other postgres backed parts can share it
+// and their writes don't go to a replica
+func (p *Postgres) DB() *sql.DB {
+	return p.db
+}
+
+const agentQuery = `
+SELECT a.id, COALESCE(a.company_id::text, ''), a.status,
+  ARRAY(
+    SELECT r.name FROM agent_role ar JOIN role r ON r.id = ar.role_id WHERE ar.agent_id = a.id
+    UNION
+    SELECT r.name FROM company_role cr JOIN role r ON r.id = cr.role_id WHERE cr.company_id = a.company_id
+  ),
+  a.scopes,
+  COALESCE(c.id::text, ''), COALESCE(c.name, ''), COALESCE(c.status, ''), COALESCE(c.plan, ''),
+  COALESCE(c.monthly_quota, 0), COALESCE(c.rate_limit, 0), COALESCE(c.rate_burst, 0),
+  COALESCE(a.usage_key, c.usage_key, ''),
+  a.ip_allow::text[], a.ip_deny::text[], c.ip_allow::text[], c.ip_deny::text[],
+  a.not_before, a.expires_at, a.revoked_at,
+  COALESCE(s.generation, 0), s.last_used_at
+FROM agent a
+  LEFT JOIN company c ON c.id = a.company_id
+  LEFT JOIN agent_secret s ON s.agent_id = a.id AND s.secret = $2 AND (s.retires_at IS NULL OR s.retires_at > now())`
+
+// SecretUseResolution is how stale last_used_at can get before a request updates it,
+// so every request isn't a write
+const SecretUseResolution = time.Hour
+
+// FindAgent looks the agent up by id, or by key and any of its active secrets, along with
+// its company, its roles and its company's, the scopes on the key and where it can be used from
+func (p *Postgres) FindAgent(ctx context.Context, creds Credentials) (Agent, error) {
+	if creds.Empty() {
+		return Agent{}, ErrNotFound
+	}
+
+	var a Agent
+	var lastUsedAt sql.NullTime
+	err := p.read(ctx, func(db *sql.DB) error {
+		var err error
+		a, lastUsedAt, err = findAgent(ctx, db, creds)
+		return err
+	})
+	if err != nil {
+		return Agent{}, err
+	}
+
+	if !p.ReadOnly && a.SecretGeneration > 0 && (!lastUsedAt.Valid || time.Since(lastUsedAt.Time) > SecretUseResolution) {
+		_, err := p.db.ExecContext(ctx, "UPDATE agent_secret SET last_used_at = now() WHERE agent_id = $1 AND generation = $2", a.ID, a.SecretGeneration)
+		if err != nil {
+			fmt.Printf("postgres secret last used: %v\n", err)
+		}
+	}
+
+	return a, nil
+}
+
+// findAgent is the lookup itself, against the primary or a replica
+func findAgent(ctx context.Context, db *sql.DB, creds Credentials) (Agent, sql.NullTime, error) {
+	var row *sql.Row
+	switch {
+	case creds.Key != "" && creds.Secret != "":
+		row = db.QueryRowContext(ctx, agentQuery+" WHERE a.key = $1 AND s.generation IS NOT NULL", creds.Key, creds.Secret)
+	default:
+		row = db.QueryRowContext(ctx, agentQuery+" WHERE a.id = $1", creds.AgentID, "")
+	}
+
+	a := Agent{}
+	var notBefore, expiresAt, revokedAt, lastUsedAt sql.NullTime
+	err := row.Scan(
+		&a.ID,
+		&a.CompanyID,
+		&a.Status,
+		pq.Array(&a.Roles),
+		pq.Array(&a.Scopes),
+		&a.Company.ID,
+		&a.Company.Name,
+		&a.Company.Status,
+		&a.Company.Plan,
+		&a.Company.Limits.Monthly,
+		&a.Company.Limits.Rate,
+		&a.Company.Limits.Burst,
+		&a.UsageKey,
+		pq.Array(&a.IPAllow),
+		pq.Array(&a.IPDeny),
+		pq.Array(&a.Company.IPAllow),
+		pq.Array(&a.Company.IPDeny),
+		&notBefore,
+		&expiresAt,
+		&revokedAt,
+		&a.SecretGeneration,
+		&lastUsedAt)
+	if err == sql.ErrNoRows {
+		return Agent{}, lastUsedAt, ErrNotFound
+	}
+	if err != nil {
+		return Agent{}, lastUsedAt, fmt.Errorf("postgres find agent: %w", err)
+	}
+	if notBefore.Valid {
+		a.NotBefore = notBefore.Time
+	}
+	if expiresAt.Valid {
+		a.ExpiresAt = expiresAt.Time
+	}
+	if revokedAt.Valid {
+		a.RevokedAt = revokedAt.Time
+	}
+
+	return a, lastUsedAt, nil
+}
+
+// Secrets lists the generations of the agent's secret
+func (p *Postgres) Secrets(ctx context.Context, agentID string) ([]Secret, error) {
+	rows, err := p.db.QueryContext(ctx, `
+SELECT generation, status, created_at, retires_at, last_used_at
+FROM agent_secret
+WHERE agent_id = $1
+ORDER BY generation`, agentID)
+	if err != nil {
+		return nil, fmt.Errorf("postgres secrets: %w", err)
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			fmt.Printf("postgres secrets rows.close: %v\n", err)
+		}
+	}()
+
+	var secrets []Secret
+	for rows.Next() {
+		s := Secret{}
+		var retiresAt, lastUsedAt sql.NullTime
+		if err := rows.Scan(&s.Generation, &s.Status, &s.CreatedAt, &retiresAt, &lastUsedAt); err != nil {
+			return nil, fmt.Errorf("postgres secrets scan: %w", err)
+		}
+		if retiresAt.Valid {
+			s.RetiresAt = retiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			s.LastUsedAt = lastUsedAt.Time
+		}
+		secrets = append(secrets, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgres secrets rows: %w", err)
+	}
+
+	return secrets, nil
+}
+
+// Rotate adds the new primary secret and retires the rest after overlap, the agent row
+// is locked so two rotations can't take the same generation
+func (p *Postgres) Rotate(ctx context.Context, agentID, secret string, overlap time.Duration) (Secret, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Secret{}, fmt.Errorf("postgres rotate begin: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			fmt.Printf("postgres rotate rollback: %v\n", err)
+		}
+	}()
+
+	var id string
+	err = tx.QueryRowContext(ctx, "SELECT id FROM agent WHERE id = $1 FOR UPDATE", agentID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return Secret{}, ErrNotFound
+	}
+	if err != nil {
+		return Secret{}, fmt.Errorf("postgres rotate agent: %w", err)
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+UPDATE agent_secret SET status = $2, retires_at = $3
+WHERE agent_id = $1 AND (retires_at IS NULL OR retires_at > $3)`, agentID, SecretSecondary, now.Add(overlap))
+	if err != nil {
+		return Secret{}, fmt.Errorf("postgres rotate retire: %w", err)
+	}
+
+	s := Secret{
+		Status:    SecretPrimary,
+		CreatedAt: now,
+	}
+	err = tx.QueryRowContext(ctx, `
+INSERT INTO agent_secret (agent_id, generation, secret, status, created_at)
+SELECT $1, COALESCE(MAX(generation), 0) + 1, $2, $3, $4 FROM agent_secret WHERE agent_id = $1
+RETURNING generation`, agentID, secret, s.Status, s.CreatedAt).Scan(&s.Generation)
+	if err != nil {
+		return Secret{}, fmt.Errorf("postgres rotate insert: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Secret{}, fmt.Errorf("postgres rotate commit: %w", err)
+	}
+	return s, nil
+}
+
+// Retire stops a secondary secret working
+func (p *Postgres) Retire(ctx context.Context, agentID string, generation int) error {
+	var status string
+	err := p.db.QueryRowContext(ctx, "SELECT status FROM agent_secret WHERE agent_id = $1 AND generation = $2", agentID, generation).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrSecretNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("postgres retire: %w", err)
+	}
+	if status == SecretPrimary {
+		return ErrPrimarySecret
+	}
+
+	_, err = p.db.ExecContext(ctx, `
+UPDATE agent_secret SET retires_at = now()
+WHERE agent_id = $1 AND generation = $2 AND (retires_at IS NULL OR retires_at > now())`, agentID, generation)
+	if err != nil {
+		return fmt.Errorf("postgres retire: %w", err)
+	}
+	return nil
+}
+
+// Roles loads every role with its permissions and inheritance
+func (p *Postgres) Roles(ctx context.Context) (role.Roles, error) {
+	var rs role.Roles
+	err := p.read(ctx, func(db *sql.DB) error {
+		var err error
+		rs, err = roles(ctx, db)
+		return err
+	})
+	return rs, err
+}
+
+// roles is the load itself, against the primary or a replica
+func roles(ctx context.Context, db *sql.DB) (role.Roles, error) {
+	rs := role.Roles{}
+
+	rows, err := db.QueryContext(ctx, `
+SELECT r.name, p.verb, p.resource
+FROM role r
+  LEFT JOIN role_permission p ON p.role_id = r.id`)
+	if err != nil {
+		return nil, fmt.Errorf("postgres roles: %w", err)
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			fmt.Printf("postgres roles rows.close: %v\n", err)
+		}
+	}()
+	for rows.Next() {
+		var name string
+		var verb, resource sql.NullString
+		if err := rows.Scan(&name, &verb, &resource); err != nil {
+			return nil, fmt.Errorf("postgres roles scan: %w", err)
+		}
+
+		if !verb.Valid {
+			rs.Add(name, "", nil)
+			continue
+		}
+		route := policy.NewRoute(verb.String, resource.String)
+		rs.Add(name, "", &route)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgres roles rows: %w", err)
+	}
+
+	inherits, err := db.QueryContext(ctx, `
+SELECT r.name, parent.name
+FROM role_inherit i
+  JOIN role r ON r.id = i.role_id
+  JOIN role parent ON parent.id = i.inherits_id`)
+	if err != nil {
+		return nil, fmt.Errorf("postgres role inherits: %w", err)
+	}
+	defer func() {
+		err := inherits.Close()
+		if err != nil {
+			fmt.Printf("postgres role inherits rows.close: %v\n", err)
+		}
+	}()
+	for inherits.Next() {
+		var name, parent string
+		if err := inherits.Scan(&name, &parent); err != nil {
+			return nil, fmt.Errorf("postgres role inherits scan: %w", err)
+		}
+		rs.Add(name, parent, nil)
+	}
+	if err := inherits.Err(); err != nil {
+		return nil, fmt.Errorf("postgres role inherits rows: %w", err)
+	}
+
+	return rs, nil
+}
+
+// SetStatus changes the agent's status and records the change in agent_status_change,
+// both in one transaction with the agent row locked so the history has no gaps
+func (p *Postgres) SetStatus(ctx context.Context, agentID, status, by, note string) (StatusChange, error) {
+	if err := checkStatusChange(status, by); err != nil {
+		return StatusChange{}, err
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return StatusChange{}, fmt.Errorf("postgres set status begin: %w", err)
+	}
+
+	c := StatusChange{
+		AgentID: agentID,
+		To:      status,
+		By:      by,
+		Note:    note,
+	}
+	err = tx.QueryRowContext(ctx, "SELECT status FROM agent WHERE id = $1 FOR UPDATE", agentID).Scan(&c.From)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "UPDATE agent SET status = $2 WHERE id = $1", agentID, status)
+	}
+	if err == nil {
+		err = tx.QueryRowContext(ctx, `
+INSERT INTO agent_status_change (agent_id, from_status, to_status, changed_by, note) VALUES ($1, $2, $3, $4, $5)
+RETURNING changed_at`, agentID, c.From, c.To, c.By, c.Note).Scan(&c.At)
+	}
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			fmt.Printf("postgres set status rollback: %v\n", rbErr)
+		}
+		if err == sql.ErrNoRows {
+			return StatusChange{}, ErrNotFound
+		}
+		return StatusChange{}, fmt.Errorf("postgres set status: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return StatusChange{}, fmt.Errorf("postgres set status commit: %w", err)
+	}
+	return c, nil
+}
+
+// StatusHistory reads the agent's status changes, oldest first
+func (p *Postgres) StatusHistory(ctx context.Context, agentID string) ([]StatusChange, error) {
+	rows, err := p.db.QueryContext(ctx, `
+SELECT from_status, to_status, changed_by, note, changed_at
+FROM agent_status_change
+WHERE agent_id = $1
+ORDER BY changed_at, id`, agentID)
+	if err != nil {
+		return nil, fmt.Errorf("postgres status history: %w", err)
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			fmt.Printf("postgres status history rows.close: %v\n", err)
+		}
+	}()
+
+	var changes []StatusChange
+	for rows.Next() {
+		c := StatusChange{AgentID: agentID}
+		if err := rows.Scan(&c.From, &c.To, &c.By, &c.Note, &c.At); err != nil {
+			return nil, fmt.Errorf("postgres status history scan: %w", err)
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgres status history rows: %w", err)
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,307 @@
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/role"
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/assert"
+)
+
+type AgentData struct {
+	ID        string
+	Key       string
+	Secret    string
+	CompanyID string
+	Name      string
+	Roles     []string
+}
+
+func injectAgent(db *sql.DB, data AgentData) error {
+	_, err := db.Exec(
+		"INSERT INTO agent (id, key, company_id, name) VALUES ($1, $2, $3, $4)",
+		data.ID,
+		data.Key,
+		data.CompanyID,
+		data.Name)
+	if err != nil {
+		return fmt.Errorf("injectAgent db.exec: %w", err)
+	}
+	_, err = db.Exec(
+		"INSERT INTO agent_secret (agent_id, generation, secret, status, created_at) VALUES ($1, 1, $2, 'primary', now())",
+		data.ID,
+		data.Secret)
+	if err != nil {
+		return fmt.Errorf("injectAgent secret db.exec: %w", err)
+	}
+	for _, r := range data.Roles {
+		_, err = db.Exec(
+			"INSERT INTO agent_role (agent_id, role_id) SELECT $1, id FROM role WHERE name = $2",
+			data.ID,
+			r)
+		if err != nil {
+			return fmt.Errorf("injectAgent role db.exec: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func deleteAgent(db *sql.DB, id string) error {
+	_, err := db.Exec("DELETE FROM agent WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("deleteAgent db.exec: %w", err)
+	}
+
+	return nil
+}
+
+// migration is the statement in structure.sql that starts with prefix
+func migration(t *testing.T, prefix string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile("../../.ci/dev/structure.sql")
+	if err != nil {
+		t.Fatalf("read structure: %v", err)
+	}
+	s := string(b)
+	start := strings.Index(s, prefix)
+	if start == -1 {
+		t.Fatalf("no statement starting %s", prefix)
+	}
+	end := strings.Index(s[start:], ";")
+	return s[start : start+end]
+}
+
+func TestPostgres(t *testing.T) {
+	if os.Getenv("GITHUB_ACTOR") == "" {
+		err := godotenv.Load("../../.env")
+		if err != nil {
+			t.Errorf("godotenv err: %v", err)
+		}
+	}
+	details := store.ConnectDetails{
+		Host:     os.Getenv("DB_HOSTNAME"),
+		Port:     os.Getenv("DB_PORT"),
+		Username: os.Getenv("DB_USERNAME"),
+		Password: os.Getenv("DB_PASSWORD"),
+		Database: os.Getenv("DB_DATABASE"),
+	}
+
+	db, err := sql.Open("postgres", details.DSN())
+	if err != nil {
+		t.Fatalf("db.open: %v", err)
+	}
+	defer func() {
+		err := db.Close()
+		if err != nil {
+			fmt.Printf("db.close: %v", err)
+		}
+	}()
+
+	p, err := store.NewPostgres(details)
+	if err != nil {
+		t.Fatalf("new postgres: %v", err)
+	}
+
+	agent := AgentData{
+		ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+		Key:       "94365b00-c6df-483f-804e-363312750500",
+		Secret:    "f7356946-5814-4b5e-ad45-0348a89576ef",
+		CompanyID: "b9e9153a-028c-4173-a7a8-e5063334416a",
+		Name:      "bugfixes test frontend -- postgres store",
+		Roles:     []string{role.Operator},
+	}
+
+	// the company goes in first for the foreign key, its usage key is used as the agent doesn't have one
+	_, err = db.Exec(
+		"INSERT INTO company (id, name, plan, usage_key) VALUES ($1, $2, $3, $4)",
+		agent.CompanyID,
+		"bugfixes test company",
+		"business",
+		"bugfixes-company-usage-key")
+	if err != nil {
+		t.Fatalf("inject company err: %v", err)
+	}
+	defer func() {
+		if _, err := db.Exec("DELETE FROM company WHERE id = $1", agent.CompanyID); err != nil {
+			t.Errorf("delete company err: %v", err)
+		}
+	}()
+
+	if err := injectAgent(db, agent); err != nil {
+		t.Fatalf("inject err: %v", err)
+	}
+	defer func() {
+		if err := deleteAgent(db, agent.ID); err != nil {
+			t.Errorf("delete err: %v", err)
+		}
+	}()
+
+	tests := []struct {
+		name   string
+		creds  store.Credentials
+		expect store.Agent
+		err    error
+	}{
+		{
+			name:  "agent id",
+			creds: store.Credentials{AgentID: agent.ID},
+			expect: store.Agent{
+				ID:        agent.ID,
+				CompanyID: agent.CompanyID,
+				Status:    store.AgentActive,
+				Roles:     []string{role.Operator},
+				Company: store.Company{
+					ID:     agent.CompanyID,
+					Name:   "bugfixes test company",
+					Status: store.CompanyActive,
+					Plan:   "business",
+				},
+				UsageKey: "bugfixes-company-usage-key",
+			},
+		},
+		{
+			name:  "key and secret",
+			creds: store.Credentials{Key: agent.Key, Secret: agent.Secret},
+			expect: store.Agent{
+				ID:        agent.ID,
+				CompanyID: agent.CompanyID,
+				Status:    store.AgentActive,
+				Roles:     []string{role.Operator},
+				Company: store.Company{
+					ID:     agent.CompanyID,
+					Name:   "bugfixes test company",
+					Status: store.CompanyActive,
+					Plan:   "business",
+				},
+				UsageKey: "bugfixes-company-usage-key",
+
+				SecretGeneration: 1,
+			},
+		},
+		{
+			name:  "wrong secret",
+			creds: store.Credentials{Key: agent.Key, Secret: "f7356946-5814-4b5e-ad45-0348a89576e0"},
+			err:   store.ErrNotFound,
+		},
+		{
+			name:  "unknown agent id",
+			creds: store.Credentials{AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c71"},
+			err:   store.ErrNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := p.FindAgent(context.Background(), test.creds)
+			assert.Equal(t, test.err, err)
+			assert.Equal(t, test.expect, a)
+		})
+	}
+
+	// both secrets work during the overlap, and the old one stops once it's retired
+	ctx := context.Background()
+	rotated, err := p.Rotate(ctx, agent.ID, "f7356946-5814-4b5e-ad45-0348a89576e1", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rotated.Generation)
+
+	// a read only lookup, as simulate does, doesn't mark the secret as used
+	p.ReadOnly = true
+	_, err = p.FindAgent(ctx, store.Credentials{Key: agent.Key, Secret: "f7356946-5814-4b5e-ad45-0348a89576e1"})
+	assert.NoError(t, err)
+	p.ReadOnly = false
+	unused, err := p.Secrets(ctx, agent.ID)
+	assert.NoError(t, err)
+	assert.True(t, unused[1].LastUsedAt.IsZero())
+
+	a, err := p.FindAgent(ctx, store.Credentials{Key: agent.Key, Secret: "f7356946-5814-4b5e-ad45-0348a89576e1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, a.SecretGeneration)
+	a, err = p.FindAgent(ctx, store.Credentials{Key: agent.Key, Secret: agent.Secret})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, a.SecretGeneration)
+
+	assert.Equal(t, store.ErrPrimarySecret, p.Retire(ctx, agent.ID, 2))
+	assert.NoError(t, p.Retire(ctx, agent.ID, 1))
+	_, err = p.FindAgent(ctx, store.Credentials{Key: agent.Key, Secret: agent.Secret})
+	assert.Equal(t, store.ErrNotFound, err)
+
+	secrets, err := p.Secrets(ctx, agent.ID)
+	assert.NoError(t, err)
+	assert.Len(t, secrets, 2)
+	assert.Equal(t, store.SecretSecondary, secrets[0].Status)
+	assert.False(t, secrets[0].LastUsedAt.IsZero())
+	assert.Equal(t, store.SecretPrimary, secrets[1].Status)
+
+	// an agent from before roles is made an operator by the migration, as it could call everything
+	legacy := "ad4b99e1-dec8-4682-862a-6b017e7c7c7a"
+	if _, err := db.Exec("INSERT INTO agent (id, name) VALUES ($1, $2)", legacy, "bugfixes test agent -- from before roles"); err != nil {
+		t.Fatalf("inject legacy err: %v", err)
+	}
+	defer func() {
+		if err := deleteAgent(db, legacy); err != nil {
+			t.Errorf("delete legacy err: %v", err)
+		}
+	}()
+	_, err = db.Exec(migration(t, `INSERT INTO "agent_role"`))
+	assert.NoError(t, err)
+	a, err = p.FindAgent(ctx, store.Credentials{AgentID: legacy})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{role.Operator}, a.Roles)
+	a, err = p.FindAgent(ctx, store.Credentials{AgentID: agent.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{role.Operator}, a.Roles)
+
+	rs, err := p.Roles(context.Background())
+	assert.NoError(t, err)
+	routes, unknown := rs.Resolve(role.Operator)
+	assert.Empty(t, unknown)
+	assert.NotEmpty(t, routes)
+
+	// a replica that can't be reached is failed over and left out
+	replicated := details
+	replicated.Replicas = []string{"127.0.0.1:1", net.JoinHostPort(details.Host, details.Port)}
+	rp, err := store.NewPostgres(replicated)
+	if err != nil {
+		t.Fatalf("new postgres with replicas: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		a, err = rp.FindAgent(ctx, store.Credentials{AgentID: agent.ID})
+		assert.NoError(t, err)
+		assert.Equal(t, agent.ID, a.ID)
+	}
+	// not found from a replica is checked with the primary, and doesn't fail the replica
+	_, err = rp.FindAgent(ctx, store.Credentials{AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c7b"})
+	assert.Equal(t, store.ErrNotFound, err)
+	replicas := rp.Replicas()
+	assert.Len(t, replicas, 2)
+	assert.Equal(t, "127.0.0.1:1", replicas[0].Host)
+	assert.False(t, replicas[0].Healthy)
+	assert.NotEmpty(t, replicas[0].LastError)
+	assert.True(t, replicas[1].Healthy)
+}
+
+func TestReplicaDetails(t *testing.T) {
+	details := store.ConnectDetails{
+		Host:     "primary.internal",
+		Port:     "5432",
+		Username: "authorizer",
+		Password: "tester",
+		Database: "bugfixes",
+		Replicas: []string{"replica-1.internal", "replica-2.internal:6432"},
+	}
+
+	assert.Equal(t, []store.ConnectDetails{
+		{Host: "replica-1.internal", Port: "5432", Username: "authorizer", Password: "tester", Database: "bugfixes"},
+		{Host: "replica-2.internal", Port: "6432", Username: "authorizer", Password: "tester", Database: "bugfixes"},
+	}, details.ReplicaDetails())
+}
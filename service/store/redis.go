@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisCache is the identity cache's shared level, each entry is the agent as json
+// under identity: and expires with the ttl it was set with
+type RedisCache struct {
+	client *redis.Client
+}
+
+type redisEntry struct {
+	Found bool   `json:"found"`
+	Agent *Agent `json:"agent,omitempty"`
+}
+
+// NewRedisCache uses the client the other shared parts have
+func NewRedisCache(c *redis.Client) *RedisCache {
+	return &RedisCache{
+		client: c,
+	}
+}
+
+// Get reads the entry
+func (r *RedisCache) Get(ctx context.Context, key string) (Agent, bool, bool, error) {
+	v, err := r.client.Get(ctx, "identity:"+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Agent{}, false, false, nil
+	}
+	if err != nil {
+		return Agent{}, false, false, fmt.Errorf("redis cache get: %w", err)
+	}
+
+	e := redisEntry{}
+	if err := json.Unmarshal(v, &e); err != nil {
+		return Agent{}, false, false, fmt.Errorf("redis cache decode: %w", err)
+	}
+	if !e.Found || e.Agent == nil {
+		return Agent{}, false, true, nil
+	}
+	return *e.Agent, true, true, nil
+}
+
+// Set writes the entry
+func (r *RedisCache) Set(ctx context.Context, key string, a Agent, found bool, ttl time.Duration) error {
+	e := redisEntry{Found: found}
+	if found {
+		e.Agent = &a
+	}
+	v, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("redis cache encode: %w", err)
+	}
+
+	if err := r.client.Set(ctx, "identity:"+key, v, ttl).Err(); err != nil {
+		return fmt.Errorf("redis cache set: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+	m := miniredis.RunT(t)
+	c := redis.NewClient(&redis.Options{Addr: m.Addr()})
+
+	r := store.NewRedisCache(c)
+	_, _, ok, err := r.Get(ctx, "test-found")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	a := store.Agent{
+		ID:        "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+		CompanyID: "a4c2b5d8-5b8e-4a8a-9f43-6f2d7b4c1e10",
+		Roles:     []string{"ingest"},
+		Scopes:    []string{},
+		ExpiresAt: time.Date(2021, time.March, 16, 10, 0, 0, 0, time.UTC),
+	}
+	assert.NoError(t, r.Set(ctx, "test-found", a, true, time.Minute))
+	got, found, ok, err := r.Get(ctx, "test-found")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, found)
+	assert.Equal(t, a, got)
+
+	assert.NoError(t, r.Set(ctx, "test-unknown", store.Agent{}, false, 50*time.Millisecond))
+	_, found, ok, err = r.Get(ctx, "test-unknown")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, found)
+
+	m.FastForward(100 * time.Millisecond)
+	_, _, ok, err = r.Get(ctx, "test-unknown")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReplicaRetry is how long a replica that failed is left out before it's tried again
+const ReplicaRetry = 30 * time.Second
+
+// ReplicaStatus is how a replica was last seen
+type ReplicaStatus struct {
+	Host      string
+	Healthy   bool
+	DownUntil time.Time
+	LastError string
+}
+
+// ReplicaDetails are the connection details for one of the replicas, they're host or
+// host:port and take everything else, the port included, from the primary
+func (c ConnectDetails) ReplicaDetails() []ConnectDetails {
+	var replicas []ConnectDetails
+	for _, r := range c.Replicas {
+		d := c
+		d.Host, d.Replicas = r, nil
+		if host, port, err := net.SplitHostPort(r); err == nil {
+			d.Host, d.Port = host, port
+		}
+		replicas = append(replicas, d)
+	}
+	return replicas
+}
+
+// replica is a read-only copy of the database, left out for ReplicaRetry after it fails
+type replica struct {
+	host string
+	db   *sql.DB
+
+	mu        sync.Mutex
+	downUntil time.Time
+	lastError string
+}
+
+func (r *replica) healthy(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return !now.Before(r.downUntil)
+}
+
+func (r *replica) fail(now time.Time, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.downUntil = now.Add(ReplicaRetry)
+	r.lastError = err.Error()
+}
+
+func (r *replica) status(now time.Time) ReplicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := ReplicaStatus{
+		Host:      r.host,
+		Healthy:   !now.Before(r.downUntil),
+		LastError: r.lastError,
+	}
+	if !s.Healthy {
+		s.DownUntil = r.downUntil
+	}
+	return s
+}
+
+// Replicas is how each replica was last seen
+func (p *Postgres) Replicas() []ReplicaStatus {
+	now := time.Now()
+	var s []ReplicaStatus
+	for _, r := range p.replicas {
+		s = append(s, r.status(now))
+	}
+	return s
+}
+
+// readers are the pools to read from in order, the healthy replicas starting with
+// the next in turn so reads are spread between them, and the primary last
+func (p *Postgres) readers(now time.Time) []*replica {
+	var readers []*replica
+	if n := len(p.replicas); n > 0 {
+		start := int(atomic.AddUint32(&p.next, 1) % uint32(n))
+		for i := 0; i < n; i++ {
+			if r := p.replicas[(start+i)%n]; r.healthy(now) {
+				readers = append(readers, r)
+			}
+		}
+	}
+	return append(readers, &replica{db: p.db})
+}
+
+// read runs the query against a replica, failing over to the next and then the
+// primary, a caller that's given up doesn't fail a replica. Not found from a replica
+// is asked of the primary, the replica may not have caught up with an agent made just now
+func (p *Postgres) read(ctx context.Context, query func(db *sql.DB) error) error {
+	var err error
+	for _, r := range p.readers(time.Now()) {
+		err = query(r.db)
+		if err == nil || ctx.Err() != nil || r.host == "" {
+			return err
+		}
+		if errors.Is(err, ErrNotFound) {
+			return query(p.db)
+		}
+		fmt.Printf("postgres replica %s failed, trying the next: %v\n", r.host, err)
+		r.fail(time.Now(), err)
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Secret statuses, new secrets are primary and the ones they replace are secondary until they retire
+const (
+	SecretPrimary   = "primary"
+	SecretSecondary = "secondary"
+)
+
+// ErrSecretNotFound is returned when the agent has no secret of that generation
+var ErrSecretNotFound = errors.New("secret not found")
+
+// ErrPrimarySecret is returned when retiring the secret a rotation hasn't replaced yet
+var ErrPrimarySecret = errors.New("secret is the primary, rotate it first")
+
+// Secret is one generation of an agent's secret, without the secret itself
+type Secret struct {
+	Generation int
+	Status     string
+	CreatedAt  time.Time
+
+	// RetiresAt is when the secret stops working, zero until a rotation replaces it
+	RetiresAt time.Time
+
+	// LastUsedAt is roughly when the secret was last presented, zero if it never has been
+	LastUsedAt time.Time
+}
+
+// Active is true when the secret still works at the time
+func (s Secret) Active(now time.Time) bool {
+	return s.RetiresAt.IsZero() || now.Before(s.RetiresAt)
+}
+
+// Rotator manages the secrets of an agent, so a new one can be handed out
+// while SDKs using the old one keep working
+type Rotator interface {
+	Secrets(ctx context.Context, agentID string) ([]Secret, error)
+
+	// Rotate adds secret as the new primary and retires the others after overlap
+	Rotate(ctx context.Context, agentID, secret string, overlap time.Duration) (Secret, error)
+
+	// Retire stops a secondary secret working straight away
+	Retire(ctx context.Context, agentID string, generation int) error
+}
+
+// NewSecret makes a random secret in the same uuid form as the original secrets
+func NewSecret() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("new secret: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
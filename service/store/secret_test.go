@@ -0,0 +1,69 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRotate(t *testing.T) {
+	ctx := context.Background()
+	m := &store.Memory{
+		Agents: []store.MemoryAgent{
+			{
+				Agent:  store.Agent{ID: "ad4b99e1-dec8-4682-862a-6b017e7c7c70"},
+				Key:    "94365b00-c6df-483f-804e-363312750500",
+				Secret: "f7356946-5814-4b5e-ad45-0348a89576ef",
+			},
+		},
+	}
+	find := func(secret string) (int, error) {
+		a, err := m.FindAgent(ctx, store.Credentials{Key: "94365b00-c6df-483f-804e-363312750500", Secret: secret})
+		return a.SecretGeneration, err
+	}
+
+	generation, err := find("f7356946-5814-4b5e-ad45-0348a89576ef")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, generation)
+
+	// the old secret keeps working alongside the new one until the overlap is up
+	s, err := m.Rotate(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "f7356946-5814-4b5e-ad45-0348a89576e1", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, s.Generation)
+	assert.Equal(t, store.SecretPrimary, s.Status)
+
+	generation, err = find("f7356946-5814-4b5e-ad45-0348a89576ef")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, generation)
+	generation, err = find("f7356946-5814-4b5e-ad45-0348a89576e1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, generation)
+
+	secrets, err := m.Secrets(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c70")
+	assert.NoError(t, err)
+	assert.Len(t, secrets, 2)
+	assert.Equal(t, store.SecretSecondary, secrets[0].Status)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), secrets[0].RetiresAt, time.Minute)
+	assert.False(t, secrets[0].LastUsedAt.IsZero())
+	assert.True(t, secrets[1].RetiresAt.IsZero())
+
+	// a second rotation doesn't push the first secret's retirement back
+	_, err = m.Rotate(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", "f7356946-5814-4b5e-ad45-0348a89576e2", 2*time.Hour)
+	assert.NoError(t, err)
+	secrets, err = m.Secrets(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c70")
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), secrets[0].RetiresAt, time.Minute)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), secrets[1].RetiresAt, time.Minute)
+
+	assert.Equal(t, store.ErrPrimarySecret, m.Retire(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", 3))
+	assert.Equal(t, store.ErrSecretNotFound, m.Retire(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", 4))
+	assert.NoError(t, m.Retire(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c70", 1))
+	_, err = find("f7356946-5814-4b5e-ad45-0348a89576ef")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	_, err = m.Rotate(ctx, "ad4b99e1-dec8-4682-862a-6b017e7c7c71", "f7356946-5814-4b5e-ad45-0348a89576e3", time.Hour)
+	assert.Equal(t, store.ErrNotFound, err)
+}
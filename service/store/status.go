@@ -0,0 +1,51 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Agent statuses, an agent without one is active
+const (
+	AgentActive       = "active"
+	AgentDisabled     = "disabled"
+	AgentPausedIngest = "paused-ingest"
+	AgentDeleted      = "deleted"
+)
+
+// ValidAgentStatus is true for the statuses an agent can be set to
+func ValidAgentStatus(s string) bool {
+	switch s {
+	case AgentActive, AgentDisabled, AgentPausedIngest, AgentDeleted:
+		return true
+	default:
+		return false
+	}
+}
+
+// StatusChange is the audit record of an agent moving from one status to another
+type StatusChange struct {
+	AgentID string
+	From    string
+	To      string
+	By      string
+	Note    string
+	At      time.Time
+}
+
+// StatusKeeper changes agents' statuses and keeps the history of the changes
+type StatusKeeper interface {
+	SetStatus(ctx context.Context, agentID, status, by, note string) (StatusChange, error)
+	StatusHistory(ctx context.Context, agentID string) ([]StatusChange, error)
+}
+
+func checkStatusChange(status, by string) error {
+	if !ValidAgentStatus(status) {
+		return fmt.Errorf("unknown agent status: %s", status)
+	}
+	if by == "" {
+		return fmt.Errorf("status change needs who made it")
+	}
+	return nil
+}
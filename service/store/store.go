@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/bugfixes/authorizer/service/role"
+)
+
+// ErrNotFound is returned when no agent matches the credentials
+var ErrNotFound = errors.New("agent not found")
+
+// Credentials are what an agent presents in the request headers, either
+// just the agent id or a key and secret pair
+type Credentials struct {
+	AgentID string
+	Key     string
+	Secret  string
+}
+
+// CredentialsFromHeaders pulls the credentials out of the request headers,
+// API Gateway passes headers through in whatever case the client sent them
+func CredentialsFromHeaders(headers map[string]string) Credentials {
+	c := Credentials{}
+	for k, v := range headers {
+		switch strings.ToLower(k) {
+		case "x-agent-id":
+			c.AgentID = v
+		case "x-api-key":
+			c.Key = v
+		case "x-api-secret":
+			c.Secret = v
+		}
+	}
+
+	return c
+}
+
+// Empty is true when there is nothing to look an agent up by
+func (c Credentials) Empty() bool {
+	return c.AgentID == "" && (c.Key == "" || c.Secret == "")
+}
+
+// Agent is the identity the credentials resolved to
+type Agent struct {
+	ID        string
+	CompanyID string
+	Roles     []string
+
+	// Scopes narrow what the key can do, nil means the key isn't scoped
+	// and an empty list means it's scoped to nothing
+	Scopes []string
+
+	// Status is one of the agent statuses, empty for agents from before there were any
+	Status string
+
+	// Company is the company the agent belongs to, empty when it has none
+	Company Company
+
+	// UsageKey is the API Gateway api key value for usage plans, the agent's own or else its company's
+	UsageKey string
+
+	// IPAllow and IPDeny are the addresses and CIDRs the agent's credentials can and can't be used from
+	IPAllow []string
+	IPDeny  []string
+
+	// NotBefore and ExpiresAt are when the credentials start and stop working, zero for no bound
+	NotBefore time.Time
+	ExpiresAt time.Time
+
+	// RevokedAt is when the credentials were revoked, zero unless they have been
+	RevokedAt time.Time
+
+	// SecretGeneration is the generation of the secret the agent presented, 0 when found by id
+	SecretGeneration int
+}
+
+// Company statuses, agents of suspended and deleted companies are denied
+const (
+	CompanyActive    = "active"
+	CompanyTrial     = "trial"
+	CompanySuspended = "suspended"
+	CompanyDeleted   = "deleted"
+)
+
+// Company is the customer agents belong to
+type Company struct {
+	ID     string
+	Name   string
+	Status string
+
+	// Plan is the pricing plan, it picks the limits that apply
+	Plan string
+
+	// Limits are the company's own, where they're set they replace the plan's
+	Limits Limits
+
+	// IPAllow and IPDeny apply to every agent of the company
+	IPAllow []string
+	IPDeny  []string
+}
+
+// Limits override a plan for one company, zero keeps the plan's
+type Limits struct {
+	// Monthly is the requests a month
+	Monthly int64
+
+	// Rate and Burst are the token bucket shared by the company's agents
+	Rate  float64
+	Burst float64
+}
+
+// Scoped is true when the key is limited to its scopes
+func (a Agent) Scoped() bool {
+	return a.Scopes != nil
+}
+
+// Store looks up agents and the roles they can hold
+type Store interface {
+	FindAgent(ctx context.Context, creds Credentials) (Agent, error)
+	Roles(ctx context.Context) (role.Roles, error)
+}
@@ -0,0 +1,56 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/bugfixes/authorizer/service/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentialsFromHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		expect  store.Credentials
+		empty   bool
+	}{
+		{
+			name: "agent id",
+			headers: map[string]string{
+				"x-agent-id": "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+			},
+			expect: store.Credentials{
+				AgentID: "ad4b99e1-dec8-4682-862a-6b017e7c7c70",
+			},
+		},
+		{
+			name: "key and secret any case",
+			headers: map[string]string{
+				"X-Api-Key":    "94365b00-c6df-483f-804e-363312750500",
+				"X-API-SECRET": "f7356946-5814-4b5e-ad45-0348a89576ef",
+			},
+			expect: store.Credentials{
+				Key:    "94365b00-c6df-483f-804e-363312750500",
+				Secret: "f7356946-5814-4b5e-ad45-0348a89576ef",
+			},
+		},
+		{
+			name: "key without secret",
+			headers: map[string]string{
+				"x-api-key": "94365b00-c6df-483f-804e-363312750500",
+			},
+			expect: store.Credentials{
+				Key: "94365b00-c6df-483f-804e-363312750500",
+			},
+			empty: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			creds := store.CredentialsFromHeaders(test.headers)
+			assert.Equal(t, test.expect, creds)
+			assert.Equal(t, test.empty, creds.Empty())
+		})
+	}
+}